@@ -2,9 +2,13 @@ package dns
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/netip"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sagernet/sing/common"
@@ -19,8 +23,13 @@ import (
 )
 
 const (
-	DefaultTTL     = 600
-	DefaultTimeout = 10 * time.Second
+	DefaultTTL            = 600
+	DefaultTimeout        = 10 * time.Second
+	DefaultServeStaleTTL  = 24 * time.Hour
+	DefaultPrefetchRatio  = 0.1
+	DefaultNegativeTTL    = 60
+	DefaultMaxNegativeTTL = 3600
+	StaleAnswerTTL        = 30
 )
 
 var (
@@ -35,11 +44,28 @@ type Client struct {
 	disableCache     bool
 	disableExpire    bool
 	independentCache bool
+	serveStale       bool
+	serveStaleTTL    time.Duration
+	prefetch         bool
+	prefetchRatio    float64
+	negativeTTL      uint32
+	maxNegativeTTL   uint32
+	minTTL           uint32
+	maxTTL           uint32
+	cachePath        string
 	rdrc             RDRCStore
 	initRDRCFunc     func() RDRCStore
 	logger           logger.ContextLogger
-	cache            freelru.Cache[dns.Question, *dns.Msg]
-	transportCache   freelru.Cache[transportCacheKey, *dns.Msg]
+	cache            freelru.Cache[dns.Question, *cacheEntry]
+	transportCache   freelru.Cache[transportCacheKey, *cacheEntry]
+	subnetCache      freelru.Cache[subnetCacheKey, *cacheEntry]
+	refreshAccess    sync.Mutex
+	refreshing       map[transportCacheKey]struct{}
+	inFlightAccess   sync.Mutex
+	inFlight         map[transportCacheKey]*inFlightExchange
+	stats            cacheStats
+	validator        *dnssecValidator
+	health           *HealthTracker
 }
 
 type RDRCStore interface {
@@ -53,13 +79,31 @@ type transportCacheKey struct {
 	transportName string
 }
 
+type cacheEntry struct {
+	message  *dns.Msg
+	expireAt time.Time
+	removed  atomic.Bool
+}
+
 type ClientOptions struct {
 	Timeout          time.Duration
 	DisableCache     bool
 	DisableExpire    bool
 	IndependentCache bool
 	CacheCapacity    uint32
+	ServeStale       bool
+	ServeStaleTTL    time.Duration
+	Prefetch         bool
+	PrefetchRatio    float64
+	NegativeTTL      uint32
+	MaxNegativeTTL   uint32
+	MinTTL           uint32
+	MaxTTL           uint32
+	CachePath        string
 	RDRC             func() RDRCStore
+	DNSSEC           bool
+	TrustAnchors     []*dns.DS
+	Health           *HealthTracker
 	Logger           logger.ContextLogger
 }
 
@@ -69,22 +113,63 @@ func NewClient(options ClientOptions) *Client {
 		disableCache:     options.DisableCache,
 		disableExpire:    options.DisableExpire,
 		independentCache: options.IndependentCache,
+		serveStale:       options.ServeStale && !options.DisableCache && !options.DisableExpire,
+		serveStaleTTL:    options.ServeStaleTTL,
+		prefetch:         options.Prefetch && !options.DisableCache && !options.DisableExpire,
+		prefetchRatio:    options.PrefetchRatio,
+		negativeTTL:      options.NegativeTTL,
+		maxNegativeTTL:   options.MaxNegativeTTL,
+		minTTL:           options.MinTTL,
+		maxTTL:           options.MaxTTL,
+		cachePath:        options.CachePath,
 		initRDRCFunc:     options.RDRC,
+		health:           options.Health,
 		logger:           options.Logger,
+		refreshing:       make(map[transportCacheKey]struct{}),
+		inFlight:         make(map[transportCacheKey]*inFlightExchange),
 	}
 	if client.timeout == 0 {
 		client.timeout = DefaultTimeout
 	}
+	if client.serveStaleTTL == 0 {
+		client.serveStaleTTL = DefaultServeStaleTTL
+	}
+	if client.prefetchRatio <= 0 || client.prefetchRatio >= 1 {
+		client.prefetchRatio = DefaultPrefetchRatio
+	}
+	if client.negativeTTL == 0 {
+		client.negativeTTL = DefaultNegativeTTL
+	}
+	if client.maxNegativeTTL == 0 {
+		client.maxNegativeTTL = DefaultMaxNegativeTTL
+	}
 	cacheCapacity := options.CacheCapacity
+	if options.DNSSEC {
+		client.validator = newDNSSECValidator(options.TrustAnchors)
+	}
 	if cacheCapacity < 1024 {
 		cacheCapacity = 1024
 	}
 	if !client.disableCache {
 		if !client.independentCache {
-			client.cache = common.Must1(freelru.NewSharded[dns.Question, *dns.Msg](cacheCapacity, maphash.NewHasher[dns.Question]().Hash32))
+			client.cache = common.Must1(freelru.NewSharded[dns.Question, *cacheEntry](cacheCapacity, maphash.NewHasher[dns.Question]().Hash32))
+			client.cache.SetOnEvict(func(_ dns.Question, entry *cacheEntry) {
+				client.stats.evict(nil, entry)
+			})
 		} else {
-			client.transportCache = common.Must1(freelru.NewSharded[transportCacheKey, *dns.Msg](cacheCapacity, maphash.NewHasher[transportCacheKey]().Hash32))
+			client.transportCache = common.Must1(freelru.NewSharded[transportCacheKey, *cacheEntry](cacheCapacity, maphash.NewHasher[transportCacheKey]().Hash32))
+			client.transportCache.SetOnEvict(func(key transportCacheKey, entry *cacheEntry) {
+				client.stats.evict(&key.transportName, entry)
+			})
 		}
+		client.subnetCache = common.Must1(freelru.NewSharded[subnetCacheKey, *cacheEntry](cacheCapacity, maphash.NewHasher[subnetCacheKey]().Hash32))
+		client.subnetCache.SetOnEvict(func(key subnetCacheKey, entry *cacheEntry) {
+			if client.independentCache {
+				client.stats.evict(&key.transportName, entry)
+			} else {
+				client.stats.evict(nil, entry)
+			}
+		})
 	}
 	return client
 }
@@ -93,6 +178,12 @@ func (c *Client) Start() {
 	if c.initRDRCFunc != nil {
 		c.rdrc = c.initRDRCFunc()
 	}
+	if c.cachePath != "" && !c.disableCache {
+		err := c.loadCacheFile()
+		if err != nil && !os.IsNotExist(err) && c.logger != nil {
+			c.logger.Warn(E.Cause(err, "load cache file"))
+		}
+	}
 }
 
 func (c *Client) Exchange(ctx context.Context, transport Transport, message *dns.Msg, options QueryOptions) (*dns.Msg, error) {
@@ -100,6 +191,10 @@ func (c *Client) Exchange(ctx context.Context, transport Transport, message *dns
 }
 
 func (c *Client) ExchangeWithResponseCheck(ctx context.Context, transport Transport, message *dns.Msg, options QueryOptions, responseChecker func(responseAddrs []netip.Addr) bool) (*dns.Msg, error) {
+	return c.exchange(ctx, transport, message, options, responseChecker, false)
+}
+
+func (c *Client) exchange(ctx context.Context, transport Transport, message *dns.Msg, options QueryOptions, responseChecker func(responseAddrs []netip.Addr) bool, refresh bool) (*dns.Msg, error) {
 	if len(message.Question) == 0 {
 		if c.logger != nil {
 			c.logger.WarnContext(ctx, "bad question size: ", len(message.Question))
@@ -121,15 +216,37 @@ func (c *Client) ExchangeWithResponseCheck(ctx context.Context, transport Transp
 	isSimpleRequest := len(message.Question) == 1 &&
 		len(message.Ns) == 0 &&
 		len(message.Extra) == 0 &&
-		!options.ClientSubnet.IsValid()
-	disableCache := !isSimpleRequest || c.disableCache || options.DisableCache
-	if !disableCache {
-		response, ttl := c.loadResponse(question, transport)
+		!options.ClientSubnet.IsValid() &&
+		!(c.validator != nil && message.CheckingDisabled)
+	var (
+		clientSubnet    netip.Prefix
+		isSubnetRequest bool
+	)
+	if !isSimpleRequest {
+		clientSubnet, isSubnetRequest = requestClientSubnet(message)
+	}
+	disableCache := !isSimpleRequest && !isSubnetRequest || c.disableCache || options.DisableCache || c.validator != nil && message.CheckingDisabled
+	var staleResponse *dns.Msg
+	if !disableCache && isSubnetRequest {
+		response, ttl := c.loadSubnetResponse(question, clientSubnet, transport)
 		if response != nil {
 			logCachedResponse(c.logger, ctx, response, ttl)
 			response.Id = message.Id
 			return response, nil
 		}
+	} else if !disableCache && !refresh {
+		response, ttl, prefetch := c.loadResponse(question, transport)
+		if response != nil {
+			logCachedResponse(c.logger, ctx, response, ttl)
+			if prefetch {
+				c.refreshCache(transport, message, options, responseChecker)
+			}
+			response.Id = message.Id
+			return response, nil
+		}
+		if c.serveStale {
+			staleResponse = c.loadStaleResponse(question, transport)
+		}
 	}
 	if question.Qtype == dns.TypeA && options.Strategy == DomainStrategyUseIPv6 || question.Qtype == dns.TypeAAAA && options.Strategy == DomainStrategyUseIPv4 {
 		responseMessage := dns.Msg{
@@ -160,15 +277,67 @@ func (c *Client) ExchangeWithResponseCheck(ctx context.Context, transport Transp
 	if responseChecker != nil && c.rdrc != nil {
 		rejected := c.rdrc.LoadRDRC(transport.Name(), question.Name, question.Qtype)
 		if rejected {
+			c.stats.reject(transport)
 			return nil, ErrResponseRejectedCached
 		}
 	}
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	response, err := transport.Exchange(ctx, message)
-	cancel()
+	if staleResponse != nil && c.health != nil && !c.health.Available(transport.Name()) {
+		if c.logger != nil {
+			c.logger.DebugContext(ctx, "serve stale ", fqdnToDomain(question.Name), ": transport[", transport.Name(), "] is down")
+		}
+		staleResponse.Id = messageId
+		return staleResponse, nil
+	}
+	request := message
+	validate := c.validator != nil && !message.CheckingDisabled
+	if validate {
+		request = c.validator.prepareRequest(message)
+	}
+	var (
+		response *dns.Msg
+		err      error
+	)
+	if isSimpleRequest {
+		response, err = c.exchangeInFlight(ctx, transport, request)
+	} else {
+		exchangeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		response, err = c.exchangeTransport(exchangeCtx, transport, request)
+		cancel()
+	}
 	if err != nil {
+		if staleResponse != nil {
+			if c.logger != nil {
+				c.logger.DebugContext(ctx, "serve stale ", fqdnToDomain(question.Name), ": ", err)
+			}
+			c.refreshCache(transport, message, options, responseChecker)
+			staleResponse.Id = messageId
+			return staleResponse, nil
+		}
 		return nil, err
 	}
+	if validate {
+		validateCtx, cancel := context.WithTimeout(ctx, c.timeout)
+		var secure bool
+		secure, err = c.validator.validate(validateCtx, transport, question, response)
+		cancel()
+		if err != nil {
+			var bogusErr *dnssecBogusError
+			if !errors.As(err, &bogusErr) {
+				return nil, err
+			}
+			if c.logger != nil {
+				c.logger.DebugContext(ctx, "validate ", fqdnToDomain(question.Name), ": ", err)
+			}
+			response = bogusResponse(message, bogusErr)
+			response.Id = messageId
+			return response, nil
+		}
+		response.AuthenticatedData = secure
+		requestEDNS := message.IsEdns0()
+		if requestEDNS == nil || !requestEDNS.Do() {
+			stripDNSSECRecords(question, response, requestEDNS != nil)
+		}
+	}
 	if responseChecker != nil {
 		var rejected bool
 		if !(response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError) {
@@ -180,48 +349,58 @@ func (c *Client) ExchangeWithResponseCheck(ctx context.Context, transport Transp
 			if c.rdrc != nil {
 				c.rdrc.SaveRDRCAsync(transport.Name(), question.Name, question.Qtype, c.logger)
 			}
+			c.stats.reject(transport)
 			logRejectedResponse(c.logger, ctx, response)
 			return response, ErrResponseRejected
 		}
 	}
 	if question.Qtype == dns.TypeHTTPS {
-		if options.Strategy == DomainStrategyUseIPv4 || options.Strategy == DomainStrategyUseIPv6 {
-			for _, rr := range response.Answer {
-				https, isHTTPS := rr.(*dns.HTTPS)
-				if !isHTTPS {
-					continue
-				}
-				content := https.SVCB
-				content.Value = common.Filter(content.Value, func(it dns.SVCBKeyValue) bool {
-					if options.Strategy == DomainStrategyUseIPv4 {
-						return it.Key() != dns.SVCB_IPV6HINT
-					} else {
-						return it.Key() != dns.SVCB_IPV4HINT
-					}
-				})
-				https.SVCB = content
-			}
-		}
+		filterHTTPSHints(response, options.Strategy)
 	}
 	var timeToLive uint32
 	for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
 		for _, record := range recordList {
+			if record.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
 			if timeToLive == 0 || record.Header().Ttl > 0 && record.Header().Ttl < timeToLive {
 				timeToLive = record.Header().Ttl
 			}
 		}
 	}
+	cacheable := response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError
+	if cacheable && isNegativeResponse(question, response) {
+		negativeTTL, loaded := negativeTimeToLive(response, c.maxNegativeTTL)
+		if loaded {
+			if timeToLive == 0 || negativeTTL < timeToLive {
+				timeToLive = negativeTTL
+			}
+		} else {
+			cacheable = false
+		}
+	}
 	if options.RewriteTTL != nil {
 		timeToLive = *options.RewriteTTL
+	} else if cacheable && timeToLive > 0 {
+		timeToLive = c.clampTTL(timeToLive, options)
+	} else {
+		cacheable = false
 	}
 	for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
 		for _, record := range recordList {
+			if record.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
 			record.Header().Ttl = timeToLive
 		}
 	}
 	response.Id = messageId
-	if !disableCache {
-		c.storeCache(transport, question, response, timeToLive)
+	if !disableCache && cacheable {
+		if isSubnetRequest {
+			c.storeSubnetCache(transport, question, clientSubnet, responseScope(response), response, timeToLive)
+		} else {
+			c.storeCache(transport, question, response, timeToLive)
+		}
 	}
 	logExchangedResponse(c.logger, ctx, response, timeToLive)
 	return response, err
@@ -232,6 +411,10 @@ func (c *Client) Lookup(ctx context.Context, transport Transport, domain string,
 }
 
 func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transport, domain string, options QueryOptions, responseChecker func(responseAddrs []netip.Addr) bool) ([]netip.Addr, error) {
+	return c.lookup(ctx, transport, domain, options, responseChecker, false)
+}
+
+func (c *Client) lookup(ctx context.Context, transport Transport, domain string, options QueryOptions, responseChecker func(responseAddrs []netip.Addr) bool, refresh bool) ([]netip.Addr, error) {
 	if dns.IsFqdn(domain) {
 		domain = domain[:len(domain)-1]
 	}
@@ -268,39 +451,64 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 		return sortAddresses(response4, response6, options.Strategy), nil
 	}
 	disableCache := c.disableCache || options.DisableCache
-	if !disableCache {
+	var staleAddresses []netip.Addr
+	if !disableCache && !refresh {
 		if options.Strategy == DomainStrategyUseIPv4 {
-			response, err := c.questionCache(dns.Question{
+			response, prefetch, err := c.questionCache(dns.Question{
 				Name:   dnsName,
 				Qtype:  dns.TypeA,
 				Qclass: dns.ClassINET,
 			}, transport)
 			if err != ErrNotCached {
+				if prefetch {
+					c.refreshLookup(transport, domain, options, responseChecker)
+				}
 				return response, err
 			}
 		} else if options.Strategy == DomainStrategyUseIPv6 {
-			response, err := c.questionCache(dns.Question{
+			response, prefetch, err := c.questionCache(dns.Question{
 				Name:   dnsName,
 				Qtype:  dns.TypeAAAA,
 				Qclass: dns.ClassINET,
 			}, transport)
 			if err != ErrNotCached {
+				if prefetch {
+					c.refreshLookup(transport, domain, options, responseChecker)
+				}
 				return response, err
 			}
 		} else {
-			response4, _ := c.questionCache(dns.Question{
+			response4, prefetch4, err4 := c.questionCache(dns.Question{
 				Name:   dnsName,
 				Qtype:  dns.TypeA,
 				Qclass: dns.ClassINET,
 			}, transport)
-			response6, _ := c.questionCache(dns.Question{
+			response6, prefetch6, err6 := c.questionCache(dns.Question{
 				Name:   dnsName,
 				Qtype:  dns.TypeAAAA,
 				Qclass: dns.ClassINET,
 			}, transport)
 			if len(response4) > 0 || len(response6) > 0 {
+				if prefetch4 || prefetch6 {
+					c.refreshLookup(transport, domain, options, responseChecker)
+				}
 				return sortAddresses(response4, response6, options.Strategy), nil
 			}
+			if err4 != ErrNotCached && err6 != ErrNotCached {
+				if prefetch4 || prefetch6 {
+					c.refreshLookup(transport, domain, options, responseChecker)
+				}
+				if err4 != nil {
+					return nil, err4
+				}
+				if err6 != nil {
+					return nil, err6
+				}
+				return nil, RCodeNameError
+			}
+		}
+		if c.serveStale {
+			staleAddresses = c.loadStaleAddresses(transport, dnsName, options.Strategy)
 		}
 	}
 	if responseChecker != nil && c.rdrc != nil {
@@ -312,17 +520,35 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 			rejected = c.rdrc.LoadRDRC(transport.Name(), dnsName, dns.TypeAAAA)
 		}
 		if rejected {
+			c.stats.reject(transport)
 			return nil, ErrResponseRejectedCached
 		}
 	}
+	if len(staleAddresses) > 0 && c.health != nil && !c.health.Available(transport.Name()) {
+		if c.logger != nil {
+			c.logger.DebugContext(ctx, "serve stale ", domain, ": transport[", transport.Name(), "] is down")
+		}
+		return staleAddresses, nil
+	}
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	var rCode int
-	response, err := transport.Lookup(ctx, domain, options.Strategy)
+	response, err := c.lookupTransport(ctx, transport, domain, options.Strategy)
 	cancel()
 	if err != nil {
-		return nil, wrapError(err)
+		err = wrapError(err)
+		if err != RCodeNameError && len(staleAddresses) > 0 {
+			if c.logger != nil {
+				c.logger.DebugContext(ctx, "serve stale ", domain, ": ", err)
+			}
+			c.refreshLookup(transport, domain, options, responseChecker)
+			return staleAddresses, nil
+		}
+		if err != RCodeNameError || disableCache {
+			return nil, err
+		}
+		rCode = dns.RcodeNameError
 	}
-	if responseChecker != nil && !responseChecker(response) {
+	if err == nil && responseChecker != nil && !responseChecker(response) {
 		if c.rdrc != nil {
 			if common.Any(response, func(addr netip.Addr) bool {
 				return addr.Is4()
@@ -335,6 +561,7 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 				c.rdrc.SaveRDRCAsync(transport.Name(), dnsName, dns.TypeAAAA, c.logger)
 			}
 		}
+		c.stats.reject(transport)
 		logRejectedResponse(c.logger, ctx, FixedResponse(0, dns.Question{}, response, DefaultTTL))
 		return response, ErrResponseRejected
 	}
@@ -343,11 +570,13 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 		Rcode:    rCode,
 	}
 	if !disableCache {
-		var timeToLive uint32
+		var timeToLive, negativeTTL uint32
 		if options.RewriteTTL != nil {
 			timeToLive = *options.RewriteTTL
+			negativeTTL = *options.RewriteTTL
 		} else {
-			timeToLive = DefaultTTL
+			timeToLive = c.clampTTL(DefaultTTL, options)
+			negativeTTL = c.clampTTL(c.negativeTTL, options)
 		}
 		if options.Strategy != DomainStrategyUseIPv6 {
 			question4 := dns.Question{
@@ -362,7 +591,9 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 				MsgHdr:   header,
 				Question: []dns.Question{question4},
 			}
-			if len(response4) > 0 {
+			if len(response4) == 0 {
+				c.storeCache(transport, question4, message4, negativeTTL)
+			} else {
 				for _, address := range response4 {
 					message4.Answer = append(message4.Answer, &dns.A{
 						Hdr: dns.RR_Header{
@@ -374,8 +605,8 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 						A: address.AsSlice(),
 					})
 				}
+				c.storeCache(transport, question4, message4, timeToLive)
 			}
-			c.storeCache(transport, question4, message4, timeToLive)
 		}
 		if options.Strategy != DomainStrategyUseIPv4 {
 			question6 := dns.Question{
@@ -390,32 +621,69 @@ func (c *Client) LookupWithResponseCheck(ctx context.Context, transport Transpor
 				MsgHdr:   header,
 				Question: []dns.Question{question6},
 			}
-			if len(response6) > 0 {
+			if len(response6) == 0 {
+				c.storeCache(transport, question6, message6, negativeTTL)
+			} else {
 				for _, address := range response6 {
 					message6.Answer = append(message6.Answer, &dns.AAAA{
 						Hdr: dns.RR_Header{
 							Name:   question6.Name,
 							Rrtype: dns.TypeAAAA,
 							Class:  dns.ClassINET,
-							Ttl:    DefaultTTL,
+							Ttl:    timeToLive,
 						},
 						AAAA: address.AsSlice(),
 					})
 				}
+				c.storeCache(transport, question6, message6, timeToLive)
 			}
-			c.storeCache(transport, question6, message6, timeToLive)
 		}
 	}
-	return response, nil
+	return response, err
+}
+
+func (c *Client) exchangeTransport(ctx context.Context, transport Transport, message *dns.Msg) (*dns.Msg, error) {
+	if c.health != nil {
+		return c.health.Exchange(ctx, transport, message)
+	}
+	return transport.Exchange(ctx, message)
+}
+
+func (c *Client) lookupTransport(ctx context.Context, transport Transport, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	if c.health != nil {
+		return c.health.Lookup(ctx, transport, domain, strategy)
+	}
+	return transport.Lookup(ctx, domain, strategy)
 }
 
 func (c *Client) ClearCache() {
 	if c.cache != nil {
+		for _, question := range c.cache.Keys() {
+			entry, loaded := c.cache.Peek(question)
+			if loaded {
+				entry.removed.Store(true)
+			}
+		}
 		c.cache.Purge()
 	}
 	if c.transportCache != nil {
+		for _, key := range c.transportCache.Keys() {
+			entry, loaded := c.transportCache.Peek(key)
+			if loaded {
+				entry.removed.Store(true)
+			}
+		}
 		c.transportCache.Purge()
 	}
+	if c.subnetCache != nil {
+		for _, key := range c.subnetCache.Keys() {
+			entry, loaded := c.subnetCache.Peek(key)
+			if loaded {
+				entry.removed.Store(true)
+			}
+		}
+		c.subnetCache.Purge()
+	}
 }
 
 func (c *Client) LookupCache(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, bool) {
@@ -427,7 +695,7 @@ func (c *Client) LookupCache(ctx context.Context, domain string, strategy Domain
 	}
 	dnsName := dns.Fqdn(domain)
 	if strategy == DomainStrategyUseIPv4 {
-		response, err := c.questionCache(dns.Question{
+		response, _, err := c.questionCache(dns.Question{
 			Name:   dnsName,
 			Qtype:  dns.TypeA,
 			Qclass: dns.ClassINET,
@@ -436,7 +704,7 @@ func (c *Client) LookupCache(ctx context.Context, domain string, strategy Domain
 			return response, true
 		}
 	} else if strategy == DomainStrategyUseIPv6 {
-		response, err := c.questionCache(dns.Question{
+		response, _, err := c.questionCache(dns.Question{
 			Name:   dnsName,
 			Qtype:  dns.TypeAAAA,
 			Qclass: dns.ClassINET,
@@ -445,12 +713,12 @@ func (c *Client) LookupCache(ctx context.Context, domain string, strategy Domain
 			return response, true
 		}
 	} else {
-		response4, _ := c.questionCache(dns.Question{
+		response4, _, _ := c.questionCache(dns.Question{
 			Name:   dnsName,
 			Qtype:  dns.TypeA,
 			Qclass: dns.ClassINET,
 		}, nil)
-		response6, _ := c.questionCache(dns.Question{
+		response6, _, _ := c.questionCache(dns.Question{
 			Name:   dnsName,
 			Qtype:  dns.TypeAAAA,
 			Qclass: dns.ClassINET,
@@ -467,7 +735,7 @@ func (c *Client) ExchangeCache(ctx context.Context, message *dns.Msg) (*dns.Msg,
 		return nil, false
 	}
 	question := message.Question[0]
-	response, ttl := c.loadResponse(question, nil)
+	response, ttl, _ := c.loadResponse(question, nil)
 	if response == nil {
 		return nil, false
 	}
@@ -476,6 +744,27 @@ func (c *Client) ExchangeCache(ctx context.Context, message *dns.Msg) (*dns.Msg,
 	return response, true
 }
 
+func filterHTTPSHints(response *dns.Msg, strategy DomainStrategy) {
+	if strategy != DomainStrategyUseIPv4 && strategy != DomainStrategyUseIPv6 {
+		return
+	}
+	for _, rr := range response.Answer {
+		https, isHTTPS := rr.(*dns.HTTPS)
+		if !isHTTPS {
+			continue
+		}
+		content := https.SVCB
+		content.Value = common.Filter(content.Value, func(it dns.SVCBKeyValue) bool {
+			if strategy == DomainStrategyUseIPv4 {
+				return it.Key() != dns.SVCB_IPV6HINT
+			} else {
+				return it.Key() != dns.SVCB_IPV4HINT
+			}
+		})
+		https.SVCB = content
+	}
+}
+
 func sortAddresses(response4 []netip.Addr, response6 []netip.Addr, strategy DomainStrategy) []netip.Addr {
 	if strategy == DomainStrategyPreferIPv6 {
 		return append(response6, response4...)
@@ -484,29 +773,118 @@ func sortAddresses(response4 []netip.Addr, response6 []netip.Addr, strategy Doma
 	}
 }
 
+func (c *Client) clampTTL(timeToLive uint32, options QueryOptions) uint32 {
+	minTTL := c.minTTL
+	if options.MinTTL > 0 {
+		minTTL = options.MinTTL
+	}
+	maxTTL := c.maxTTL
+	if options.MaxTTL > 0 {
+		maxTTL = options.MaxTTL
+	}
+	if minTTL > 0 && timeToLive < minTTL {
+		timeToLive = minTTL
+	}
+	if maxTTL > 0 && timeToLive > maxTTL {
+		timeToLive = maxTTL
+	}
+	return timeToLive
+}
+
 func (c *Client) storeCache(transport Transport, question dns.Question, message *dns.Msg, timeToLive uint32) {
 	if timeToLive == 0 {
 		return
 	}
+	entry := &cacheEntry{
+		message: message,
+	}
+	c.stats.store(transport)
 	if c.disableExpire {
 		if !c.independentCache {
-			c.cache.Add(question, message)
+			c.cache.Add(question, entry)
 		} else {
 			c.transportCache.Add(transportCacheKey{
 				Question:      question,
 				transportName: transport.Name(),
-			}, message)
+			}, entry)
 		}
 		return
 	}
+	lifetime := time.Second * time.Duration(timeToLive)
+	entry.expireAt = time.Now().Add(lifetime)
+	if c.serveStale {
+		lifetime += c.serveStaleTTL
+	}
 	if !c.independentCache {
-		c.cache.AddWithLifetime(question, message, time.Second*time.Duration(timeToLive))
+		c.cache.AddWithLifetime(question, entry, lifetime)
 	} else {
 		c.transportCache.AddWithLifetime(transportCacheKey{
 			Question:      question,
 			transportName: transport.Name(),
-		}, message, time.Second*time.Duration(timeToLive))
+		}, entry, lifetime)
+	}
+}
+
+func (c *Client) refreshCache(transport Transport, message *dns.Msg, options QueryOptions, responseChecker func(responseAddrs []netip.Addr) bool) {
+	key := transportCacheKey{
+		Question:      message.Question[0],
+		transportName: transport.Name(),
+	}
+	c.refreshAccess.Lock()
+	if _, loaded := c.refreshing[key]; loaded {
+		c.refreshAccess.Unlock()
+		return
+	}
+	c.refreshing[key] = struct{}{}
+	c.refreshAccess.Unlock()
+	message = message.Copy()
+	go func() {
+		defer func() {
+			c.refreshAccess.Lock()
+			delete(c.refreshing, key)
+			c.refreshAccess.Unlock()
+		}()
+		_, _ = c.exchange(context.Background(), transport, message, options, responseChecker, true)
+	}()
+}
+
+func (c *Client) refreshLookup(transport Transport, domain string, options QueryOptions, responseChecker func(responseAddrs []netip.Addr) bool) {
+	dnsName := dns.Fqdn(domain)
+	var keys []transportCacheKey
+	if options.Strategy != DomainStrategyUseIPv6 {
+		keys = append(keys, transportCacheKey{
+			Question:      dns.Question{Name: dnsName, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			transportName: transport.Name(),
+		})
+	}
+	if options.Strategy != DomainStrategyUseIPv4 {
+		keys = append(keys, transportCacheKey{
+			Question:      dns.Question{Name: dnsName, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+			transportName: transport.Name(),
+		})
+	}
+	c.refreshAccess.Lock()
+	if common.Any(keys, func(key transportCacheKey) bool {
+		_, loaded := c.refreshing[key]
+		return loaded
+	}) {
+		c.refreshAccess.Unlock()
+		return
+	}
+	for _, key := range keys {
+		c.refreshing[key] = struct{}{}
 	}
+	c.refreshAccess.Unlock()
+	go func() {
+		defer func() {
+			c.refreshAccess.Lock()
+			for _, key := range keys {
+				delete(c.refreshing, key)
+			}
+			c.refreshAccess.Unlock()
+		}()
+		_, _ = c.lookup(context.Background(), transport, domain, options, responseChecker, true)
+	}()
 }
 
 func (c *Client) exchangeToLookup(ctx context.Context, transport Transport, message *dns.Msg, question dns.Question, options QueryOptions, responseChecker func(responseAddrs []netip.Addr) bool) (*dns.Msg, error) {
@@ -524,7 +902,7 @@ func (c *Client) exchangeToLookup(ctx context.Context, transport Transport, mess
 	if options.RewriteTTL != nil {
 		timeToLive = *options.RewriteTTL
 	} else {
-		timeToLive = DefaultTTL
+		timeToLive = c.clampTTL(DefaultTTL, options)
 	}
 	response := FixedResponse(message.Id, question, result, timeToLive)
 	logExchangedResponse(c.logger, ctx, response, timeToLive)
@@ -537,13 +915,6 @@ func (c *Client) lookupToExchange(ctx context.Context, transport Transport, name
 		Qtype:  qType,
 		Qclass: dns.ClassINET,
 	}
-	disableCache := c.disableCache || options.DisableCache
-	if !disableCache {
-		cachedAddresses, err := c.questionCache(question, transport)
-		if err != ErrNotCached {
-			return cachedAddresses, err
-		}
-	}
 	message := dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			RecursionDesired: true,
@@ -568,89 +939,175 @@ func (c *Client) lookupToExchange(ctx context.Context, transport Transport, name
 	return MessageToAddresses(response), nil
 }
 
-func (c *Client) questionCache(question dns.Question, transport Transport) ([]netip.Addr, error) {
-	response, _ := c.loadResponse(question, transport)
+func (c *Client) questionCache(question dns.Question, transport Transport) ([]netip.Addr, bool, error) {
+	response, _, prefetch := c.loadResponse(question, transport)
 	if response == nil {
-		return nil, ErrNotCached
+		return nil, false, ErrNotCached
 	}
 	if response.Rcode != dns.RcodeSuccess {
-		return nil, RCodeError(response.Rcode)
+		return nil, prefetch, RCodeError(response.Rcode)
 	}
-	return MessageToAddresses(response), nil
+	return MessageToAddresses(response), prefetch, nil
 }
 
-func (c *Client) loadResponse(question dns.Question, transport Transport) (*dns.Msg, int) {
+func (c *Client) loadResponse(question dns.Question, transport Transport) (*dns.Msg, int, bool) {
 	var (
-		response *dns.Msg
-		loaded   bool
+		entry  *cacheEntry
+		loaded bool
 	)
-	if c.disableExpire {
-		if !c.independentCache {
-			response, loaded = c.cache.Get(question)
-		} else {
-			response, loaded = c.transportCache.Get(transportCacheKey{
-				Question:      question,
-				transportName: transport.Name(),
-			})
-		}
-		if !loaded {
-			return nil, 0
-		}
-		return response.Copy(), 0
+	if !c.independentCache {
+		entry, loaded = c.cache.Get(question)
 	} else {
-		var expireAt time.Time
+		entry, loaded = c.transportCache.Get(transportCacheKey{
+			Question:      question,
+			transportName: transport.Name(),
+		})
+	}
+	if !loaded {
+		c.stats.miss(transport)
+		return nil, 0, false
+	}
+	if !c.disableExpire && time.Now().After(entry.expireAt) {
+		c.stats.miss(transport)
+		if c.serveStale {
+			return nil, 0, false
+		}
 		if !c.independentCache {
-			response, expireAt, loaded = c.cache.GetWithLifetime(question)
+			c.cache.Remove(question)
 		} else {
-			response, expireAt, loaded = c.transportCache.GetWithLifetime(transportCacheKey{
+			c.transportCache.Remove(transportCacheKey{
 				Question:      question,
 				transportName: transport.Name(),
 			})
 		}
-		if !loaded {
-			return nil, 0
-		}
-		timeNow := time.Now()
-		if timeNow.After(expireAt) {
-			if !c.independentCache {
-				c.cache.Remove(question)
-			} else {
-				c.transportCache.Remove(transportCacheKey{
-					Question:      question,
-					transportName: transport.Name(),
-				})
+		return nil, 0, false
+	}
+	c.stats.hit(transport)
+	return c.cachedResponse(entry)
+}
+
+func (c *Client) cachedResponse(entry *cacheEntry) (*dns.Msg, int, bool) {
+	if c.disableExpire {
+		return entry.message.Copy(), 0, false
+	}
+	response := entry.message
+	var originTTL int
+	for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range recordList {
+			if record.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if originTTL == 0 || record.Header().Ttl > 0 && int(record.Header().Ttl) < originTTL {
+				originTTL = int(record.Header().Ttl)
 			}
-			return nil, 0
 		}
-		var originTTL int
+	}
+	nowTTL := int(time.Until(entry.expireAt).Seconds())
+	if nowTTL < 0 {
+		nowTTL = 0
+	}
+	response = response.Copy()
+	if originTTL > 0 {
+		duration := uint32(originTTL - nowTTL)
 		for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
 			for _, record := range recordList {
-				if originTTL == 0 || record.Header().Ttl > 0 && int(record.Header().Ttl) < originTTL {
-					originTTL = int(record.Header().Ttl)
+				if record.Header().Rrtype == dns.TypeOPT {
+					continue
 				}
+				record.Header().Ttl = record.Header().Ttl - duration
 			}
 		}
-		nowTTL := int(expireAt.Sub(timeNow).Seconds())
-		if nowTTL < 0 {
-			nowTTL = 0
-		}
-		response = response.Copy()
-		if originTTL > 0 {
-			duration := uint32(originTTL - nowTTL)
-			for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
-				for _, record := range recordList {
-					record.Header().Ttl = record.Header().Ttl - duration
+	} else {
+		for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+			for _, record := range recordList {
+				if record.Header().Rrtype == dns.TypeOPT {
+					continue
 				}
+				record.Header().Ttl = uint32(nowTTL)
 			}
-		} else {
-			for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
-				for _, record := range recordList {
-					record.Header().Ttl = uint32(nowTTL)
-				}
+		}
+	}
+	prefetch := c.prefetch && originTTL > 0 && float64(nowTTL) < float64(originTTL)*c.prefetchRatio
+	return response, nowTTL, prefetch
+}
+
+func (c *Client) loadStaleResponse(question dns.Question, transport Transport) *dns.Msg {
+	var (
+		entry  *cacheEntry
+		loaded bool
+	)
+	if !c.independentCache {
+		entry, loaded = c.cache.Peek(question)
+	} else {
+		entry, loaded = c.transportCache.Peek(transportCacheKey{
+			Question:      question,
+			transportName: transport.Name(),
+		})
+	}
+	if !loaded {
+		return nil
+	}
+	response := entry.message.Copy()
+	for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range recordList {
+			if record.Header().Rrtype == dns.TypeOPT {
+				continue
 			}
+			record.Header().Ttl = StaleAnswerTTL
+		}
+	}
+	return response
+}
+
+func (c *Client) loadStaleAddresses(transport Transport, dnsName string, strategy DomainStrategy) []netip.Addr {
+	var response4, response6 []netip.Addr
+	if strategy != DomainStrategyUseIPv6 {
+		response := c.loadStaleResponse(dns.Question{Name: dnsName, Qtype: dns.TypeA, Qclass: dns.ClassINET}, transport)
+		if response != nil && response.Rcode == dns.RcodeSuccess {
+			response4 = MessageToAddresses(response)
+		}
+	}
+	if strategy != DomainStrategyUseIPv4 {
+		response := c.loadStaleResponse(dns.Question{Name: dnsName, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, transport)
+		if response != nil && response.Rcode == dns.RcodeSuccess {
+			response6 = MessageToAddresses(response)
+		}
+	}
+	if len(response4) == 0 && len(response6) == 0 {
+		return nil
+	}
+	return sortAddresses(response4, response6, strategy)
+}
+
+func isNegativeResponse(question dns.Question, response *dns.Msg) bool {
+	switch response.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return !common.Any(response.Answer, func(it dns.RR) bool {
+			return question.Qtype == dns.TypeANY || it.Header().Rrtype == question.Qtype
+		})
+	default:
+		return false
+	}
+}
+
+func negativeTimeToLive(response *dns.Msg, maxTTL uint32) (uint32, bool) {
+	for _, record := range response.Ns {
+		soa, isSOA := record.(*dns.SOA)
+		if !isSOA {
+			continue
+		}
+		timeToLive := soa.Hdr.Ttl
+		if soa.Minttl < timeToLive {
+			timeToLive = soa.Minttl
+		}
+		if maxTTL > 0 && timeToLive > maxTTL {
+			timeToLive = maxTTL
 		}
-		return response, nowTTL
+		return timeToLive, true
 	}
+	return 0, false
 }
 
 func MessageToAddresses(response *dns.Msg) []netip.Addr {
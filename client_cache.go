@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type CacheEntry struct {
+	Question      dns.Question
+	TransportName string
+	ClientSubnet  netip.Prefix
+	TTL           time.Duration
+	Response      *dns.Msg
+}
+
+type CacheFilter struct {
+	Name          string
+	Suffix        string
+	Qtype         uint16
+	TransportName string
+}
+
+func (f CacheFilter) Match(question dns.Question, transportName string) bool {
+	if f.Name != "" && !strings.EqualFold(dns.Fqdn(f.Name), question.Name) {
+		return false
+	}
+	if f.Suffix != "" && !dns.IsSubDomain(dns.Fqdn(f.Suffix), question.Name) {
+		return false
+	}
+	if f.Qtype != 0 && f.Qtype != question.Qtype {
+		return false
+	}
+	if f.TransportName != "" && f.TransportName != transportName {
+		return false
+	}
+	return true
+}
+
+func (c *Client) RangeCache(f func(entry CacheEntry) bool) {
+	if c.disableCache {
+		return
+	}
+	timeNow := time.Now()
+	c.rangeCache(func(question dns.Question, transportName string, response *dns.Msg, expireAt time.Time) bool {
+		var timeToLive time.Duration
+		if !expireAt.IsZero() {
+			timeToLive = expireAt.Sub(timeNow)
+		}
+		return f(CacheEntry{
+			Question:      question,
+			TransportName: transportName,
+			TTL:           timeToLive,
+			Response:      response.Copy(),
+		})
+	})
+	c.rangeSubnetCache(func(key subnetCacheKey, entry *cacheEntry) bool {
+		var timeToLive time.Duration
+		if !entry.expireAt.IsZero() {
+			timeToLive = entry.expireAt.Sub(timeNow)
+		}
+		return f(CacheEntry{
+			Question:      key.Question,
+			TransportName: key.transportName,
+			ClientSubnet:  key.clientSubnet,
+			TTL:           timeToLive,
+			Response:      entry.message.Copy(),
+		})
+	})
+}
+
+func (c *Client) RemoveCache(filter CacheFilter) int {
+	if c.disableCache {
+		return 0
+	}
+	var removed int
+	if !c.independentCache {
+		for _, question := range c.cache.Keys() {
+			if !filter.Match(question, "") {
+				continue
+			}
+			entry, loaded := c.cache.Peek(question)
+			if !loaded {
+				continue
+			}
+			entry.removed.Store(true)
+			if c.cache.Remove(question) {
+				removed++
+			}
+		}
+	} else {
+		for _, key := range c.transportCache.Keys() {
+			if !filter.Match(key.Question, key.transportName) {
+				continue
+			}
+			entry, loaded := c.transportCache.Peek(key)
+			if !loaded {
+				continue
+			}
+			entry.removed.Store(true)
+			if c.transportCache.Remove(key) {
+				removed++
+			}
+		}
+	}
+	for _, key := range c.subnetCache.Keys() {
+		if !filter.Match(key.Question, key.transportName) {
+			continue
+		}
+		entry, loaded := c.subnetCache.Peek(key)
+		if !loaded {
+			continue
+		}
+		entry.removed.Store(true)
+		if c.subnetCache.Remove(key) {
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *Client) rangeCache(f func(question dns.Question, transportName string, response *dns.Msg, expireAt time.Time) bool) {
+	if !c.independentCache {
+		for _, question := range c.cache.Keys() {
+			entry, loaded := c.cache.Peek(question)
+			if !loaded {
+				continue
+			}
+			if !f(question, "", entry.message, entry.expireAt) {
+				return
+			}
+		}
+	} else {
+		for _, key := range c.transportCache.Keys() {
+			entry, loaded := c.transportCache.Peek(key)
+			if !loaded {
+				continue
+			}
+			if !f(key.Question, key.transportName, entry.message, entry.expireAt) {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) rangeSubnetCache(f func(key subnetCacheKey, entry *cacheEntry) bool) {
+	for _, key := range c.subnetCache.Keys() {
+		entry, loaded := c.subnetCache.Peek(key)
+		if !loaded {
+			continue
+		}
+		if !f(key, entry) {
+			return
+		}
+	}
+}
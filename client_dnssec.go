@@ -0,0 +1,729 @@
+package dns
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/contrab/freelru"
+	"github.com/sagernet/sing/contrab/maphash"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnssecUDPSize            = 1232
+	dnssecMaxVerifications   = 32
+	dnssecMaxNSEC3Iterations = 150
+	dnssecZoneCacheCapacity  = 1024
+)
+
+var errDNSSECNSEC3Iterations = E.New("NSEC3 iterations exceed limit")
+
+var DefaultTrustAnchors = []*dns.DS{
+	{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     20326,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	},
+	{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     38696,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	},
+}
+
+type dnssecBogusError struct {
+	code uint16
+	err  error
+}
+
+func newDNSSECBogusError(code uint16, message ...any) *dnssecBogusError {
+	return &dnssecBogusError{code, E.New(message...)}
+}
+
+func (e *dnssecBogusError) Error() string {
+	return "dnssec bogus: " + e.err.Error()
+}
+
+func (e *dnssecBogusError) Unwrap() error {
+	return e.err
+}
+
+type dnssecValidator struct {
+	anchors map[string][]*dns.DS
+	zones   freelru.Cache[dnssecZoneKey, *dnssecZoneEntry]
+}
+
+type dnssecZoneKey struct {
+	transportName string
+	name          string
+}
+
+type dnssecZone struct {
+	name string
+	keys []*dns.DNSKEY
+}
+
+type dnssecZoneEntry struct {
+	zone        *dnssecZone
+	nonexistent bool
+}
+
+type dnssecBudget struct {
+	verifications int
+}
+
+type dnssecRRSet struct {
+	name    string
+	rrType  uint16
+	records []dns.RR
+	sigs    []*dns.RRSIG
+}
+
+func newDNSSECValidator(trustAnchors []*dns.DS) *dnssecValidator {
+	if len(trustAnchors) == 0 {
+		trustAnchors = DefaultTrustAnchors
+	}
+	validator := &dnssecValidator{
+		anchors: make(map[string][]*dns.DS),
+		zones:   common.Must1(freelru.NewSharded[dnssecZoneKey, *dnssecZoneEntry](dnssecZoneCacheCapacity, maphash.NewHasher[dnssecZoneKey]().Hash32)),
+	}
+	for _, anchor := range trustAnchors {
+		name := dns.CanonicalName(anchor.Hdr.Name)
+		validator.anchors[name] = append(validator.anchors[name], anchor)
+	}
+	return validator
+}
+
+func (v *dnssecValidator) prepareRequest(message *dns.Msg) *dns.Msg {
+	message = message.Copy()
+	message.CheckingDisabled = true
+	optRecord := message.IsEdns0()
+	if optRecord == nil {
+		message.SetEdns0(dnssecUDPSize, true)
+	} else {
+		optRecord.SetDo()
+	}
+	return message
+}
+
+func (v *dnssecValidator) validate(ctx context.Context, transport Transport, question dns.Question, response *dns.Msg) (bool, error) {
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+	secure := true
+	budget := new(dnssecBudget)
+	for _, rrset := range dnssecRRSets(response.Answer) {
+		zone, err := v.signerZone(ctx, transport, rrset.name, rrset.sigs)
+		if err != nil {
+			return false, err
+		}
+		if zone.keys == nil {
+			secure = false
+			continue
+		}
+		sig, err := verifyRRSet(rrset, zone, budget)
+		if err != nil {
+			return false, err
+		}
+		if int(sig.Labels) < dns.CountLabel(rrset.name) {
+			err = verifyWildcardExpansion(zone, rrset.name, int(sig.Labels), response.Ns, budget)
+			if err == errDNSSECNSEC3Iterations {
+				secure = false
+			} else if err != nil {
+				return false, err
+			}
+		}
+	}
+	name := dns.CanonicalName(question.Name)
+	for range response.Answer {
+		var target string
+		for _, record := range response.Answer {
+			cname, isCNAME := record.(*dns.CNAME)
+			if isCNAME && dns.CanonicalName(cname.Hdr.Name) == name {
+				target = dns.CanonicalName(cname.Target)
+				break
+			}
+		}
+		if target == "" {
+			break
+		}
+		name = target
+	}
+	if question.Qtype == dns.TypeCNAME || question.Qtype == dns.TypeANY {
+		return secure, nil
+	}
+	for _, record := range response.Answer {
+		if record.Header().Rrtype == question.Qtype && dns.CanonicalName(record.Header().Name) == name {
+			return secure, nil
+		}
+	}
+	var sigs []*dns.RRSIG
+	for _, rrset := range dnssecRRSets(response.Ns) {
+		sigs = append(sigs, rrset.sigs...)
+	}
+	zone, err := v.signerZone(ctx, transport, name, sigs)
+	if err != nil {
+		return false, err
+	}
+	if zone.keys == nil {
+		return false, nil
+	}
+	insecure, err := verifyDenial(zone, name, question.Qtype, response.Rcode == dns.RcodeNameError, response.Ns, budget)
+	if err == errDNSSECNSEC3Iterations {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return secure && !insecure, nil
+}
+
+func (v *dnssecValidator) signerZone(ctx context.Context, transport Transport, name string, sigs []*dns.RRSIG) (*dnssecZone, error) {
+	if len(sigs) > 0 {
+		signer := dns.CanonicalName(sigs[0].SignerName)
+		if dns.IsSubDomain(signer, name) {
+			zone, err := v.findZone(ctx, transport, signer)
+			if err != nil {
+				return nil, err
+			}
+			if zone.keys == nil || zone.name == signer {
+				return zone, nil
+			}
+		}
+	}
+	return v.findZone(ctx, transport, name)
+}
+
+func (v *dnssecValidator) findZone(ctx context.Context, transport Transport, name string) (*dnssecZone, error) {
+	ancestors := dnssecAncestors(name)
+	anchorIndex := -1
+	for index, ancestor := range ancestors {
+		if _, loaded := v.anchors[ancestor]; loaded {
+			anchorIndex = index
+			break
+		}
+	}
+	if anchorIndex == -1 {
+		return &dnssecZone{name: "."}, nil
+	}
+	entry, err := v.loadAnchor(ctx, transport, ancestors[anchorIndex])
+	if err != nil {
+		return nil, err
+	}
+	zone := entry.zone
+	for index := anchorIndex - 1; index >= 0 && zone.keys != nil; index-- {
+		entry, err = v.loadDelegation(ctx, transport, zone, ancestors[index])
+		if err != nil {
+			return nil, err
+		}
+		if entry.zone != nil {
+			zone = entry.zone
+		}
+		if entry.nonexistent {
+			break
+		}
+	}
+	return zone, nil
+}
+
+func (v *dnssecValidator) loadEntry(transport Transport, name string) *dnssecZoneEntry {
+	entry, _ := v.zones.Get(dnssecZoneKey{transport.Name(), name})
+	return entry
+}
+
+func (v *dnssecValidator) storeEntry(transport Transport, name string, entry *dnssecZoneEntry, response *dns.Msg) {
+	var timeToLive uint32
+	for _, recordList := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, record := range recordList {
+			if timeToLive == 0 || record.Header().Ttl < timeToLive {
+				timeToLive = record.Header().Ttl
+			}
+		}
+	}
+	if timeToLive == 0 {
+		return
+	}
+	v.zones.AddWithLifetime(dnssecZoneKey{transport.Name(), name}, entry, time.Duration(timeToLive)*time.Second)
+}
+
+func (v *dnssecValidator) loadAnchor(ctx context.Context, transport Transport, name string) (*dnssecZoneEntry, error) {
+	entry := v.loadEntry(transport, name)
+	if entry != nil {
+		return entry, nil
+	}
+	zone, response, err := v.loadKeys(ctx, transport, name, v.anchors[name])
+	if err != nil {
+		return nil, err
+	}
+	entry = &dnssecZoneEntry{zone: zone}
+	if response != nil {
+		v.storeEntry(transport, name, entry, response)
+	}
+	return entry, nil
+}
+
+func (v *dnssecValidator) loadDelegation(ctx context.Context, transport Transport, parent *dnssecZone, name string) (*dnssecZoneEntry, error) {
+	entry := v.loadEntry(transport, name)
+	if entry != nil {
+		return entry, nil
+	}
+	response, err := v.query(ctx, transport, name, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	entry = &dnssecZoneEntry{}
+	var (
+		dsSet   []*dns.DS
+		isAlias bool
+	)
+	budget := new(dnssecBudget)
+	for _, rrset := range dnssecRRSets(response.Answer) {
+		if rrset.name != name || rrset.rrType != dns.TypeDS && rrset.rrType != dns.TypeCNAME {
+			continue
+		}
+		_, err = verifyRRSet(rrset, parent, budget)
+		if err != nil {
+			return nil, err
+		}
+		if rrset.rrType == dns.TypeCNAME {
+			isAlias = true
+			continue
+		}
+		for _, record := range rrset.records {
+			dsSet = append(dsSet, record.(*dns.DS))
+		}
+	}
+	if len(dsSet) > 0 {
+		var keysResponse *dns.Msg
+		entry.zone, keysResponse, err = v.loadKeys(ctx, transport, name, dsSet)
+		if err != nil {
+			return nil, err
+		}
+		if keysResponse != nil {
+			response = response.Copy()
+			response.Answer = append(response.Answer, keysResponse.Answer...)
+		}
+	} else if !isAlias {
+		nameError := response.Rcode == dns.RcodeNameError
+		delegation, err := verifyDenial(parent, name, dns.TypeDS, nameError, response.Ns, budget)
+		if err == errDNSSECNSEC3Iterations {
+			delegation = true
+		} else if err != nil {
+			return nil, err
+		}
+		if delegation {
+			entry.zone = &dnssecZone{name: name}
+		}
+		entry.nonexistent = nameError
+	}
+	v.storeEntry(transport, name, entry, response)
+	return entry, nil
+}
+
+func (v *dnssecValidator) loadKeys(ctx context.Context, transport Transport, name string, dsSet []*dns.DS) (*dnssecZone, *dns.Msg, error) {
+	var supportedSet []*dns.DS
+	for _, ds := range dsSet {
+		if !dnssecAlgorithmSupported(ds.Algorithm) {
+			continue
+		}
+		switch ds.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			supportedSet = append(supportedSet, ds)
+		}
+	}
+	if len(supportedSet) == 0 {
+		return &dnssecZone{name: name}, nil, nil
+	}
+	response, err := v.query(ctx, transport, name, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keySet *dnssecRRSet
+	for _, rrset := range dnssecRRSets(response.Answer) {
+		if rrset.name == name && rrset.rrType == dns.TypeDNSKEY {
+			keySet = rrset
+			break
+		}
+	}
+	if keySet == nil {
+		return nil, nil, newDNSSECBogusError(dns.ExtendedErrorCodeDNSKEYMissing, "missing DNSKEY for ", name)
+	}
+	var keys []*dns.DNSKEY
+	budget := new(dnssecBudget)
+	for _, record := range keySet.records {
+		key := record.(*dns.DNSKEY)
+		if key.Flags&dns.ZONE != 0 && key.Flags&dns.REVOKE == 0 {
+			keys = append(keys, key)
+		}
+	}
+	for _, ds := range supportedSet {
+		for _, key := range keys {
+			if key.Algorithm != ds.Algorithm || key.KeyTag() != ds.KeyTag {
+				continue
+			}
+			keyDS := key.ToDS(ds.DigestType)
+			if keyDS == nil || !strings.EqualFold(keyDS.Digest, ds.Digest) {
+				continue
+			}
+			_, err = verifyRRSet(keySet, &dnssecZone{name: name, keys: []*dns.DNSKEY{key}}, budget)
+			if err == nil {
+				return &dnssecZone{name: name, keys: keys}, response, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, newDNSSECBogusError(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY matching DS for ", name)
+}
+
+func (v *dnssecValidator) query(ctx context.Context, transport Transport, name string, qType uint16) (*dns.Msg, error) {
+	message := new(dns.Msg)
+	message.SetQuestion(name, qType)
+	message.CheckingDisabled = true
+	message.SetEdns0(dnssecUDPSize, true)
+	response, err := transport.Exchange(ctx, message)
+	if err != nil {
+		return nil, E.Cause(err, "query ", dns.TypeToString[qType], " ", name)
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return nil, E.Cause(RCodeError(response.Rcode), "query ", dns.TypeToString[qType], " ", name)
+	}
+	return response, nil
+}
+
+func verifyRRSet(rrset *dnssecRRSet, zone *dnssecZone, budget *dnssecBudget) (*dns.RRSIG, error) {
+	if len(rrset.sigs) == 0 {
+		return nil, newDNSSECBogusError(dns.ExtendedErrorCodeRRSIGsMissing, "missing RRSIG for ", rrset.name, " ", dns.TypeToString[rrset.rrType])
+	}
+	now := time.Now()
+	code := dns.ExtendedErrorCodeDNSBogus
+	for _, sig := range rrset.sigs {
+		if dns.CanonicalName(sig.SignerName) != zone.name {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			if int64(sig.Inception) > now.Unix() {
+				code = dns.ExtendedErrorCodeSignatureNotYetValid
+			} else {
+				code = dns.ExtendedErrorCodeSignatureExpired
+			}
+			continue
+		}
+		for _, key := range zone.keys {
+			if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag {
+				continue
+			}
+			if budget.verifications >= dnssecMaxVerifications {
+				return nil, newDNSSECBogusError(dns.ExtendedErrorCodeDNSBogus, "too many signature verifications for ", rrset.name, " ", dns.TypeToString[rrset.rrType])
+			}
+			budget.verifications++
+			if sig.Verify(key, rrset.records) == nil {
+				return sig, nil
+			}
+		}
+	}
+	return nil, newDNSSECBogusError(code, "invalid RRSIG for ", rrset.name, " ", dns.TypeToString[rrset.rrType])
+}
+
+func verifyWildcardExpansion(zone *dnssecZone, name string, labels int, records []dns.RR, budget *dnssecBudget) error {
+	nsecList, nsec3List, err := verifyDenialRecords(zone, records, budget)
+	if err != nil {
+		return err
+	}
+	nameLabels := dns.SplitDomainName(name)
+	nextCloser := dns.Fqdn(strings.Join(nameLabels[len(nameLabels)-labels-1:], "."))
+	for _, nsec := range nsecList {
+		if nsecCovers(nsec, name) {
+			return nil
+		}
+	}
+	for _, nsec3 := range nsec3List {
+		if nsec3.Cover(nextCloser) {
+			return nil
+		}
+	}
+	return newDNSSECBogusError(dns.ExtendedErrorCodeNSECMissing, "missing wildcard proof for ", name)
+}
+
+func verifyDenialRecords(zone *dnssecZone, records []dns.RR, budget *dnssecBudget) ([]*dns.NSEC, []*dns.NSEC3, error) {
+	var (
+		nsecList  []*dns.NSEC
+		nsec3List []*dns.NSEC3
+	)
+	for _, rrset := range dnssecRRSets(records) {
+		if rrset.rrType != dns.TypeNSEC && rrset.rrType != dns.TypeNSEC3 {
+			continue
+		}
+		if rrset.rrType == dns.TypeNSEC3 && common.Any(rrset.records, func(it dns.RR) bool {
+			return it.(*dns.NSEC3).Iterations > dnssecMaxNSEC3Iterations
+		}) {
+			return nil, nil, errDNSSECNSEC3Iterations
+		}
+		_, err := verifyRRSet(rrset, zone, budget)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, record := range rrset.records {
+			switch denialRecord := record.(type) {
+			case *dns.NSEC:
+				nsecList = append(nsecList, denialRecord)
+			case *dns.NSEC3:
+				nsec3List = append(nsec3List, denialRecord)
+			}
+		}
+	}
+	return nsecList, nsec3List, nil
+}
+
+func verifyDenial(zone *dnssecZone, name string, qType uint16, nameError bool, records []dns.RR, budget *dnssecBudget) (bool, error) {
+	nsecList, nsec3List, err := verifyDenialRecords(zone, records, budget)
+	if err != nil {
+		return false, err
+	}
+	var delegation, proven bool
+	if len(nsecList) > 0 {
+		delegation, proven = nsecDenial(name, qType, nameError, nsecList)
+	} else if len(nsec3List) > 0 {
+		delegation, proven = nsec3Denial(name, qType, nameError, nsec3List)
+	}
+	if !proven {
+		return false, newDNSSECBogusError(dns.ExtendedErrorCodeNSECMissing, "missing denial of existence for ", name, " ", dns.TypeToString[qType])
+	}
+	return delegation, nil
+}
+
+func nsecDenial(name string, qType uint16, nameError bool, nsecList []*dns.NSEC) (bool, bool) {
+	for _, nsec := range nsecList {
+		if dns.CanonicalName(nsec.Hdr.Name) != name {
+			continue
+		}
+		if nameError || hasType(nsec.TypeBitMap, qType) || hasType(nsec.TypeBitMap, dns.TypeCNAME) {
+			return false, false
+		}
+		return hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeSOA), true
+	}
+	var covering *dns.NSEC
+	for _, nsec := range nsecList {
+		if nsecCovers(nsec, name) {
+			covering = nsec
+			break
+		}
+	}
+	if covering == nil {
+		return false, false
+	}
+	if !nameError && dns.IsSubDomain(name, dns.CanonicalName(covering.NextDomain)) {
+		return false, true
+	}
+	closestEncloser := commonAncestor(name, covering.Hdr.Name)
+	if nextEncloser := commonAncestor(name, covering.NextDomain); dns.CountLabel(nextEncloser) > dns.CountLabel(closestEncloser) {
+		closestEncloser = nextEncloser
+	}
+	wildcard := wildcardName(closestEncloser)
+	for _, nsec := range nsecList {
+		if dns.CanonicalName(nsec.Hdr.Name) == wildcard {
+			return false, !nameError && !hasType(nsec.TypeBitMap, qType) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	if !nameError {
+		return false, false
+	}
+	for _, nsec := range nsecList {
+		if nsecCovers(nsec, wildcard) {
+			return false, true
+		}
+	}
+	return false, false
+}
+
+func nsec3Denial(name string, qType uint16, nameError bool, nsec3List []*dns.NSEC3) (bool, bool) {
+	for _, nsec3 := range nsec3List {
+		if !nsec3.Match(name) {
+			continue
+		}
+		if nameError || hasType(nsec3.TypeBitMap, qType) || hasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+			return false, false
+		}
+		return hasType(nsec3.TypeBitMap, dns.TypeNS) && !hasType(nsec3.TypeBitMap, dns.TypeSOA), true
+	}
+	ancestors := dnssecAncestors(name)
+	for index := 1; index < len(ancestors); index++ {
+		closestEncloser := ancestors[index]
+		if !nsec3Any(nsec3List, func(nsec3 *dns.NSEC3) bool { return nsec3.Match(closestEncloser) }) {
+			continue
+		}
+		nextCloser := ancestors[index-1]
+		var covering *dns.NSEC3
+		for _, nsec3 := range nsec3List {
+			if nsec3.Cover(nextCloser) {
+				covering = nsec3
+				break
+			}
+		}
+		if covering == nil {
+			return false, false
+		}
+		if covering.Flags&1 != 0 {
+			return true, true
+		}
+		wildcard := wildcardName(closestEncloser)
+		if nameError {
+			return false, nsec3Any(nsec3List, func(nsec3 *dns.NSEC3) bool { return nsec3.Cover(wildcard) })
+		}
+		return false, nsec3Any(nsec3List, func(nsec3 *dns.NSEC3) bool {
+			return nsec3.Match(wildcard) && !hasType(nsec3.TypeBitMap, qType) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME)
+		})
+	}
+	return false, false
+}
+
+func nsec3Any(nsec3List []*dns.NSEC3, block func(nsec3 *dns.NSEC3) bool) bool {
+	for _, nsec3 := range nsec3List {
+		if block(nsec3) {
+			return true
+		}
+	}
+	return false
+}
+
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := dns.CanonicalName(nsec.Hdr.Name)
+	next := dns.CanonicalName(nsec.NextDomain)
+	if owner != name && dns.IsSubDomain(owner, name) && hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeSOA) {
+		return false
+	}
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+func canonicalCompare(a string, b string) int {
+	aLabels := dns.SplitDomainName(a)
+	bLabels := dns.SplitDomainName(b)
+	for index := 1; index <= len(aLabels) && index <= len(bLabels); index++ {
+		result := strings.Compare(aLabels[len(aLabels)-index], bLabels[len(bLabels)-index])
+		if result != 0 {
+			return result
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+func commonAncestor(a string, b string) string {
+	labels := dns.SplitDomainName(dns.CanonicalName(a))
+	common := dns.CompareDomainName(a, b)
+	return dns.Fqdn(strings.Join(labels[len(labels)-common:], "."))
+}
+
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+func hasType(typeBitMap []uint16, rrType uint16) bool {
+	for _, it := range typeBitMap {
+		if it == rrType {
+			return true
+		}
+	}
+	return false
+}
+
+func dnssecAncestors(name string) []string {
+	labels := dns.SplitDomainName(name)
+	ancestors := make([]string, 0, len(labels)+1)
+	for index := range labels {
+		ancestors = append(ancestors, dns.Fqdn(strings.Join(labels[index:], ".")))
+	}
+	return append(ancestors, ".")
+}
+
+func dnssecAlgorithmSupported(algorithm uint8) bool {
+	switch algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+func dnssecRRSets(records []dns.RR) []*dnssecRRSet {
+	var rrsets []*dnssecRRSet
+	for _, record := range records {
+		header := record.Header()
+		if header.Rrtype == dns.TypeRRSIG || header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		name := dns.CanonicalName(header.Name)
+		var rrset *dnssecRRSet
+		for _, it := range rrsets {
+			if it.name == name && it.rrType == header.Rrtype {
+				rrset = it
+				break
+			}
+		}
+		if rrset == nil {
+			rrset = &dnssecRRSet{name: name, rrType: header.Rrtype}
+			rrsets = append(rrsets, rrset)
+		}
+		rrset.records = append(rrset.records, record)
+	}
+	for _, record := range records {
+		sig, isRRSIG := record.(*dns.RRSIG)
+		if !isRRSIG {
+			continue
+		}
+		name := dns.CanonicalName(sig.Hdr.Name)
+		for _, rrset := range rrsets {
+			if rrset.name == name && rrset.rrType == sig.TypeCovered {
+				rrset.sigs = append(rrset.sigs, sig)
+				break
+			}
+		}
+	}
+	return rrsets
+}
+
+func stripDNSSECRecords(question dns.Question, response *dns.Msg, keepEDNS bool) {
+	isDNSSECRecord := func(record dns.RR) bool {
+		switch record.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			return record.Header().Rrtype != question.Qtype
+		case dns.TypeOPT:
+			return !keepEDNS
+		default:
+			return false
+		}
+	}
+	response.Answer = common.Filter(response.Answer, func(it dns.RR) bool { return !isDNSSECRecord(it) })
+	response.Ns = common.Filter(response.Ns, func(it dns.RR) bool { return !isDNSSECRecord(it) })
+	response.Extra = common.Filter(response.Extra, func(it dns.RR) bool { return !isDNSSECRecord(it) })
+}
+
+func bogusResponse(message *dns.Msg, err *dnssecBogusError) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetRcode(message, dns.RcodeServerFailure)
+	response.RecursionAvailable = true
+	requestEDNS := message.IsEdns0()
+	if requestEDNS == nil {
+		return response
+	}
+	response.SetEdns0(requestEDNS.UDPSize(), requestEDNS.Do())
+	optRecord := response.IsEdns0()
+	optRecord.Option = append(optRecord.Option, &dns.EDNS0_EDE{
+		InfoCode:  err.code,
+		ExtraText: err.err.Error(),
+	})
+	return response
+}
@@ -0,0 +1,496 @@
+package dns_test
+
+import (
+	"context"
+	"crypto"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type signedTestZone struct {
+	name       string
+	key        *mDNS.DNSKEY
+	privateKey crypto.Signer
+	records    []mDNS.RR
+	expired    bool
+}
+
+func newSignedTestZone(t *testing.T, name string, signed bool, records ...string) *signedTestZone {
+	zone := &signedTestZone{name: name}
+	zone.records = append(zone.records, mustNewRR(t, name+" 3600 IN SOA ns.nic. hostmaster.nic. 1 3600 600 86400 300"))
+	for _, record := range records {
+		zone.records = append(zone.records, mustNewRR(t, record))
+	}
+	if signed {
+		zone.key = &mDNS.DNSKEY{
+			Hdr: mDNS.RR_Header{
+				Name:   name,
+				Rrtype: mDNS.TypeDNSKEY,
+				Class:  mDNS.ClassINET,
+				Ttl:    3600,
+			},
+			Flags:     mDNS.ZONE | mDNS.SEP,
+			Protocol:  3,
+			Algorithm: mDNS.ECDSAP256SHA256,
+		}
+		privateKey, err := zone.key.Generate(256)
+		require.NoError(t, err)
+		zone.privateKey = privateKey.(crypto.Signer)
+		zone.records = append(zone.records, zone.key)
+	}
+	return zone
+}
+
+func mustNewRR(t *testing.T, record string) mDNS.RR {
+	rr, err := mDNS.NewRR(record)
+	require.NoError(t, err)
+	return rr
+}
+
+func (z *signedTestZone) ds() *mDNS.DS {
+	return z.key.ToDS(mDNS.SHA256)
+}
+
+func (z *signedTestZone) delegation(child *signedTestZone) {
+	z.records = append(z.records, &mDNS.NS{
+		Hdr: mDNS.RR_Header{Name: child.name, Rrtype: mDNS.TypeNS, Class: mDNS.ClassINET, Ttl: 3600},
+		Ns:  "ns." + child.name,
+	})
+	if child.key != nil {
+		z.records = append(z.records, child.ds())
+	}
+}
+
+func (z *signedTestZone) lookup(name string, rrType uint16) []mDNS.RR {
+	var records []mDNS.RR
+	for _, record := range z.records {
+		if strings.EqualFold(record.Header().Name, name) && record.Header().Rrtype == rrType {
+			records = append(records, mDNS.Copy(record))
+		}
+	}
+	return records
+}
+
+func (z *signedTestZone) sign(t *testing.T, records []mDNS.RR) []mDNS.RR {
+	if z.key == nil || len(records) == 0 {
+		return records
+	}
+	inception := time.Now().Add(-time.Hour)
+	expiration := time.Now().Add(time.Hour)
+	if z.expired {
+		inception = time.Now().Add(-2 * time.Hour)
+		expiration = time.Now().Add(-time.Hour)
+	}
+	sig := &mDNS.RRSIG{
+		Hdr:        mDNS.RR_Header{Ttl: records[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	require.NoError(t, sig.Sign(z.privateKey, records))
+	return append(records, sig)
+}
+
+func (z *signedTestZone) nsecChain() []*mDNS.NSEC {
+	types := make(map[string][]uint16)
+	for _, record := range z.records {
+		name := mDNS.CanonicalName(record.Header().Name)
+		types[name] = append(types[name], record.Header().Rrtype)
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return canonicalLess(names[i], names[j])
+	})
+	chain := make([]*mDNS.NSEC, 0, len(names))
+	for index, name := range names {
+		typeBitMap := append(types[name], mDNS.TypeNSEC, mDNS.TypeRRSIG)
+		sort.Slice(typeBitMap, func(i, j int) bool {
+			return typeBitMap[i] < typeBitMap[j]
+		})
+		chain = append(chain, &mDNS.NSEC{
+			Hdr:        mDNS.RR_Header{Name: name, Rrtype: mDNS.TypeNSEC, Class: mDNS.ClassINET, Ttl: 300},
+			NextDomain: names[(index+1)%len(names)],
+			TypeBitMap: typeBitMap,
+		})
+	}
+	return chain
+}
+
+func canonicalLess(a string, b string) bool {
+	aLabels := mDNS.SplitDomainName(a)
+	bLabels := mDNS.SplitDomainName(b)
+	for index := 1; index <= len(aLabels) && index <= len(bLabels); index++ {
+		if aLabels[len(aLabels)-index] != bLabels[len(bLabels)-index] {
+			return aLabels[len(aLabels)-index] < bLabels[len(bLabels)-index]
+		}
+	}
+	return len(aLabels) < len(bLabels)
+}
+
+func (z *signedTestZone) exchange(t *testing.T, message *mDNS.Msg) *mDNS.Msg {
+	question := message.Question[0]
+	response := new(mDNS.Msg)
+	response.SetReply(message)
+	response.RecursionAvailable = true
+	name := question.Name
+	for range z.records {
+		records := z.lookup(name, question.Qtype)
+		if len(records) > 0 {
+			response.Answer = append(response.Answer, z.sign(t, records)...)
+			return response
+		}
+		cname := z.lookup(name, mDNS.TypeCNAME)
+		if len(cname) == 0 {
+			break
+		}
+		response.Answer = append(response.Answer, z.sign(t, cname)...)
+		name = cname[0].(*mDNS.CNAME).Target
+	}
+	response.Ns = z.sign(t, z.lookup(z.name, mDNS.TypeSOA))
+	if z.key == nil {
+		if !z.exists(name) {
+			response.Rcode = mDNS.RcodeNameError
+		}
+		return response
+	}
+	chain := z.nsecChain()
+	for _, nsec := range chain {
+		if nsec.Hdr.Name == mDNS.CanonicalName(name) {
+			response.Ns = append(response.Ns, z.sign(t, []mDNS.RR{nsec})...)
+			return response
+		}
+	}
+	response.Rcode = mDNS.RcodeNameError
+	covered := make(map[string]bool)
+	for _, target := range []string{mDNS.CanonicalName(name), "*." + z.name} {
+		for index, nsec := range chain {
+			if canonicalLess(nsec.Hdr.Name, target) && (index == len(chain)-1 || canonicalLess(target, chain[index+1].Hdr.Name)) {
+				if !covered[nsec.Hdr.Name] {
+					covered[nsec.Hdr.Name] = true
+					response.Ns = append(response.Ns, z.sign(t, []mDNS.RR{nsec})...)
+				}
+				break
+			}
+		}
+	}
+	return response
+}
+
+func (z *signedTestZone) exists(name string) bool {
+	for _, record := range z.records {
+		if strings.EqualFold(record.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func newSignedTestTransport(t *testing.T, zones ...*signedTestZone) *testTransport {
+	transport := newTestTransport(0)
+	transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		question := message.Question[0]
+		var zone *signedTestZone
+		for _, it := range zones {
+			if !mDNS.IsSubDomain(it.name, question.Name) {
+				continue
+			}
+			if question.Qtype == mDNS.TypeDS && strings.EqualFold(it.name, question.Name) && it.name != "." {
+				continue
+			}
+			if zone == nil || mDNS.CountLabel(it.name) > mDNS.CountLabel(zone.name) {
+				zone = it
+			}
+		}
+		response := zone.exchange(t, message)
+		if opt := message.IsEdns0(); opt == nil || !opt.Do() {
+			for _, recordList := range []*[]mDNS.RR{&response.Answer, &response.Ns} {
+				var records []mDNS.RR
+				for _, record := range *recordList {
+					switch record.Header().Rrtype {
+					case mDNS.TypeRRSIG, mDNS.TypeNSEC:
+					default:
+						records = append(records, record)
+					}
+				}
+				*recordList = records
+			}
+		}
+		return response, nil
+	}
+	return transport
+}
+
+func newDNSSECTestZones(t *testing.T) (*signedTestZone, *signedTestZone, *signedTestZone) {
+	exampleZone := newSignedTestZone(t, "example.", true,
+		"www.example. 300 IN A 10.0.0.80",
+		"alias.example. 300 IN CNAME www.example.",
+		"forged.example. 300 IN A 10.0.0.1",
+	)
+	insecureZone := newSignedTestZone(t, "insecure.", false,
+		"www.insecure. 300 IN A 10.0.1.80",
+	)
+	rootZone := newSignedTestZone(t, ".", true)
+	rootZone.delegation(exampleZone)
+	rootZone.delegation(insecureZone)
+	return rootZone, exampleZone, insecureZone
+}
+
+func newTestEDNSQuery(domain string, qType uint16) *mDNS.Msg {
+	message := newTestQuery(domain, qType)
+	message.SetEdns0(1232, false)
+	return message
+}
+
+func extendedError(response *mDNS.Msg) *mDNS.EDNS0_EDE {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ede, isEDE := option.(*mDNS.EDNS0_EDE); isEDE {
+			return ede
+		}
+	}
+	return nil
+}
+
+func TestClientDNSSEC(t *testing.T) {
+	t.Parallel()
+	rootZone, exampleZone, insecureZone := newDNSSECTestZones(t)
+	transport := newSignedTestTransport(t, rootZone, exampleZone, insecureZone)
+	client := dns.NewClient(dns.ClientOptions{
+		DNSSEC:       true,
+		TrustAnchors: []*mDNS.DS{rootZone.ds()},
+	})
+
+	response, err := client.Exchange(context.Background(), transport, newTestQuery("www.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.True(t, response.AuthenticatedData)
+	require.Len(t, response.Answer, 1)
+	require.Nil(t, response.IsEdns0())
+
+	message := newTestQuery("alias.example", mDNS.TypeA)
+	message.SetEdns0(1232, true)
+	response, err = client.Exchange(context.Background(), transport, message, dns.QueryOptions{})
+	require.NoError(t, err)
+	require.True(t, response.AuthenticatedData)
+	require.Len(t, response.Answer, 4)
+
+	response, err = client.Exchange(context.Background(), transport, newTestQuery("missing.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.True(t, response.AuthenticatedData)
+	require.Len(t, response.Ns, 1)
+
+	response, err = client.Exchange(context.Background(), transport, newTestQuery("www.example", mDNS.TypeAAAA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.True(t, response.AuthenticatedData)
+	require.Empty(t, response.Answer)
+
+	response, err = client.Exchange(context.Background(), transport, newTestQuery("www.insecure", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.False(t, response.AuthenticatedData)
+	require.Len(t, response.Answer, 1)
+}
+
+func TestClientDNSSECBogus(t *testing.T) {
+	t.Parallel()
+	rootZone, exampleZone, insecureZone := newDNSSECTestZones(t)
+	transport := newSignedTestTransport(t, rootZone, exampleZone, insecureZone)
+	signedExchange := transport.exchange
+	transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		response, err := signedExchange(ctx, message)
+		if err == nil && message.Question[0].Name == "forged.example." {
+			for _, record := range response.Answer {
+				if a, isA := record.(*mDNS.A); isA {
+					a.A = netip.MustParseAddr("192.0.2.1").AsSlice()
+				}
+			}
+		}
+		return response, err
+	}
+	client := dns.NewClient(dns.ClientOptions{
+		DNSSEC:       true,
+		TrustAnchors: []*mDNS.DS{rootZone.ds()},
+	})
+
+	response, err := client.Exchange(context.Background(), transport, newTestQuery("forged.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+	require.Nil(t, response.IsEdns0())
+
+	response, err = client.Exchange(context.Background(), transport, newTestEDNSQuery("forged.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Equal(t, uint16(1232), response.IsEdns0().UDPSize())
+	ede := extendedError(response)
+	require.NotNil(t, ede)
+	require.Equal(t, mDNS.ExtendedErrorCodeDNSBogus, ede.InfoCode)
+
+	message := newTestQuery("forged.example", mDNS.TypeA)
+	message.CheckingDisabled = true
+	response, err = client.Exchange(context.Background(), transport, message, dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.False(t, response.AuthenticatedData)
+	require.Equal(t, "192.0.2.1", response.Answer[0].(*mDNS.A).A.String())
+
+	exampleZone.expired = true
+	response, err = client.Exchange(context.Background(), transport, newTestEDNSQuery("www.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+	ede = extendedError(response)
+	require.NotNil(t, ede)
+	require.Equal(t, mDNS.ExtendedErrorCodeSignatureExpired, ede.InfoCode)
+}
+
+func TestClientDNSSECTrustAnchorMismatch(t *testing.T) {
+	t.Parallel()
+	rootZone, exampleZone, insecureZone := newDNSSECTestZones(t)
+	transport := newSignedTestTransport(t, rootZone, exampleZone, insecureZone)
+	client := dns.NewClient(dns.ClientOptions{
+		DNSSEC:       true,
+		TrustAnchors: []*mDNS.DS{exampleZone.ds()},
+	})
+	response, err := client.Exchange(context.Background(), transport, newTestQuery("www.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.True(t, response.AuthenticatedData)
+
+	anchor := rootZone.ds()
+	anchor.Digest = strings.Repeat("0", len(anchor.Digest))
+	client = dns.NewClient(dns.ClientOptions{
+		DNSSEC:       true,
+		TrustAnchors: []*mDNS.DS{anchor},
+	})
+	response, err = client.Exchange(context.Background(), transport, newTestEDNSQuery("www.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+	ede := extendedError(response)
+	require.NotNil(t, ede)
+	require.Equal(t, mDNS.ExtendedErrorCodeDNSKEYMissing, ede.InfoCode)
+}
+
+func TestClientDNSSECLimits(t *testing.T) {
+	t.Parallel()
+	rootZone, exampleZone, insecureZone := newDNSSECTestZones(t)
+	transport := newSignedTestTransport(t, rootZone, exampleZone, insecureZone)
+	signedExchange := transport.exchange
+	transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		response, err := signedExchange(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		switch message.Question[0].Name {
+		case "www.example.":
+			sig := response.Answer[len(response.Answer)-1].(*mDNS.RRSIG)
+			var answer []mDNS.RR
+			for i := 0; i < 64; i++ {
+				forged := mDNS.Copy(sig).(*mDNS.RRSIG)
+				forged.Signature = strings.Repeat("A", len(sig.Signature))
+				answer = append(answer, forged)
+			}
+			response.Answer = append(response.Answer[:len(response.Answer)-1], append(answer, sig)...)
+		case "missing.example.":
+			var ns []mDNS.RR
+			for _, record := range response.Ns {
+				switch record := record.(type) {
+				case *mDNS.NSEC:
+					continue
+				case *mDNS.RRSIG:
+					if record.TypeCovered == mDNS.TypeNSEC {
+						continue
+					}
+				}
+				ns = append(ns, record)
+			}
+			nsec3 := &mDNS.NSEC3{
+				Hdr:        mDNS.RR_Header{Name: "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.", Rrtype: mDNS.TypeNSEC3, Class: mDNS.ClassINET, Ttl: 300},
+				Hash:       mDNS.SHA1,
+				Iterations: 500,
+				SaltLength: 0,
+				HashLength: 20,
+				NextDomain: "2t7b4g4vsa5smi47k61mv5bv1a22bojr",
+				TypeBitMap: []uint16{mDNS.TypeA, mDNS.TypeRRSIG},
+			}
+			response.Ns = append(ns, exampleZone.sign(t, []mDNS.RR{nsec3})...)
+		}
+		return response, nil
+	}
+	client := dns.NewClient(dns.ClientOptions{
+		DNSSEC:       true,
+		TrustAnchors: []*mDNS.DS{rootZone.ds()},
+	})
+
+	response, err := client.Exchange(context.Background(), transport, newTestEDNSQuery("www.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+	ede := extendedError(response)
+	require.NotNil(t, ede)
+	require.Equal(t, mDNS.ExtendedErrorCodeDNSBogus, ede.InfoCode)
+
+	response, err = client.Exchange(context.Background(), transport, newTestQuery("missing.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.False(t, response.AuthenticatedData)
+}
+
+func TestClientDNSSECOptOut(t *testing.T) {
+	t.Parallel()
+	rootZone, exampleZone, insecureZone := newDNSSECTestZones(t)
+	transport := newSignedTestTransport(t, rootZone, exampleZone, insecureZone)
+	signedExchange := transport.exchange
+	transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		response, err := signedExchange(ctx, message)
+		if err != nil || message.Question[0].Name != "missing.example." {
+			return response, err
+		}
+		apexHash := mDNS.HashName("example.", mDNS.SHA1, 0, "")
+		nsec3 := &mDNS.NSEC3{
+			Hdr:        mDNS.RR_Header{Name: strings.ToLower(apexHash) + ".example.", Rrtype: mDNS.TypeNSEC3, Class: mDNS.ClassINET, Ttl: 300},
+			Hash:       mDNS.SHA1,
+			Flags:      1,
+			HashLength: 20,
+			NextDomain: apexHash,
+			TypeBitMap: []uint16{mDNS.TypeNS, mDNS.TypeSOA, mDNS.TypeRRSIG, mDNS.TypeDNSKEY, mDNS.TypeNSEC3PARAM},
+		}
+		var ns []mDNS.RR
+		for _, record := range response.Ns {
+			switch record := record.(type) {
+			case *mDNS.NSEC:
+				continue
+			case *mDNS.RRSIG:
+				if record.TypeCovered == mDNS.TypeNSEC {
+					continue
+				}
+			}
+			ns = append(ns, record)
+		}
+		response.Ns = append(ns, exampleZone.sign(t, []mDNS.RR{nsec3})...)
+		return response, nil
+	}
+	client := dns.NewClient(dns.ClientOptions{
+		DNSSEC:       true,
+		TrustAnchors: []*mDNS.DS{rootZone.ds()},
+	})
+	response, err := client.Exchange(context.Background(), transport, newTestQuery("missing.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.False(t, response.AuthenticatedData)
+}
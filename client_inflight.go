@@ -0,0 +1,82 @@
+package dns
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type inFlightExchange struct {
+	done     chan struct{}
+	cancel   context.CancelFunc
+	waiters  int
+	response *dns.Msg
+	err      error
+}
+
+func (c *Client) exchangeInFlight(ctx context.Context, transport Transport, message *dns.Msg) (*dns.Msg, error) {
+	key := transportCacheKey{
+		Question:      message.Question[0],
+		transportName: transport.Name(),
+	}
+	c.inFlightAccess.Lock()
+	call, loaded := c.inFlight[key]
+	if !loaded {
+		exchangeCtx, cancel := context.WithTimeout(detachedContext{ctx}, c.timeout)
+		call = &inFlightExchange{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		c.inFlight[key] = call
+		message = message.Copy()
+		go func() {
+			response, err := c.exchangeTransport(exchangeCtx, transport, message)
+			cancel()
+			c.inFlightAccess.Lock()
+			if c.inFlight[key] == call {
+				delete(c.inFlight, key)
+			}
+			c.inFlightAccess.Unlock()
+			call.response = response
+			call.err = err
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	c.inFlightAccess.Unlock()
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, call.err
+		}
+		return call.response.Copy(), nil
+	case <-ctx.Done():
+		c.inFlightAccess.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			if c.inFlight[key] == call {
+				delete(c.inFlight, key)
+			}
+			call.cancel()
+		}
+		c.inFlightAccess.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
@@ -6,5 +6,7 @@ type QueryOptions struct {
 	Strategy     DomainStrategy
 	DisableCache bool
 	RewriteTTL   *uint32
+	MinTTL       uint32
+	MaxTTL       uint32
 	ClientSubnet netip.Prefix
 }
@@ -0,0 +1,277 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/contrab/freelru"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	cacheSnapshotMagic   = "SDNC"
+	cacheSnapshotVersion = 2
+)
+
+func (c *Client) SaveCache() error {
+	if c.cachePath == "" {
+		return E.New("missing cache path")
+	}
+	err := ensureCacheDirectory(c.cachePath)
+	if err != nil {
+		return err
+	}
+	temporaryPath := c.cachePath + ".tmp"
+	file, err := os.Create(temporaryPath)
+	if err != nil {
+		return err
+	}
+	err = c.ExportCache(file)
+	if err != nil {
+		file.Close()
+		os.Remove(temporaryPath)
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	return os.Rename(temporaryPath, c.cachePath)
+}
+
+func (c *Client) loadCacheFile() error {
+	file, err := os.Open(c.cachePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return c.ImportCache(file)
+}
+
+func (c *Client) ExportCache(writer io.Writer) error {
+	if c.disableCache {
+		return E.New("cache disabled")
+	}
+	bufferedWriter := bufio.NewWriter(writer)
+	_, err := bufferedWriter.WriteString(cacheSnapshotMagic)
+	if err != nil {
+		return err
+	}
+	err = bufferedWriter.WriteByte(cacheSnapshotVersion)
+	if err != nil {
+		return err
+	}
+	var entryErr error
+	writeEntry := func(transportName string, clientSubnet netip.Prefix, response *dns.Msg, expireAt time.Time) bool {
+		var expireAtMilli int64
+		if !expireAt.IsZero() {
+			expireAtMilli = expireAt.UnixMilli()
+		}
+		var rawMessage []byte
+		rawMessage, entryErr = response.Pack()
+		if entryErr != nil {
+			return false
+		}
+		entryErr = writeSnapshotEntry(bufferedWriter, transportName, clientSubnet, expireAtMilli, rawMessage)
+		return entryErr == nil
+	}
+	c.rangeCache(func(question dns.Question, transportName string, response *dns.Msg, expireAt time.Time) bool {
+		return writeEntry(transportName, netip.Prefix{}, response, expireAt)
+	})
+	if entryErr != nil {
+		return entryErr
+	}
+	c.rangeSubnetCache(func(key subnetCacheKey, entry *cacheEntry) bool {
+		return writeEntry(key.transportName, key.clientSubnet, entry.message, entry.expireAt)
+	})
+	if entryErr != nil {
+		return entryErr
+	}
+	return bufferedWriter.Flush()
+}
+
+func (c *Client) ImportCache(reader io.Reader) error {
+	if c.disableCache {
+		return E.New("cache disabled")
+	}
+	bufferedReader := bufio.NewReader(reader)
+	header := make([]byte, len(cacheSnapshotMagic)+1)
+	_, err := io.ReadFull(bufferedReader, header)
+	if err != nil {
+		return E.Cause(err, "read cache snapshot header")
+	}
+	if string(header[:len(cacheSnapshotMagic)]) != cacheSnapshotMagic {
+		return E.New("invalid cache snapshot")
+	}
+	version := header[len(cacheSnapshotMagic)]
+	if version == 0 || version > cacheSnapshotVersion {
+		return E.New("unsupported cache snapshot version: ", version)
+	}
+	timeNow := time.Now()
+	for {
+		transportName, clientSubnet, expireAtMilli, rawMessage, err := readSnapshotEntry(bufferedReader, version)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return E.Cause(err, "read cache snapshot entry")
+		}
+		var message dns.Msg
+		err = message.Unpack(rawMessage)
+		if err != nil {
+			return E.Cause(err, "unpack cache snapshot entry")
+		}
+		if len(message.Question) != 1 {
+			continue
+		}
+		question := message.Question[0]
+		if c.independentCache && transportName == "" {
+			continue
+		}
+		entry := &cacheEntry{
+			message: &message,
+		}
+		var lifetime time.Duration
+		if !c.disableExpire {
+			if expireAtMilli > 0 {
+				entry.expireAt = time.UnixMilli(expireAtMilli)
+			} else {
+				entry.expireAt = timeNow.Add(time.Second * DefaultTTL)
+			}
+			lifetime = entry.expireAt.Sub(timeNow)
+			if c.serveStale && !clientSubnet.IsValid() {
+				lifetime += c.serveStaleTTL
+			}
+			if lifetime <= 0 {
+				continue
+			}
+		}
+		if clientSubnet.IsValid() {
+			key := subnetCacheKey{
+				Question:     question,
+				clientSubnet: clientSubnet,
+			}
+			if c.independentCache {
+				key.transportName = transportName
+			}
+			addSnapshotEntry(c.subnetCache, key, entry, lifetime)
+		} else if !c.independentCache {
+			addSnapshotEntry(c.cache, question, entry, lifetime)
+		} else {
+			addSnapshotEntry(c.transportCache, transportCacheKey{
+				Question:      question,
+				transportName: transportName,
+			}, entry, lifetime)
+		}
+	}
+}
+
+func addSnapshotEntry[K comparable](cache freelru.Cache[K, *cacheEntry], key K, entry *cacheEntry, lifetime time.Duration) {
+	if lifetime == 0 {
+		cache.Add(key, entry)
+	} else {
+		cache.AddWithLifetime(key, entry, lifetime)
+	}
+}
+
+func writeSnapshotEntry(writer *bufio.Writer, transportName string, clientSubnet netip.Prefix, expireAt int64, rawMessage []byte) error {
+	var buffer [binary.MaxVarintLen64]byte
+	_, err := writer.Write(binary.AppendUvarint(buffer[:0], uint64(len(transportName))))
+	if err != nil {
+		return err
+	}
+	_, err = writer.WriteString(transportName)
+	if err != nil {
+		return err
+	}
+	var rawSubnet []byte
+	if clientSubnet.IsValid() {
+		rawSubnet, err = clientSubnet.MarshalBinary()
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.WriteByte(byte(len(rawSubnet)))
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(rawSubnet)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(binary.AppendVarint(buffer[:0], expireAt))
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(binary.AppendUvarint(buffer[:0], uint64(len(rawMessage))))
+	if err != nil {
+		return err
+	}
+	return common.Error(writer.Write(rawMessage))
+}
+
+func readSnapshotEntry(reader *bufio.Reader, version byte) (transportName string, clientSubnet netip.Prefix, expireAt int64, rawMessage []byte, err error) {
+	nameLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return
+	}
+	if nameLen > 0xffff {
+		err = E.New("invalid transport name length: ", nameLen)
+		return
+	}
+	name := make([]byte, nameLen)
+	_, err = io.ReadFull(reader, name)
+	if err != nil {
+		return
+	}
+	transportName = string(name)
+	if version >= 2 {
+		var subnetLen byte
+		subnetLen, err = reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if subnetLen > 0 {
+			rawSubnet := make([]byte, subnetLen)
+			_, err = io.ReadFull(reader, rawSubnet)
+			if err != nil {
+				return
+			}
+			err = clientSubnet.UnmarshalBinary(rawSubnet)
+			if err != nil {
+				return
+			}
+		}
+	}
+	expireAt, err = binary.ReadVarint(reader)
+	if err != nil {
+		return
+	}
+	messageLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return
+	}
+	if messageLen > dns.MaxMsgSize {
+		err = E.New("invalid message length: ", messageLen)
+		return
+	}
+	rawMessage = make([]byte, messageLen)
+	_, err = io.ReadFull(reader, rawMessage)
+	return
+}
+
+func ensureCacheDirectory(path string) error {
+	directory := filepath.Dir(path)
+	if directory == "" || directory == "." {
+		return nil
+	}
+	return os.MkdirAll(directory, 0o755)
+}
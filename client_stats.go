@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CacheStats struct {
+	CacheCounters
+	Transports map[string]CacheCounters
+}
+
+type CacheCounters struct {
+	Hits        uint64
+	Misses      uint64
+	Expirations uint64
+	Evictions   uint64
+	Stores      uint64
+	Rejections  uint64
+}
+
+func (c CacheCounters) HitRatio() float64 {
+	total := c.Hits + c.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(total)
+}
+
+type cacheCounters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	expirations atomic.Uint64
+	evictions   atomic.Uint64
+	stores      atomic.Uint64
+	rejections  atomic.Uint64
+}
+
+func (c *cacheCounters) snapshot() CacheCounters {
+	return CacheCounters{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Expirations: c.expirations.Load(),
+		Evictions:   c.evictions.Load(),
+		Stores:      c.stores.Load(),
+		Rejections:  c.rejections.Load(),
+	}
+}
+
+func (c *cacheCounters) reset() {
+	c.hits.Store(0)
+	c.misses.Store(0)
+	c.expirations.Store(0)
+	c.evictions.Store(0)
+	c.stores.Store(0)
+	c.rejections.Store(0)
+}
+
+type cacheStats struct {
+	total      cacheCounters
+	access     sync.RWMutex
+	transports map[string]*cacheCounters
+}
+
+func (s *cacheStats) update(transport Transport, update func(counters *cacheCounters)) {
+	if transport == nil {
+		update(&s.total)
+		return
+	}
+	transportName := transport.Name()
+	s.updateTransport(&transportName, update)
+}
+
+func (s *cacheStats) updateTransport(transportName *string, update func(counters *cacheCounters)) {
+	update(&s.total)
+	if transportName == nil {
+		return
+	}
+	s.access.RLock()
+	counters, loaded := s.transports[*transportName]
+	s.access.RUnlock()
+	if !loaded {
+		s.access.Lock()
+		counters, loaded = s.transports[*transportName]
+		if !loaded {
+			if s.transports == nil {
+				s.transports = make(map[string]*cacheCounters)
+			}
+			counters = new(cacheCounters)
+			s.transports[*transportName] = counters
+		}
+		s.access.Unlock()
+	}
+	update(counters)
+}
+
+func (s *cacheStats) hit(transport Transport) {
+	s.update(transport, func(counters *cacheCounters) {
+		counters.hits.Add(1)
+	})
+}
+
+func (s *cacheStats) miss(transport Transport) {
+	s.update(transport, func(counters *cacheCounters) {
+		counters.misses.Add(1)
+	})
+}
+
+func (s *cacheStats) store(transport Transport) {
+	s.update(transport, func(counters *cacheCounters) {
+		counters.stores.Add(1)
+	})
+}
+
+func (s *cacheStats) evict(transportName *string, entry *cacheEntry) {
+	if entry.removed.Load() {
+		return
+	}
+	if !entry.expireAt.IsZero() && !time.Now().Before(entry.expireAt) {
+		s.updateTransport(transportName, func(counters *cacheCounters) {
+			counters.expirations.Add(1)
+		})
+	} else {
+		s.updateTransport(transportName, func(counters *cacheCounters) {
+			counters.evictions.Add(1)
+		})
+	}
+}
+
+func (s *cacheStats) reject(transport Transport) {
+	s.update(transport, func(counters *cacheCounters) {
+		counters.rejections.Add(1)
+	})
+}
+
+func (c *Client) CacheStats() CacheStats {
+	stats := CacheStats{
+		CacheCounters: c.stats.total.snapshot(),
+		Transports:    make(map[string]CacheCounters),
+	}
+	c.stats.access.RLock()
+	for transportName, counters := range c.stats.transports {
+		stats.Transports[transportName] = counters.snapshot()
+	}
+	c.stats.access.RUnlock()
+	return stats
+}
+
+func (c *Client) ResetCacheStats() {
+	c.stats.access.Lock()
+	c.stats.total.reset()
+	c.stats.transports = nil
+	c.stats.access.Unlock()
+}
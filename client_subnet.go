@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"net/netip"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/miekg/dns"
+)
+
+type subnetCacheKey struct {
+	dns.Question
+	transportName string
+	clientSubnet  netip.Prefix
+}
+
+func requestClientSubnet(message *dns.Msg) (netip.Prefix, bool) {
+	if len(message.Question) != 1 || len(message.Ns) != 0 || len(message.Extra) != 1 {
+		return netip.Prefix{}, false
+	}
+	optRecord, isOPTRecord := message.Extra[0].(*dns.OPT)
+	if !isOPTRecord || optRecord.Do() || len(optRecord.Option) != 1 {
+		return netip.Prefix{}, false
+	}
+	subnetOption, isEDNS0Subnet := optRecord.Option[0].(*dns.EDNS0_SUBNET)
+	if !isEDNS0Subnet {
+		return netip.Prefix{}, false
+	}
+	address := M.AddrFromIP(subnetOption.Address)
+	if !address.IsValid() {
+		return netip.Prefix{}, false
+	}
+	clientSubnet, err := address.Prefix(int(subnetOption.SourceNetmask))
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return clientSubnet, true
+}
+
+func responseScope(response *dns.Msg) int {
+	optRecord := response.IsEdns0()
+	if optRecord == nil {
+		return 0
+	}
+	for _, option := range optRecord.Option {
+		subnetOption, isEDNS0Subnet := option.(*dns.EDNS0_SUBNET)
+		if isEDNS0Subnet {
+			return int(subnetOption.SourceScope)
+		}
+	}
+	return 0
+}
+
+func rewriteResponseSubnet(response *dns.Msg, clientSubnet netip.Prefix, scope int) {
+	optRecord := response.IsEdns0()
+	if optRecord == nil {
+		return
+	}
+	for index, option := range optRecord.Option {
+		if _, isEDNS0Subnet := option.(*dns.EDNS0_SUBNET); !isEDNS0Subnet {
+			continue
+		}
+		subnetOption := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			SourceNetmask: uint8(clientSubnet.Bits()),
+			SourceScope:   uint8(scope),
+			Address:       clientSubnet.Addr().AsSlice(),
+		}
+		if clientSubnet.Addr().Is4() {
+			subnetOption.Family = 1
+		} else {
+			subnetOption.Family = 2
+		}
+		optRecord.Option[index] = subnetOption
+	}
+}
+
+func (c *Client) loadSubnetResponse(question dns.Question, clientSubnet netip.Prefix, transport Transport) (*dns.Msg, int) {
+	key := subnetCacheKey{
+		Question: question,
+	}
+	if c.independentCache {
+		key.transportName = transport.Name()
+	}
+	for bits := clientSubnet.Bits(); bits >= 0; bits-- {
+		key.clientSubnet = netip.PrefixFrom(clientSubnet.Addr(), bits).Masked()
+		entry, loaded := c.subnetCache.Peek(key)
+		if !loaded {
+			continue
+		}
+		if !c.disableExpire && time.Now().After(entry.expireAt) {
+			c.subnetCache.Remove(key)
+			continue
+		}
+		c.subnetCache.Get(key)
+		c.stats.hit(transport)
+		response, ttl, _ := c.cachedResponse(entry)
+		rewriteResponseSubnet(response, clientSubnet, bits)
+		return response, ttl
+	}
+	c.stats.miss(transport)
+	return nil, 0
+}
+
+func (c *Client) storeSubnetCache(transport Transport, question dns.Question, clientSubnet netip.Prefix, scope int, message *dns.Msg, timeToLive uint32) {
+	if timeToLive == 0 {
+		return
+	}
+	if scope > clientSubnet.Bits() {
+		scope = clientSubnet.Bits()
+	}
+	key := subnetCacheKey{
+		Question:     question,
+		clientSubnet: netip.PrefixFrom(clientSubnet.Addr(), scope).Masked(),
+	}
+	if c.independentCache {
+		key.transportName = transport.Name()
+	}
+	entry := &cacheEntry{
+		message: message,
+	}
+	c.stats.store(transport)
+	if c.disableExpire {
+		c.subnetCache.Add(key, entry)
+		return
+	}
+	lifetime := time.Second * time.Duration(timeToLive)
+	entry.expireAt = time.Now().Add(lifetime)
+	c.subnetCache.AddWithLifetime(key, entry, lifetime)
+}
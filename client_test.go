@@ -0,0 +1,670 @@
+package dns_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+var _ dns.Transport = (*testTransport)(nil)
+
+type testTransport struct {
+	name     string
+	access   sync.Mutex
+	ttl      uint32
+	address  netip.Addr
+	err      error
+	queries  atomic.Int32
+	exchange func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error)
+	lookup   func(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error)
+}
+
+func newTestTransport(ttl uint32) *testTransport {
+	return &testTransport{
+		name:    "test",
+		ttl:     ttl,
+		address: netip.MustParseAddr("1.1.1.1"),
+	}
+}
+
+func (t *testTransport) Name() string {
+	return t.name
+}
+
+func (t *testTransport) Start() error {
+	return nil
+}
+
+func (t *testTransport) Reset() {
+}
+
+func (t *testTransport) Close() error {
+	return nil
+}
+
+func (t *testTransport) Raw() bool {
+	return t.lookup == nil
+}
+
+func (t *testTransport) setError(err error) {
+	t.access.Lock()
+	t.err = err
+	t.access.Unlock()
+}
+
+func (t *testTransport) Exchange(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+	t.queries.Add(1)
+	if t.exchange != nil {
+		return t.exchange(ctx, message)
+	}
+	t.access.Lock()
+	err := t.err
+	t.access.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	address := t.address
+	if message.Question[0].Qtype == mDNS.TypeAAAA {
+		address = netip.AddrFrom16(address.As16())
+	}
+	return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{address}, t.ttl), nil
+}
+
+func (t *testTransport) Lookup(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+	if t.lookup == nil {
+		return nil, os.ErrInvalid
+	}
+	t.queries.Add(1)
+	return t.lookup(ctx, domain, strategy)
+}
+
+func newTestQuery(domain string, qType uint16) *mDNS.Msg {
+	message := new(mDNS.Msg)
+	message.SetQuestion(mDNS.Fqdn(domain), qType)
+	return message
+}
+
+func TestClientServeStale(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(1)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:     logger.NOP(),
+		ServeStale: true,
+	})
+	ctx := context.Background()
+	_, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	transport.setError(os.ErrDeadlineExceeded)
+	response, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint32(dns.StaleAnswerTTL), response.Answer[0].Header().Ttl)
+	require.Eventually(t, func() bool {
+		return transport.queries.Load() == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	transport.setError(nil)
+	response, err = client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), response.Answer[0].Header().Ttl)
+}
+
+func TestClientServeStaleLookup(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(0)
+	var failing atomic.Bool
+	transport.lookup = func(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+		if failing.Load() {
+			return nil, os.ErrDeadlineExceeded
+		}
+		return []netip.Addr{transport.address}, nil
+	}
+	ttl := uint32(1)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:     logger.NOP(),
+		ServeStale: true,
+	})
+	ctx := context.Background()
+	options := dns.QueryOptions{
+		Strategy:   dns.DomainStrategyUseIPv4,
+		RewriteTTL: &ttl,
+	}
+	_, err := client.Lookup(ctx, transport, "example.com", options)
+	require.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	failing.Store(true)
+	addresses, err := client.Lookup(ctx, transport, "example.com", options)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{transport.address}, addresses)
+	require.Eventually(t, func() bool {
+		return transport.queries.Load() == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClientServeStaleDisabled(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(1)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	ctx := context.Background()
+	_, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	transport.setError(os.ErrDeadlineExceeded)
+	_, err = client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestClientPrefetch(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(2)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:        logger.NOP(),
+		Prefetch:      true,
+		PrefetchRatio: 0.9,
+	})
+	ctx := context.Background()
+	_, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), transport.queries.Load())
+	response, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Eventually(t, func() bool {
+		return transport.queries.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		addresses, lookupErr := client.Lookup(ctx, transport, "example.com", dns.QueryOptions{
+			Strategy: dns.DomainStrategyUseIPv4,
+		})
+		require.NoError(t, lookupErr)
+		require.Equal(t, []netip.Addr{transport.address}, addresses)
+		return transport.queries.Load() >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClientPrefetchLookup(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(0)
+	transport.lookup = func(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+		return []netip.Addr{transport.address}, nil
+	}
+	ttl := uint32(2)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:        logger.NOP(),
+		Prefetch:      true,
+		PrefetchRatio: 0.9,
+	})
+	ctx := context.Background()
+	options := dns.QueryOptions{
+		RewriteTTL: &ttl,
+	}
+	_, err := client.Lookup(ctx, transport, "example.com", options)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), transport.queries.Load())
+	addresses, err := client.Lookup(ctx, transport, "example.com", options)
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{transport.address}, addresses)
+	require.Eventually(t, func() bool {
+		return transport.queries.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClientInFlight(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(60)
+	release := make(chan struct{})
+	transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{transport.address}, transport.ttl), nil
+	}
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	var group sync.WaitGroup
+	var canceledErr error
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		_, canceledErr = client.Lookup(canceledCtx, transport, "example.com", dns.QueryOptions{
+			Strategy: dns.DomainStrategyUseIPv4,
+		})
+	}()
+	results := make([][]netip.Addr, 100)
+	lookupErrors := make([]error, 100)
+	for i := range results {
+		index := i
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			results[index], lookupErrors[index] = client.Lookup(context.Background(), transport, "example.com", dns.QueryOptions{
+				Strategy: dns.DomainStrategyUseIPv4,
+			})
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return transport.queries.Load() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	group.Wait()
+	require.ErrorIs(t, canceledErr, context.Canceled)
+	require.Equal(t, int32(1), transport.queries.Load())
+	for i := range results {
+		require.NoError(t, lookupErrors[i])
+		require.Equal(t, []netip.Addr{transport.address}, results[i])
+	}
+}
+
+func TestClientInFlightTransports(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	newTransport := func(name string, address string) *testTransport {
+		transport := newTestTransport(60)
+		transport.name = name
+		transport.address = netip.MustParseAddr(address)
+		transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+			<-release
+			return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{transport.address}, transport.ttl), nil
+		}
+		return transport
+	}
+	transports := []*testTransport{newTransport("a", "1.1.1.1"), newTransport("b", "2.2.2.2")}
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	var group sync.WaitGroup
+	results := make([][]netip.Addr, len(transports))
+	lookupErrors := make([]error, len(transports))
+	for i := range transports {
+		index := i
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			results[index], lookupErrors[index] = client.Lookup(context.Background(), transports[index], "example.com", dns.QueryOptions{
+				Strategy: dns.DomainStrategyUseIPv4,
+			})
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return transports[0].queries.Load() == 1 && transports[1].queries.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	group.Wait()
+	for i, transport := range transports {
+		require.NoError(t, lookupErrors[i])
+		require.Equal(t, []netip.Addr{transport.address}, results[i])
+	}
+}
+
+func newNegativeResponse(message *mDNS.Msg, rCode int, soaTTL uint32, minTTL uint32) *mDNS.Msg {
+	response := new(mDNS.Msg)
+	response.SetRcode(message, rCode)
+	if soaTTL > 0 {
+		response.Ns = append(response.Ns, &mDNS.SOA{
+			Hdr: mDNS.RR_Header{
+				Name:   "example.com.",
+				Rrtype: mDNS.TypeSOA,
+				Class:  mDNS.ClassINET,
+				Ttl:    soaTTL,
+			},
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: minTTL,
+		})
+	}
+	return response
+}
+
+func TestClientNegativeCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	for _, testCase := range []struct {
+		name           string
+		rCode          int
+		soaTTL         uint32
+		minTTL         uint32
+		maxNegativeTTL uint32
+		expectedTTL    uint32
+	}{
+		{"nxdomain", mDNS.RcodeNameError, 300, 30, 0, 30},
+		{"nodata", mDNS.RcodeSuccess, 20, 300, 0, 20},
+		{"capped", mDNS.RcodeNameError, 7200, 7200, 100, 100},
+		{"no soa", mDNS.RcodeNameError, 0, 0, 0, 0},
+	} {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			transport := newTestTransport(60)
+			transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+				return newNegativeResponse(message, testCase.rCode, testCase.soaTTL, testCase.minTTL), nil
+			}
+			client := dns.NewClient(dns.ClientOptions{
+				Logger:         logger.NOP(),
+				MaxNegativeTTL: testCase.maxNegativeTTL,
+			})
+			for i := 0; i < 2; i++ {
+				response, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+				require.NoError(t, err)
+				require.Equal(t, testCase.rCode, response.Rcode)
+				if testCase.expectedTTL > 0 {
+					require.Len(t, response.Ns, 1)
+					require.LessOrEqual(t, response.Ns[0].Header().Ttl, testCase.expectedTTL)
+					require.Greater(t, response.Ns[0].Header().Ttl, testCase.expectedTTL-2)
+				}
+			}
+			if testCase.expectedTTL > 0 {
+				require.Equal(t, int32(1), transport.queries.Load())
+			} else {
+				require.Equal(t, int32(2), transport.queries.Load())
+			}
+		})
+	}
+}
+
+func TestClientNegativeCacheLookup(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(0)
+	transport.lookup = func(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:      logger.NOP(),
+		NegativeTTL: 1,
+	})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := client.Lookup(ctx, transport, "example.com", dns.QueryOptions{})
+		require.ErrorIs(t, err, dns.RCodeNameError)
+	}
+	require.Equal(t, int32(1), transport.queries.Load())
+	time.Sleep(1100 * time.Millisecond)
+	_, err := client.Lookup(ctx, transport, "example.com", dns.QueryOptions{})
+	require.ErrorIs(t, err, dns.RCodeNameError)
+	require.Equal(t, int32(2), transport.queries.Load())
+}
+
+func TestClientNoDataCacheLookup(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(0)
+	transport.lookup = func(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+		return nil, nil
+	}
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:      logger.NOP(),
+		NegativeTTL: 60,
+	})
+	ctx := context.Background()
+	_, err := client.Lookup(ctx, transport, "example.com", dns.QueryOptions{})
+	require.NoError(t, err)
+	addresses, err := client.Lookup(ctx, transport, "example.com", dns.QueryOptions{})
+	require.ErrorIs(t, err, dns.RCodeNameError)
+	require.Empty(t, addresses)
+	require.Equal(t, int32(1), transport.queries.Load())
+}
+
+func TestClientCacheSnapshot(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := newTestTransport(300)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:           logger.NOP(),
+		IndependentCache: true,
+	})
+	_, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	cachePath := filepath.Join(t.TempDir(), "cache.db")
+	require.Error(t, client.SaveCache())
+	client = dns.NewClient(dns.ClientOptions{
+		Logger:           logger.NOP(),
+		IndependentCache: true,
+		CachePath:        cachePath,
+	})
+	client.Start()
+	_, err = client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.NoError(t, client.SaveCache())
+	client = dns.NewClient(dns.ClientOptions{
+		Logger:           logger.NOP(),
+		IndependentCache: true,
+		CachePath:        cachePath,
+	})
+	client.Start()
+	response, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), transport.queries.Load())
+	require.Len(t, response.Answer, 1)
+	require.LessOrEqual(t, response.Answer[0].Header().Ttl, uint32(300))
+	require.Greater(t, response.Answer[0].Header().Ttl, uint32(290))
+	otherTransport := newTestTransport(300)
+	otherTransport.name = "other"
+	_, err = client.Exchange(ctx, otherTransport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), otherTransport.queries.Load())
+}
+
+func TestClientRemoveCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := newTestTransport(300)
+	otherTransport := newTestTransport(300)
+	otherTransport.name = "other"
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:           logger.NOP(),
+		IndependentCache: true,
+	})
+	for _, domain := range []string{"a.corp.example", "b.corp.example", "corp.example", "example.com"} {
+		for _, qType := range []uint16{mDNS.TypeA, mDNS.TypeAAAA} {
+			_, err := client.Exchange(ctx, transport, newTestQuery(domain, qType), dns.QueryOptions{})
+			require.NoError(t, err)
+		}
+	}
+	_, err := client.Exchange(ctx, otherTransport, newTestQuery("a.corp.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	countEntries := func() int {
+		var count int
+		client.RangeCache(func(entry dns.CacheEntry) bool {
+			require.NotNil(t, entry.Response)
+			require.Greater(t, entry.TTL, 290*time.Second)
+			count++
+			return true
+		})
+		return count
+	}
+	require.Equal(t, 9, countEntries())
+	require.Equal(t, 1, client.RemoveCache(dns.CacheFilter{TransportName: "other"}))
+	require.Equal(t, 1, client.RemoveCache(dns.CacheFilter{Name: "example.com", Qtype: mDNS.TypeAAAA}))
+	require.Equal(t, 3, client.RemoveCache(dns.CacheFilter{Suffix: "corp.example", Qtype: mDNS.TypeA}))
+	require.Equal(t, 4, countEntries())
+	require.Equal(t, 3, client.RemoveCache(dns.CacheFilter{Suffix: "corp.example."}))
+	require.Equal(t, 1, countEntries())
+}
+
+func TestClientCacheStats(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := newTestTransport(1)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	for i := 0; i < 3; i++ {
+		_, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+		require.NoError(t, err)
+	}
+	_, err := client.ExchangeWithResponseCheck(ctx, transport, newTestQuery("example.org", mDNS.TypeA), dns.QueryOptions{}, func(responseAddrs []netip.Addr) bool {
+		return false
+	})
+	require.ErrorIs(t, err, dns.ErrResponseRejected)
+	time.Sleep(1100 * time.Millisecond)
+	_, err = client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	stats := client.CacheStats()
+	expected := dns.CacheCounters{
+		Hits:        2,
+		Misses:      3,
+		Expirations: 1,
+		Stores:      2,
+		Rejections:  1,
+	}
+	require.Equal(t, expected, stats.CacheCounters)
+	expected.Expirations = 0
+	require.Equal(t, expected, stats.Transports[transport.Name()])
+	require.InDelta(t, 0.4, stats.HitRatio(), 0.001)
+	client.ResetCacheStats()
+	require.Equal(t, dns.CacheCounters{}, client.CacheStats().CacheCounters)
+	require.Equal(t, 1, client.RemoveCache(dns.CacheFilter{}))
+	require.Equal(t, dns.CacheCounters{}, client.CacheStats().CacheCounters)
+}
+
+func TestClientClampTTL(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := newTestTransport(300)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:       logger.NOP(),
+		MaxTTL:       60,
+		DisableCache: true,
+	})
+	response, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), response.Answer[0].Header().Ttl)
+	response, err = client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{
+		MinTTL: 600,
+		MaxTTL: 3600,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(600), response.Answer[0].Header().Ttl)
+	lookupTransport := newTestTransport(0)
+	lookupTransport.lookup = func(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+		return []netip.Addr{lookupTransport.address}, nil
+	}
+	client = dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+		MaxTTL: 60,
+	})
+	response, err = client.Exchange(ctx, lookupTransport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), response.Answer[0].Header().Ttl)
+	client.RangeCache(func(entry dns.CacheEntry) bool {
+		require.LessOrEqual(t, entry.TTL, 60*time.Second)
+		require.Equal(t, uint32(60), entry.Response.Answer[0].Header().Ttl)
+		return true
+	})
+}
+
+func TestClientClampTTLFailure(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	transport := newTestTransport(300)
+	transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		response := new(mDNS.Msg)
+		response.SetRcode(message, mDNS.RcodeServerFailure)
+		return response, nil
+	}
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+		MinTTL: 60,
+	})
+	for i := 0; i < 2; i++ {
+		response, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+		require.NoError(t, err)
+		require.Equal(t, mDNS.RcodeServerFailure, response.Rcode)
+	}
+	require.Equal(t, int32(2), transport.queries.Load())
+}
+
+func TestClientSubnetCache(t *testing.T) {
+	t.Parallel()
+	transport := newTestTransport(300)
+	transport.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		response := dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{transport.address}, transport.ttl)
+		requestOPT := message.IsEdns0()
+		if requestOPT != nil {
+			for _, option := range requestOPT.Option {
+				subnetOption, isEDNS0Subnet := option.(*mDNS.EDNS0_SUBNET)
+				if !isEDNS0Subnet {
+					continue
+				}
+				response.SetEdns0(mDNS.DefaultMsgSize, false)
+				response.IsEdns0().Option = []mDNS.EDNS0{&mDNS.EDNS0_SUBNET{
+					Code:          mDNS.EDNS0SUBNET,
+					Family:        subnetOption.Family,
+					SourceNetmask: subnetOption.SourceNetmask,
+					SourceScope:   16,
+					Address:       subnetOption.Address,
+				}}
+			}
+		}
+		return response, nil
+	}
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	ctx := context.Background()
+	_, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{
+		ClientSubnet: netip.MustParsePrefix("10.1.1.0/24"),
+	})
+	require.NoError(t, err)
+	response, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{
+		ClientSubnet: netip.MustParsePrefix("10.1.2.0/24"),
+	})
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, int32(1), transport.queries.Load())
+	subnetOption := response.IsEdns0().Option[0].(*mDNS.EDNS0_SUBNET)
+	require.Equal(t, "10.1.2.0", subnetOption.Address.String())
+	require.Equal(t, uint8(24), subnetOption.SourceNetmask)
+	require.Equal(t, uint8(16), subnetOption.SourceScope)
+	_, err = client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{
+		ClientSubnet: netip.MustParsePrefix("10.2.1.0/24"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), transport.queries.Load())
+	_, err = client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int32(3), transport.queries.Load())
+	var subnets []netip.Prefix
+	client.RangeCache(func(entry dns.CacheEntry) bool {
+		if entry.ClientSubnet.IsValid() {
+			subnets = append(subnets, entry.ClientSubnet)
+		}
+		return true
+	})
+	require.ElementsMatch(t, []netip.Prefix{
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("10.2.0.0/16"),
+	}, subnets)
+	var snapshot bytes.Buffer
+	require.NoError(t, client.ExportCache(&snapshot))
+	importedClient := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	require.NoError(t, importedClient.ImportCache(&snapshot))
+	response, err = importedClient.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{
+		ClientSubnet: netip.MustParsePrefix("10.2.3.0/24"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(3), transport.queries.Load())
+	require.Equal(t, "10.2.3.0", response.IsEdns0().Option[0].(*mDNS.EDNS0_SUBNET).Address.String())
+	require.Equal(t, 3, client.RemoveCache(dns.CacheFilter{Name: "example.com", Qtype: mDNS.TypeA}))
+}
@@ -0,0 +1,261 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultHealthFailureThreshold = 3
+	DefaultHealthProbeInterval    = 10 * time.Second
+	DefaultHealthProbeTimeout     = 5 * time.Second
+)
+
+type HealthOptions struct {
+	Context          context.Context
+	Logger           logger.ContextLogger
+	FailureThreshold uint32
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	ProbeName        string
+	ProbeType        uint16
+}
+
+type HealthState struct {
+	Up                  bool
+	Successes           uint64
+	Failures            uint64
+	ConsecutiveFailures uint32
+	RTT                 time.Duration
+	LastError           error
+	UpdatedAt           time.Time
+}
+
+func (s HealthState) SuccessRate() float64 {
+	total := s.Successes + s.Failures
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(total)
+}
+
+type HealthTracker struct {
+	ctx              context.Context
+	cancel           context.CancelFunc
+	logger           logger.ContextLogger
+	failureThreshold uint32
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	probeName        string
+	probeType        uint16
+	access           sync.Mutex
+	transports       map[string]*healthEntry
+}
+
+type healthEntry struct {
+	transport Transport
+	state     HealthState
+	probing   bool
+}
+
+func NewHealthTracker(options HealthOptions) *HealthTracker {
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	tracker := &HealthTracker{
+		ctx:              ctx,
+		cancel:           cancel,
+		logger:           options.Logger,
+		failureThreshold: options.FailureThreshold,
+		probeInterval:    options.ProbeInterval,
+		probeTimeout:     options.ProbeTimeout,
+		probeName:        options.ProbeName,
+		probeType:        options.ProbeType,
+		transports:       make(map[string]*healthEntry),
+	}
+	if tracker.failureThreshold == 0 {
+		tracker.failureThreshold = DefaultHealthFailureThreshold
+	}
+	if tracker.probeInterval == 0 {
+		tracker.probeInterval = DefaultHealthProbeInterval
+	}
+	if tracker.probeTimeout == 0 {
+		tracker.probeTimeout = DefaultHealthProbeTimeout
+	}
+	if tracker.probeName == "" {
+		tracker.probeName = "."
+	} else {
+		tracker.probeName = dns.Fqdn(tracker.probeName)
+	}
+	if tracker.probeType == 0 {
+		tracker.probeType = dns.TypeSOA
+	}
+	return tracker
+}
+
+func (h *HealthTracker) Close() error {
+	h.cancel()
+	return nil
+}
+
+func (h *HealthTracker) Exchange(ctx context.Context, transport Transport, message *dns.Msg) (*dns.Msg, error) {
+	startAt := time.Now()
+	response, err := transport.Exchange(ctx, message)
+	if err == nil {
+		h.Report(transport, time.Since(startAt), responseFailure(response))
+	} else if !errors.Is(ctx.Err(), context.Canceled) {
+		h.Report(transport, time.Since(startAt), err)
+	}
+	return response, err
+}
+
+func (h *HealthTracker) Lookup(ctx context.Context, transport Transport, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	startAt := time.Now()
+	addresses, err := transport.Lookup(ctx, domain, strategy)
+	if err == nil || wrapError(err) == RCodeNameError {
+		h.Report(transport, time.Since(startAt), nil)
+	} else if !errors.Is(ctx.Err(), context.Canceled) {
+		h.Report(transport, time.Since(startAt), err)
+	}
+	return addresses, err
+}
+
+func (h *HealthTracker) Report(transport Transport, rtt time.Duration, err error) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	entry, loaded := h.transports[transport.Name()]
+	if !loaded {
+		entry = &healthEntry{
+			transport: transport,
+			state:     HealthState{Up: true},
+		}
+		h.transports[transport.Name()] = entry
+	}
+	state := &entry.state
+	state.UpdatedAt = time.Now()
+	if err == nil {
+		state.Successes++
+		state.ConsecutiveFailures = 0
+		state.LastError = nil
+		if state.RTT == 0 {
+			state.RTT = rtt
+		} else {
+			state.RTT = (state.RTT*7 + rtt) / 8
+		}
+		if !state.Up {
+			state.Up = true
+			if h.logger != nil {
+				h.logger.InfoContext(h.ctx, "transport[", transport.Name(), "] is up")
+			}
+		}
+		return
+	}
+	state.Failures++
+	state.ConsecutiveFailures++
+	state.LastError = err
+	if state.Up && state.ConsecutiveFailures >= h.failureThreshold {
+		state.Up = false
+		if h.logger != nil {
+			h.logger.WarnContext(h.ctx, "transport[", transport.Name(), "] is down: ", err)
+		}
+		if !entry.probing && h.ctx.Err() == nil {
+			entry.probing = true
+			go h.probe(entry)
+		}
+	}
+}
+
+func (h *HealthTracker) probe(entry *healthEntry) {
+	ticker := time.NewTicker(h.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			h.access.Lock()
+			entry.probing = false
+			h.access.Unlock()
+			return
+		case <-ticker.C:
+		}
+		h.access.Lock()
+		if entry.state.Up {
+			entry.probing = false
+			h.access.Unlock()
+			return
+		}
+		h.access.Unlock()
+		message := new(dns.Msg)
+		message.SetQuestion(h.probeName, h.probeType)
+		ctx, cancel := context.WithTimeout(h.ctx, h.probeTimeout)
+		startAt := time.Now()
+		var (
+			response *dns.Msg
+			err      error
+		)
+		if entry.transport.Raw() {
+			response, err = entry.transport.Exchange(ctx, message)
+			if err == nil {
+				err = responseFailure(response)
+			}
+		} else {
+			_, err = entry.transport.Lookup(ctx, fqdnToDomain(h.probeName), DomainStrategyAsIS)
+			if wrapError(err) == RCodeNameError {
+				err = nil
+			}
+		}
+		cancel()
+		if h.ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			err = E.Cause(err, "probe")
+		}
+		h.Report(entry.transport, time.Since(startAt), err)
+	}
+}
+
+func (h *HealthTracker) Available(transportName string) bool {
+	h.access.Lock()
+	defer h.access.Unlock()
+	entry, loaded := h.transports[transportName]
+	return !loaded || entry.state.Up
+}
+
+func (h *HealthTracker) State(transportName string) (HealthState, bool) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	entry, loaded := h.transports[transportName]
+	if !loaded {
+		return HealthState{}, false
+	}
+	return entry.state, true
+}
+
+func (h *HealthTracker) States() map[string]HealthState {
+	h.access.Lock()
+	defer h.access.Unlock()
+	states := make(map[string]HealthState, len(h.transports))
+	for transportName, entry := range h.transports {
+		states[transportName] = entry.state
+	}
+	return states
+}
+
+func responseFailure(response *dns.Msg) error {
+	switch response.Rcode {
+	case dns.RcodeServerFailure, dns.RcodeRefused:
+		return RCodeError(response.Rcode)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,120 @@
+package dns_test
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthTracker(t *testing.T) {
+	t.Parallel()
+	health := dns.NewHealthTracker(dns.HealthOptions{
+		Logger:           logger.NOP(),
+		FailureThreshold: 2,
+		ProbeInterval:    50 * time.Millisecond,
+	})
+	defer health.Close()
+	transport := newTestTransport(60)
+	ctx := context.Background()
+	_, err := health.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	state, loaded := health.State(transport.Name())
+	require.True(t, loaded)
+	require.True(t, state.Up)
+	require.Equal(t, uint64(1), state.Successes)
+	require.Greater(t, state.RTT, time.Duration(0))
+
+	transport.setError(os.ErrDeadlineExceeded)
+	for i := 0; i < 2; i++ {
+		_, err = health.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA))
+		require.Error(t, err)
+	}
+	require.False(t, health.Available(transport.Name()))
+	state = health.States()[transport.Name()]
+	require.Equal(t, uint32(2), state.ConsecutiveFailures)
+	require.ErrorIs(t, state.LastError, os.ErrDeadlineExceeded)
+	require.InDelta(t, 1.0/3, state.SuccessRate(), 0.01)
+
+	transport.setError(nil)
+	require.Eventually(t, func() bool {
+		return health.Available(transport.Name())
+	}, 5*time.Second, 10*time.Millisecond)
+	state, _ = health.State(transport.Name())
+	require.Zero(t, state.ConsecutiveFailures)
+}
+
+func TestHealthTrackerClient(t *testing.T) {
+	t.Parallel()
+	health := dns.NewHealthTracker(dns.HealthOptions{
+		Logger:           logger.NOP(),
+		FailureThreshold: 1,
+		ProbeInterval:    time.Hour,
+	})
+	defer health.Close()
+	transport := newTestTransport(1)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger:     logger.NOP(),
+		ServeStale: true,
+		Health:     health,
+	})
+	ctx := context.Background()
+	_, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	transport.setError(os.ErrDeadlineExceeded)
+	_, err = client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return !health.Available(transport.Name())
+	}, 5*time.Second, 10*time.Millisecond)
+	queries := transport.queries.Load()
+	response, err := client.Exchange(ctx, transport, newTestQuery("example.com", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(dns.StaleAnswerTTL), response.Answer[0].Header().Ttl)
+	require.Equal(t, queries, transport.queries.Load())
+}
+
+func TestHealthTrackerGroup(t *testing.T) {
+	t.Parallel()
+	health := dns.NewHealthTracker(dns.HealthOptions{
+		Logger:           logger.NOP(),
+		FailureThreshold: 1,
+		ProbeInterval:    time.Hour,
+	})
+	defer health.Close()
+	query := url.Values{}
+	query.Add("upstream", url.Values{"server": {"rcode://server_failure"}, "name": {"broken"}}.Encode())
+	query.Add("upstream", staticUpstream("10.0.0.1").Encode())
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Name:    "group",
+		Address: "group://?" + query.Encode(),
+		Health:  health,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.NoError(t, transport.Start())
+	for i := 0; i < 3; i++ {
+		response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1", response.Answer[0].(*mDNS.A).A.String())
+	}
+	require.False(t, health.Available("broken"))
+	state, loaded := health.State("broken")
+	require.True(t, loaded)
+	require.Equal(t, uint64(1), state.Failures)
+	state, loaded = health.State("group/upstream[1]")
+	require.True(t, loaded)
+	require.Equal(t, uint64(3), state.Successes)
+}
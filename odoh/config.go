@@ -0,0 +1,130 @@
+package odoh
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const ConfigVersion = 0x0001
+
+type Config struct {
+	KEMID     uint16
+	KDFID     uint16
+	AEADID    uint16
+	PublicKey []byte
+}
+
+func ParseConfigs(rawConfigs []byte) ([]Config, error) {
+	if len(rawConfigs) < 2 {
+		return nil, E.New("invalid ODoH configs")
+	}
+	configsLen := int(binary.BigEndian.Uint16(rawConfigs))
+	rawConfigs = rawConfigs[2:]
+	if configsLen != len(rawConfigs) {
+		return nil, E.New("invalid ODoH configs length")
+	}
+	var configs []Config
+	for len(rawConfigs) > 0 {
+		if len(rawConfigs) < 4 {
+			return nil, E.New("invalid ODoH config")
+		}
+		version := binary.BigEndian.Uint16(rawConfigs)
+		contentsLen := int(binary.BigEndian.Uint16(rawConfigs[2:]))
+		rawConfigs = rawConfigs[4:]
+		if contentsLen > len(rawConfigs) {
+			return nil, E.New("invalid ODoH config length")
+		}
+		contents := rawConfigs[:contentsLen]
+		rawConfigs = rawConfigs[contentsLen:]
+		if version != ConfigVersion {
+			continue
+		}
+		config, err := parseConfigContents(contents)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func parseConfigContents(contents []byte) (Config, error) {
+	if len(contents) < 8 {
+		return Config{}, E.New("invalid ODoH config contents")
+	}
+	config := Config{
+		KEMID:  binary.BigEndian.Uint16(contents),
+		KDFID:  binary.BigEndian.Uint16(contents[2:]),
+		AEADID: binary.BigEndian.Uint16(contents[4:]),
+	}
+	publicKeyLen := int(binary.BigEndian.Uint16(contents[6:]))
+	if publicKeyLen == 0 || publicKeyLen != len(contents)-8 {
+		return Config{}, E.New("invalid ODoH public key length")
+	}
+	config.PublicKey = append([]byte(nil), contents[8:]...)
+	return config, nil
+}
+
+func MarshalConfigs(configs ...Config) []byte {
+	var rawConfigs []byte
+	for _, config := range configs {
+		contents := config.contents()
+		rawConfigs = binary.BigEndian.AppendUint16(rawConfigs, ConfigVersion)
+		rawConfigs = binary.BigEndian.AppendUint16(rawConfigs, uint16(len(contents)))
+		rawConfigs = append(rawConfigs, contents...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(rawConfigs))), rawConfigs...)
+}
+
+func (c Config) contents() []byte {
+	contents := binary.BigEndian.AppendUint16(nil, c.KEMID)
+	contents = binary.BigEndian.AppendUint16(contents, c.KDFID)
+	contents = binary.BigEndian.AppendUint16(contents, c.AEADID)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(c.PublicKey)))
+	return append(contents, c.PublicKey...)
+}
+
+func (c Config) KeyID() []byte {
+	prk := hkdf.Extract(sha256.New, c.contents(), nil)
+	keyID := make([]byte, sha256.Size)
+	_, err := hkdf.Expand(sha256.New, prk, []byte("odoh key id")).Read(keyID)
+	if err != nil {
+		panic(err)
+	}
+	return keyID
+}
+
+func (c Config) suite() (*hpkeSuite, error) {
+	return newHPKESuite(c.KEMID, c.KDFID, c.AEADID)
+}
+
+type KeyPair struct {
+	Config     Config
+	PrivateKey *ecdh.PrivateKey
+}
+
+func GenerateKeyPair(kemID uint16, kdfID uint16, aeadID uint16) (*KeyPair, error) {
+	suite, err := newHPKESuite(kemID, kdfID, aeadID)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := suite.curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{
+		Config: Config{
+			KEMID:     kemID,
+			KDFID:     kdfID,
+			AEADID:    aeadID,
+			PublicKey: privateKey.PublicKey().Bytes(),
+		},
+		PrivateKey: privateKey,
+	}, nil
+}
@@ -0,0 +1,199 @@
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	KEMP256HKDFSHA256   uint16 = 0x0010
+	KEMX25519HKDFSHA256 uint16 = 0x0020
+	KDFHKDFSHA256       uint16 = 0x0001
+	AEADAES128GCM       uint16 = 0x0001
+	AEADAES256GCM       uint16 = 0x0002
+	AEADChaCha20Poly    uint16 = 0x0003
+)
+
+const hpkeModeBase = 0x00
+
+type hpkeSuite struct {
+	kemID  uint16
+	kdfID  uint16
+	aeadID uint16
+	curve  ecdh.Curve
+	keyLen int
+}
+
+func newHPKESuite(kemID uint16, kdfID uint16, aeadID uint16) (*hpkeSuite, error) {
+	suite := &hpkeSuite{
+		kemID:  kemID,
+		kdfID:  kdfID,
+		aeadID: aeadID,
+	}
+	switch kemID {
+	case KEMX25519HKDFSHA256:
+		suite.curve = ecdh.X25519()
+	case KEMP256HKDFSHA256:
+		suite.curve = ecdh.P256()
+	default:
+		return nil, E.New("unsupported HPKE KEM: ", kemID)
+	}
+	if kdfID != KDFHKDFSHA256 {
+		return nil, E.New("unsupported HPKE KDF: ", kdfID)
+	}
+	switch aeadID {
+	case AEADAES128GCM:
+		suite.keyLen = 16
+	case AEADAES256GCM, AEADChaCha20Poly:
+		suite.keyLen = 32
+	default:
+		return nil, E.New("unsupported HPKE AEAD: ", aeadID)
+	}
+	return suite, nil
+}
+
+func (s *hpkeSuite) kemSuiteID() []byte {
+	return binary.BigEndian.AppendUint16([]byte("KEM"), s.kemID)
+}
+
+func (s *hpkeSuite) suiteID() []byte {
+	suiteID := []byte("HPKE")
+	suiteID = binary.BigEndian.AppendUint16(suiteID, s.kemID)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, s.kdfID)
+	return binary.BigEndian.AppendUint16(suiteID, s.aeadID)
+}
+
+func (s *hpkeSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s.aeadID {
+	case AEADChaCha20Poly:
+		return chacha20poly1305.New(key)
+	default:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+}
+
+func labeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+func labeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	output := make([]byte, length)
+	_, err := hkdf.Expand(sha256.New, prk, labeledInfo).Read(output)
+	if err != nil {
+		panic(err)
+	}
+	return output
+}
+
+func (s *hpkeSuite) extractAndExpand(dh []byte, kemContext []byte) []byte {
+	suiteID := s.kemSuiteID()
+	prk := labeledExtract(suiteID, nil, "eae_prk", dh)
+	return labeledExpand(suiteID, prk, "shared_secret", kemContext, sha256.Size)
+}
+
+func (s *hpkeSuite) encap(publicKey *ecdh.PublicKey) (sharedSecret []byte, enc []byte, err error) {
+	ephemeralKey, err := s.curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	dh, err := ephemeralKey.ECDH(publicKey)
+	if err != nil {
+		return
+	}
+	enc = ephemeralKey.PublicKey().Bytes()
+	kemContext := append(append([]byte(nil), enc...), publicKey.Bytes()...)
+	sharedSecret = s.extractAndExpand(dh, kemContext)
+	return
+}
+
+func (s *hpkeSuite) decap(enc []byte, privateKey *ecdh.PrivateKey) ([]byte, error) {
+	ephemeralKey, err := s.curve.NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := privateKey.ECDH(ephemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append([]byte(nil), enc...), privateKey.PublicKey().Bytes()...)
+	return s.extractAndExpand(dh, kemContext), nil
+}
+
+type hpkeContext struct {
+	suiteID        []byte
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+func (s *hpkeSuite) keySchedule(sharedSecret []byte, info []byte) (*hpkeContext, error) {
+	suiteID := s.suiteID()
+	pskIDHash := labeledExtract(suiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(suiteID, nil, "info_hash", info)
+	keyScheduleContext := append([]byte{hpkeModeBase}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+	secret := labeledExtract(suiteID, sharedSecret, "secret", nil)
+	aead, err := s.newAEAD(labeledExpand(suiteID, secret, "key", keyScheduleContext, s.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		suiteID:        suiteID,
+		aead:           aead,
+		baseNonce:      labeledExpand(suiteID, secret, "base_nonce", keyScheduleContext, aead.NonceSize()),
+		exporterSecret: labeledExpand(suiteID, secret, "exp", keyScheduleContext, sha256.Size),
+	}, nil
+}
+
+func (s *hpkeSuite) setupBaseSender(publicKey *ecdh.PublicKey, info []byte) (*hpkeContext, []byte, error) {
+	sharedSecret, enc, err := s.encap(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	context, err := s.keySchedule(sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return context, enc, nil
+}
+
+func (s *hpkeSuite) setupBaseReceiver(enc []byte, privateKey *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	sharedSecret, err := s.decap(enc, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return s.keySchedule(sharedSecret, info)
+}
+
+func (c *hpkeContext) seal(aad []byte, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.baseNonce, plaintext, aad)
+}
+
+func (c *hpkeContext) open(aad []byte, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.baseNonce, ciphertext, aad)
+}
+
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return labeledExpand(c.suiteID, c.exporterSecret, "sec", exporterContext, length)
+}
@@ -0,0 +1,214 @@
+package odoh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	messageTypeQuery    = 0x01
+	messageTypeResponse = 0x02
+	paddingBlockSize    = 128
+)
+
+type queryContext struct {
+	suite          *hpkeSuite
+	context        *hpkeContext
+	queryPlaintext []byte
+}
+
+func encryptQuery(config Config, rawQuery []byte) ([]byte, *queryContext, error) {
+	suite, err := config.suite()
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := suite.curve.NewPublicKey(config.PublicKey)
+	if err != nil {
+		return nil, nil, E.Cause(err, "parse ODoH public key")
+	}
+	context, enc, err := suite.setupBaseSender(publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := config.KeyID()
+	queryPlaintext := marshalPlaintext(rawQuery)
+	encryptedMessage := append(enc, context.seal(messageAAD(messageTypeQuery, keyID), queryPlaintext)...)
+	return marshalMessage(messageTypeQuery, keyID, encryptedMessage), &queryContext{
+		suite:          suite,
+		context:        context,
+		queryPlaintext: queryPlaintext,
+	}, nil
+}
+
+func (k *KeyPair) decryptQuery(rawMessage []byte) ([]byte, *queryContext, error) {
+	messageType, keyID, encryptedMessage, err := parseMessage(rawMessage)
+	if err != nil {
+		return nil, nil, err
+	}
+	if messageType != messageTypeQuery {
+		return nil, nil, E.New("unexpected ODoH message type: ", messageType)
+	}
+	if !bytes.Equal(keyID, k.Config.KeyID()) {
+		return nil, nil, E.New("unknown ODoH key id")
+	}
+	suite, err := k.Config.suite()
+	if err != nil {
+		return nil, nil, err
+	}
+	encLen := len(k.Config.PublicKey)
+	if len(encryptedMessage) < encLen {
+		return nil, nil, E.New("invalid ODoH encrypted query")
+	}
+	context, err := suite.setupBaseReceiver(encryptedMessage[:encLen], k.PrivateKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := context.open(messageAAD(messageTypeQuery, keyID), encryptedMessage[encLen:])
+	if err != nil {
+		return nil, nil, E.Cause(err, "decrypt ODoH query")
+	}
+	rawQuery, err := parsePlaintext(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawQuery, &queryContext{
+		suite:          suite,
+		context:        context,
+		queryPlaintext: plaintext,
+	}, nil
+}
+
+func (c *queryContext) responseAEAD(responseNonce []byte) (aeadKey []byte, aeadNonce []byte, err error) {
+	secret := c.context.export([]byte("odoh response"), c.suite.keyLen)
+	return deriveResponseSecrets(secret, c.queryPlaintext, responseNonce, c.suite.keyLen, c.context.aead.NonceSize())
+}
+
+func deriveResponseSecrets(secret []byte, queryPlaintext []byte, responseNonce []byte, keyLen int, nonceLen int) (aeadKey []byte, aeadNonce []byte, err error) {
+	salt := append([]byte(nil), queryPlaintext...)
+	salt = binary.BigEndian.AppendUint16(salt, uint16(len(responseNonce)))
+	salt = append(salt, responseNonce...)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	aeadKey = make([]byte, keyLen)
+	_, err = hkdf.Expand(sha256.New, prk, []byte("odoh key")).Read(aeadKey)
+	if err != nil {
+		return
+	}
+	aeadNonce = make([]byte, nonceLen)
+	_, err = hkdf.Expand(sha256.New, prk, []byte("odoh nonce")).Read(aeadNonce)
+	return
+}
+
+func (c *queryContext) encryptResponse(rawResponse []byte) ([]byte, error) {
+	responseNonce := make([]byte, c.suite.keyLen)
+	_, err := rand.Read(responseNonce)
+	if err != nil {
+		return nil, err
+	}
+	aeadKey, aeadNonce, err := c.responseAEAD(responseNonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.suite.newAEAD(aeadKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptedMessage := aead.Seal(nil, aeadNonce, marshalPlaintext(rawResponse), messageAAD(messageTypeResponse, responseNonce))
+	return marshalMessage(messageTypeResponse, responseNonce, encryptedMessage), nil
+}
+
+func (c *queryContext) decryptResponse(rawMessage []byte) ([]byte, error) {
+	messageType, responseNonce, encryptedMessage, err := parseMessage(rawMessage)
+	if err != nil {
+		return nil, err
+	}
+	if messageType != messageTypeResponse {
+		return nil, E.New("unexpected ODoH message type: ", messageType)
+	}
+	aeadKey, aeadNonce, err := c.responseAEAD(responseNonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.suite.newAEAD(aeadKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, aeadNonce, encryptedMessage, messageAAD(messageTypeResponse, responseNonce))
+	if err != nil {
+		return nil, E.Cause(err, "decrypt ODoH response")
+	}
+	return parsePlaintext(plaintext)
+}
+
+func messageAAD(messageType uint8, keyID []byte) []byte {
+	aad := binary.BigEndian.AppendUint16([]byte{messageType}, uint16(len(keyID)))
+	return append(aad, keyID...)
+}
+
+func marshalMessage(messageType uint8, keyID []byte, encryptedMessage []byte) []byte {
+	message := messageAAD(messageType, keyID)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(encryptedMessage)))
+	return append(message, encryptedMessage...)
+}
+
+func parseMessage(rawMessage []byte) (messageType uint8, keyID []byte, encryptedMessage []byte, err error) {
+	if len(rawMessage) < 3 {
+		err = E.New("invalid ODoH message")
+		return
+	}
+	messageType = rawMessage[0]
+	keyIDLen := int(binary.BigEndian.Uint16(rawMessage[1:]))
+	rawMessage = rawMessage[3:]
+	if len(rawMessage) < keyIDLen+2 {
+		err = E.New("invalid ODoH message key id")
+		return
+	}
+	keyID = rawMessage[:keyIDLen]
+	rawMessage = rawMessage[keyIDLen:]
+	encryptedMessageLen := int(binary.BigEndian.Uint16(rawMessage))
+	rawMessage = rawMessage[2:]
+	if encryptedMessageLen == 0 || encryptedMessageLen != len(rawMessage) {
+		err = E.New("invalid ODoH encrypted message length")
+		return
+	}
+	encryptedMessage = rawMessage
+	return
+}
+
+func marshalPlaintext(rawMessage []byte) []byte {
+	paddingLen := paddingBlockSize - (len(rawMessage)+4)%paddingBlockSize
+	if paddingLen == paddingBlockSize {
+		paddingLen = 0
+	}
+	plaintext := binary.BigEndian.AppendUint16(nil, uint16(len(rawMessage)))
+	plaintext = append(plaintext, rawMessage...)
+	plaintext = binary.BigEndian.AppendUint16(plaintext, uint16(paddingLen))
+	return append(plaintext, make([]byte, paddingLen)...)
+}
+
+func parsePlaintext(plaintext []byte) ([]byte, error) {
+	if len(plaintext) < 2 {
+		return nil, E.New("invalid ODoH plaintext")
+	}
+	messageLen := int(binary.BigEndian.Uint16(plaintext))
+	plaintext = plaintext[2:]
+	if messageLen == 0 || len(plaintext) < messageLen+2 {
+		return nil, E.New("invalid ODoH plaintext length")
+	}
+	rawMessage := plaintext[:messageLen]
+	padding := plaintext[messageLen+2:]
+	if int(binary.BigEndian.Uint16(plaintext[messageLen:])) != len(padding) {
+		return nil, E.New("invalid ODoH padding length")
+	}
+	for _, b := range padding {
+		if b != 0 {
+			return nil, E.New("invalid ODoH padding")
+		}
+	}
+	return rawMessage, nil
+}
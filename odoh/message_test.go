@@ -0,0 +1,19 @@
+package odoh
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeriveResponseSecrets(t *testing.T) {
+	t.Parallel()
+	secret, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	queryPlaintext, _ := hex.DecodeString("0004deadbeef0000")
+	responseNonce, _ := hex.DecodeString("101112131415161718191a1b1c1d1e1f")
+	aeadKey, aeadNonce, err := deriveResponseSecrets(secret, queryPlaintext, responseNonce, 16, 12)
+	require.NoError(t, err)
+	require.Equal(t, "327032f09c06dcc16e1b18dbb4e8ec62", hex.EncodeToString(aeadKey))
+	require.Equal(t, "6bb488cae06130c6d044e601", hex.EncodeToString(aeadNonce))
+}
@@ -0,0 +1,102 @@
+package odoh
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/sagernet/sing-dns/server"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+
+	mDNS "github.com/miekg/dns"
+)
+
+var _ http.Handler = (*TargetHandler)(nil)
+
+type TargetHandler struct {
+	logger  logger.ContextLogger
+	keyPair *KeyPair
+	handler server.Handler
+}
+
+func NewTargetHandler(logger logger.ContextLogger, keyPair *KeyPair, handler server.Handler) *TargetHandler {
+	return &TargetHandler{
+		logger:  logger,
+		keyPair: keyPair,
+		handler: handler,
+	}
+}
+
+func (h *TargetHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == ConfigsPath {
+		if request.Method != http.MethodGet {
+			http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rawConfigs := MarshalConfigs(h.keyPair.Config)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(rawConfigs)))
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(rawConfigs)
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", "POST")
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if request.Header.Get("Content-Type") != MimeType {
+		http.Error(writer, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	rawRequest, err := io.ReadAll(io.LimitReader(request.Body, mDNS.MaxMsgSize*2))
+	if err != nil {
+		http.Error(writer, "read request failed", http.StatusBadRequest)
+		return
+	}
+	rawQuery, queryContext, err := h.keyPair.decryptQuery(rawRequest)
+	if err != nil {
+		if h.logger != nil {
+			h.logger.DebugContext(request.Context(), E.Cause(err, "decrypt query"))
+		}
+		http.Error(writer, "decrypt query failed", http.StatusUnauthorized)
+		return
+	}
+	var message mDNS.Msg
+	err = message.Unpack(rawQuery)
+	if err != nil || message.Response {
+		http.Error(writer, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	ctx := request.Context()
+	source := M.ParseSocksaddr(request.RemoteAddr)
+	response, err := h.handler.ServeDNS(ctx, source, &message)
+	if err != nil {
+		if h.logger != nil {
+			h.logger.DebugContext(ctx, E.Cause(err, "exchange for ", source))
+		}
+		response = server.ErrorResponse(&message, err)
+	} else if response == nil {
+		http.Error(writer, "no response", http.StatusBadGateway)
+		return
+	}
+	response.Id = message.Id
+	response.Compress = true
+	rawResponse, err := response.Pack()
+	if err != nil {
+		http.Error(writer, "pack response failed", http.StatusInternalServerError)
+		return
+	}
+	rawMessage, err := queryContext.encryptResponse(rawResponse)
+	if err != nil {
+		http.Error(writer, "encrypt response failed", http.StatusInternalServerError)
+		return
+	}
+	header := writer.Header()
+	header.Set("Content-Type", MimeType)
+	header.Set("Content-Length", strconv.Itoa(len(rawMessage)))
+	header.Set("Cache-Control", "no-cache, no-store")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(rawMessage)
+}
@@ -0,0 +1,274 @@
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sagernet/sing-dns"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+
+	mDNS "github.com/miekg/dns"
+)
+
+const (
+	MimeType    = "application/oblivious-dns-message"
+	ConfigsPath = "/.well-known/odohconfigs"
+)
+
+var _ dns.Transport = (*Transport)(nil)
+
+func init() {
+	dns.RegisterTransport([]string{"odoh"}, func(options dns.TransportOptions) (dns.Transport, error) {
+		return NewTransport(options)
+	})
+}
+
+type Transport struct {
+	name          string
+	targetURL     *url.URL
+	proxyURL      *url.URL
+	configsURL    *url.URL
+	staticConfigs []Config
+	transport     *http.Transport
+	access        sync.Mutex
+	config        *Config
+}
+
+func NewTransport(options dns.TransportOptions) (*Transport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	if serverURL.Host == "" {
+		return nil, E.New("missing target host")
+	}
+	query := serverURL.Query()
+	var proxyURL *url.URL
+	if rawProxyURL := query.Get("proxy"); rawProxyURL != "" {
+		proxyURL, err = url.Parse(rawProxyURL)
+		if err != nil {
+			return nil, E.Cause(err, "parse proxy url")
+		}
+		if proxyURL.Scheme != "https" && proxyURL.Scheme != "http" {
+			return nil, E.New("unsupported proxy url scheme: ", proxyURL.Scheme)
+		}
+		query.Del("proxy")
+	}
+	var configsURL *url.URL
+	if rawConfigsURL := query.Get("configs_url"); rawConfigsURL != "" {
+		configsURL, err = url.Parse(rawConfigsURL)
+		if err != nil {
+			return nil, E.Cause(err, "parse configs url")
+		}
+		if configsURL.Scheme != "https" && configsURL.Scheme != "http" {
+			return nil, E.New("unsupported configs url scheme: ", configsURL.Scheme)
+		}
+		query.Del("configs_url")
+	}
+	var staticConfigs []Config
+	if rawConfigs := query.Get("configs"); rawConfigs != "" {
+		configsContent, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(rawConfigs, "="))
+		if err != nil {
+			return nil, E.Cause(err, "decode configs")
+		}
+		staticConfigs, err = ParseConfigs(configsContent)
+		if err != nil {
+			return nil, E.Cause(err, "parse configs")
+		}
+		query.Del("configs")
+	}
+	targetURL := *serverURL
+	targetURL.Scheme = "https"
+	targetURL.RawQuery = query.Encode()
+	if targetURL.Path == "" {
+		targetURL.Path = "/dns-query"
+	}
+	if configsURL == nil {
+		configsURL = &url.URL{
+			Scheme: "https",
+			Host:   targetURL.Host,
+			Path:   ConfigsPath,
+		}
+	}
+	return &Transport{
+		name:          options.Name,
+		targetURL:     &targetURL,
+		proxyURL:      proxyURL,
+		configsURL:    configsURL,
+		staticConfigs: staticConfigs,
+		transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   options.TLSConfig,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return options.Dialer.DialContext(ctx, network, M.ParseSocksaddr(addr))
+			},
+		},
+	}, nil
+}
+
+func (t *Transport) Name() string {
+	return t.name
+}
+
+func (t *Transport) Start() error {
+	return nil
+}
+
+func (t *Transport) Reset() {
+	t.access.Lock()
+	t.config = nil
+	t.access.Unlock()
+	t.transport.CloseIdleConnections()
+	t.transport = t.transport.Clone()
+}
+
+func (t *Transport) Close() error {
+	t.Reset()
+	return nil
+}
+
+func (t *Transport) Raw() bool {
+	return true
+}
+
+func (t *Transport) Exchange(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+	exMessage := *message
+	exMessage.Id = 0
+	exMessage.Compress = true
+	rawQuery, err := exMessage.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var response *mDNS.Msg
+	for i := 0; i < 2; i++ {
+		var config Config
+		config, err = t.loadConfig(ctx)
+		if err != nil {
+			return nil, E.Cause(err, "fetch ODoH config")
+		}
+		response, err = t.exchange(ctx, config, rawQuery)
+		if err == nil {
+			response.Id = message.Id
+			return response, nil
+		} else if err != errKeyMismatch {
+			return nil, err
+		}
+		t.access.Lock()
+		t.config = nil
+		t.access.Unlock()
+	}
+	return nil, err
+}
+
+var errKeyMismatch = E.New("ODoH key mismatch")
+
+func (t *Transport) exchange(ctx context.Context, config Config, rawQuery []byte) (*mDNS.Msg, error) {
+	rawRequest, queryContext, err := encryptQuery(config, rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.requestURL(t.targetURL).String(), bytes.NewReader(rawRequest))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", MimeType)
+	request.Header.Set("Accept", MimeType)
+	request.Header.Set("Cache-Control", "no-cache, no-store")
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		return nil, errKeyMismatch
+	} else if response.StatusCode != http.StatusOK {
+		return nil, E.New("unexpected status: ", response.Status)
+	}
+	rawResponse, err := io.ReadAll(io.LimitReader(response.Body, mDNS.MaxMsgSize*2))
+	if err != nil {
+		return nil, err
+	}
+	rawMessage, err := queryContext.decryptResponse(rawResponse)
+	if err != nil {
+		return nil, err
+	}
+	var responseMessage mDNS.Msg
+	err = responseMessage.Unpack(rawMessage)
+	if err != nil {
+		return nil, err
+	}
+	return &responseMessage, nil
+}
+
+func (t *Transport) requestURL(targetURL *url.URL) *url.URL {
+	if t.proxyURL == nil {
+		return targetURL
+	}
+	proxyURL := *t.proxyURL
+	query := proxyURL.Query()
+	query.Set("targethost", targetURL.Host)
+	query.Set("targetpath", targetURL.RequestURI())
+	proxyURL.RawQuery = query.Encode()
+	return &proxyURL
+}
+
+func (t *Transport) loadConfig(ctx context.Context) (Config, error) {
+	t.access.Lock()
+	config := t.config
+	t.access.Unlock()
+	if config != nil {
+		return *config, nil
+	}
+	configs := t.staticConfigs
+	if len(configs) == 0 {
+		var err error
+		configs, err = t.fetchConfigs(ctx)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	for _, config := range configs {
+		_, err := config.suite()
+		if err == nil {
+			t.access.Lock()
+			t.config = &config
+			t.access.Unlock()
+			return config, nil
+		}
+	}
+	return Config{}, E.New("no supported ODoH config")
+}
+
+func (t *Transport) fetchConfigs(ctx context.Context) ([]Config, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, t.configsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, E.New("unexpected status: ", response.Status)
+	}
+	rawConfigs, err := io.ReadAll(io.LimitReader(response.Body, 0xffff+2))
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfigs(rawConfigs)
+}
+
+func (t *Transport) Lookup(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
@@ -0,0 +1,169 @@
+package odoh_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/odoh"
+	"github.com/sagernet/sing-dns/server"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+	for _, suite := range []struct {
+		name   string
+		kemID  uint16
+		aeadID uint16
+	}{
+		{"x25519-aes128gcm", odoh.KEMX25519HKDFSHA256, odoh.AEADAES128GCM},
+		{"p256-chacha20poly1305", odoh.KEMP256HKDFSHA256, odoh.AEADChaCha20Poly},
+	} {
+		suite := suite
+		t.Run(suite.name, func(t *testing.T) {
+			t.Parallel()
+			keyPair, err := odoh.GenerateKeyPair(suite.kemID, odoh.KDFHKDFSHA256, suite.aeadID)
+			require.NoError(t, err)
+			var targetSources []string
+			target := httptest.NewTLSServer(odoh.NewTargetHandler(logger.NOP(), keyPair, server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+				targetSources = append(targetSources, source.String())
+				return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 300), nil
+			})))
+			defer target.Close()
+			var configRequests atomic.Int32
+			configs := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				configRequests.Add(1)
+				writer.Write(odoh.MarshalConfigs(keyPair.Config))
+			}))
+			defer configs.Close()
+			certPool := x509.NewCertPool()
+			certPool.AddCert(target.Certificate())
+			certPool.AddCert(configs.Certificate())
+			var proxyQueries atomic.Int32
+			proxy := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				if request.Method != http.MethodPost || request.Header.Get("Content-Type") != odoh.MimeType {
+					writer.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				proxyQueries.Add(1)
+				targetURL := url.URL{
+					Scheme: "https",
+					Host:   request.URL.Query().Get("targethost"),
+					Path:   request.URL.Query().Get("targetpath"),
+				}
+				body, err := io.ReadAll(request.Body)
+				require.NoError(t, err)
+				targetRequest, err := http.NewRequest(request.Method, targetURL.String(), bytes.NewReader(body))
+				require.NoError(t, err)
+				targetRequest.Header.Set("Content-Type", request.Header.Get("Content-Type"))
+				targetResponse, err := target.Client().Do(targetRequest)
+				require.NoError(t, err)
+				defer targetResponse.Body.Close()
+				writer.Header().Set("Content-Type", targetResponse.Header.Get("Content-Type"))
+				writer.WriteHeader(targetResponse.StatusCode)
+				io.Copy(writer, targetResponse.Body)
+			}))
+			defer proxy.Close()
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Dialer:  &blockingDialer{N.SystemDialer, target.Listener.Addr().String()},
+				Address: "odoh://" + target.Listener.Addr().String() + "/dns-query?" + url.Values{
+					"proxy":       {proxy.URL + "/proxy"},
+					"configs_url": {configs.URL + "/configs"},
+				}.Encode(),
+				TLSConfig: &tls.Config{RootCAs: certPool},
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			for i := 0; i < 2; i++ {
+				request := new(mDNS.Msg)
+				request.SetQuestion("example.com.", mDNS.TypeA)
+				response, err := transport.Exchange(context.Background(), request)
+				require.NoError(t, err)
+				require.Equal(t, request.Id, response.Id)
+				require.Len(t, response.Answer, 1)
+				require.Equal(t, "1.1.1.1", response.Answer[0].(*mDNS.A).A.String())
+			}
+			require.Equal(t, int32(2), proxyQueries.Load())
+			require.Equal(t, int32(1), configRequests.Load())
+			require.Len(t, targetSources, 2)
+		})
+	}
+}
+
+type blockingDialer struct {
+	N.Dialer
+	blocked string
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if destination.String() == d.blocked {
+		return nil, E.New("direct connection to ", destination)
+	}
+	return d.Dialer.DialContext(ctx, network, destination)
+}
+
+func TestTransportStaticConfigs(t *testing.T) {
+	t.Parallel()
+	keyPair, err := odoh.GenerateKeyPair(odoh.KEMX25519HKDFSHA256, odoh.KDFHKDFSHA256, odoh.AEADAES128GCM)
+	require.NoError(t, err)
+	var configRequests atomic.Int32
+	targetHandler := odoh.NewTargetHandler(logger.NOP(), keyPair, server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+		return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 300), nil
+	}))
+	target := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == odoh.ConfigsPath {
+			configRequests.Add(1)
+		}
+		targetHandler.ServeHTTP(writer, request)
+	}))
+	defer target.Close()
+	certPool := x509.NewCertPool()
+	certPool.AddCert(target.Certificate())
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context:   context.Background(),
+		Logger:    logger.NOP(),
+		Dialer:    N.SystemDialer,
+		Address:   "odoh://" + target.Listener.Addr().String() + "/dns-query?configs=" + base64.RawURLEncoding.EncodeToString(odoh.MarshalConfigs(keyPair.Config)),
+		TLSConfig: &tls.Config{RootCAs: certPool},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	request := new(mDNS.Msg)
+	request.SetQuestion("example.com.", mDNS.TypeA)
+	response, err := transport.Exchange(context.Background(), request)
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Zero(t, configRequests.Load())
+}
+
+func TestConfigs(t *testing.T) {
+	t.Parallel()
+	keyPair, err := odoh.GenerateKeyPair(odoh.KEMX25519HKDFSHA256, odoh.KDFHKDFSHA256, odoh.AEADAES128GCM)
+	require.NoError(t, err)
+	configs, err := odoh.ParseConfigs(odoh.MarshalConfigs(keyPair.Config))
+	require.NoError(t, err)
+	require.Equal(t, []odoh.Config{keyPair.Config}, configs)
+	require.Equal(t, keyPair.Config.KeyID(), configs[0].KeyID())
+	_, err = odoh.ParseConfigs([]byte{0, 4, 0, 1, 0, 8})
+	require.Error(t, err)
+}
@@ -0,0 +1,204 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/quic-go"
+	"github.com/sagernet/sing-dns/internal/wire"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+)
+
+const (
+	DoQNoError          quic.ApplicationErrorCode = 0x0
+	DoQInternalError    quic.ApplicationErrorCode = 0x1
+	DoQProtocolError    quic.ApplicationErrorCode = 0x2
+	DoQRequestCancelled quic.ApplicationErrorCode = 0x3
+)
+
+const DefaultIdleTimeout = 30 * time.Second
+
+type ServerOptions struct {
+	Context     context.Context
+	Logger      logger.ContextLogger
+	Listen      M.Socksaddr
+	TLSConfig   *tls.Config
+	Handler     server.Handler
+	IdleTimeout time.Duration
+}
+
+type Server struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	logger      logger.ContextLogger
+	listen      M.Socksaddr
+	tlsConfig   *tls.Config
+	handler     server.Handler
+	idleTimeout time.Duration
+	access      sync.Mutex
+	listeners   []*quic.Listener
+}
+
+func NewServer(options ServerOptions) (*Server, error) {
+	if options.Handler == nil {
+		return nil, E.New("missing handler")
+	}
+	if options.TLSConfig == nil {
+		return nil, E.New("missing TLS config")
+	}
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	serverLogger := options.Logger
+	if serverLogger == nil {
+		serverLogger = logger.NOP()
+	}
+	idleTimeout := options.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	tlsConfig := options.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+	return &Server{
+		ctx:         ctx,
+		cancel:      cancel,
+		logger:      serverLogger,
+		listen:      options.Listen,
+		tlsConfig:   tlsConfig,
+		handler:     options.Handler,
+		idleTimeout: idleTimeout,
+	}, nil
+}
+
+func (s *Server) Start() error {
+	packetConn, err := net.ListenPacket(N.NetworkUDP, s.listen.String())
+	if err != nil {
+		return E.Cause(err, "listen udp")
+	}
+	go func() {
+		serveErr := s.Serve(packetConn)
+		if serveErr != nil && !common.Done(s.ctx) {
+			s.logger.Error(E.Cause(serveErr, "serve quic"))
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Close() error {
+	s.cancel()
+	s.access.Lock()
+	listeners := s.listeners
+	s.listeners = nil
+	s.access.Unlock()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) Serve(packetConn net.PacketConn) error {
+	listener, err := quic.Listen(packetConn, s.tlsConfig, &quic.Config{
+		MaxIdleTimeout: s.idleTimeout,
+	})
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+	s.access.Lock()
+	if common.Done(s.ctx) {
+		s.access.Unlock()
+		listener.Close()
+		packetConn.Close()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, listener)
+	s.access.Unlock()
+	defer packetConn.Close()
+	defer listener.Close()
+	for {
+		connection, err := listener.Accept(s.ctx)
+		if err != nil {
+			if common.Done(s.ctx) {
+				return nil
+			}
+			return err
+		}
+		go s.handleConnection(connection)
+	}
+}
+
+func (s *Server) handleConnection(connection quic.Connection) {
+	source := M.SocksaddrFromNet(connection.RemoteAddr())
+	for {
+		stream, err := connection.AcceptStream(s.ctx)
+		if err != nil {
+			if common.Done(s.ctx) {
+				connection.CloseWithError(DoQNoError, "")
+			}
+			return
+		}
+		go s.handleStream(connection, source, stream)
+	}
+}
+
+func (s *Server) handleStream(connection quic.Connection, source M.Socksaddr, stream quic.Stream) {
+	request, err := wire.ReadMessage(stream)
+	if err != nil {
+		s.logger.DebugContext(s.ctx, E.Cause(err, "read request from ", source))
+		connection.CloseWithError(DoQProtocolError, "invalid request")
+		return
+	}
+	var extraData [1]byte
+	n, err := stream.Read(extraData[:])
+	if n > 0 {
+		connection.CloseWithError(DoQProtocolError, "unexpected data after request")
+		return
+	} else if err != io.EOF {
+		stream.CancelWrite(quic.StreamErrorCode(DoQRequestCancelled))
+		return
+	}
+	if request.Id != 0 {
+		connection.CloseWithError(DoQProtocolError, "non-zero message id")
+		return
+	}
+	if optRecord := request.IsEdns0(); optRecord != nil {
+		for _, option := range optRecord.Option {
+			if option.Option() == mDNS.EDNS0TCPKEEPALIVE {
+				connection.CloseWithError(DoQProtocolError, "unexpected edns-tcp-keepalive")
+				return
+			}
+		}
+	}
+	response, err := s.handler.ServeDNS(s.ctx, source, request)
+	if err != nil {
+		if common.Done(s.ctx) {
+			stream.CancelWrite(quic.StreamErrorCode(DoQRequestCancelled))
+			return
+		}
+		s.logger.DebugContext(s.ctx, E.Cause(err, "exchange for ", source))
+		response = server.ErrorResponse(request, err)
+	} else if response == nil {
+		stream.CancelWrite(quic.StreamErrorCode(DoQInternalError))
+		return
+	}
+	err = wire.WriteMessage(stream, 0, response)
+	if err != nil {
+		s.logger.DebugContext(s.ctx, E.Cause(err, "write response to ", source))
+		stream.CancelWrite(quic.StreamErrorCode(DoQInternalError))
+		return
+	}
+	stream.Close()
+}
@@ -0,0 +1,91 @@
+package quic_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sagernet/quic-go"
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/internal/testutil"
+	"github.com/sagernet/sing-dns/internal/wire"
+	dnsQUIC "github.com/sagernet/sing-dns/quic"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) (net.Addr, *x509.CertPool) {
+	serverConfig, certPool := testutil.NewCertificate(t)
+	dnsServer, err := dnsQUIC.NewServer(dnsQUIC.ServerOptions{
+		Logger:    logger.NOP(),
+		TLSConfig: serverConfig,
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 300), nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		dnsServer.Close()
+	})
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go dnsServer.Serve(packetConn)
+	return packetConn.LocalAddr(), certPool
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	serverAddr, certPool := startServer(t)
+	transport, err := dnsQUIC.NewTransport(dns.TransportOptions{
+		Context:   context.Background(),
+		Logger:    logger.NOP(),
+		Dialer:    N.SystemDialer,
+		Address:   "quic://" + serverAddr.String(),
+		TLSConfig: &tls.Config{RootCAs: certPool},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	for i := 0; i < 2; i++ {
+		request := new(mDNS.Msg)
+		request.SetQuestion("example.com.", mDNS.TypeA)
+		response, err := transport.Exchange(context.Background(), request)
+		require.NoError(t, err)
+		require.Equal(t, uint16(0), response.Id)
+		require.Len(t, response.Answer, 1)
+		require.Equal(t, "1.1.1.1", response.Answer[0].(*mDNS.A).A.String())
+	}
+}
+
+func TestServerProtocolError(t *testing.T) {
+	t.Parallel()
+	serverAddr, certPool := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connection, err := quic.DialAddr(ctx, serverAddr.String(), &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    certPool,
+		NextProtos: []string{"doq"},
+	}, nil)
+	require.NoError(t, err)
+	stream, err := connection.OpenStreamSync(ctx)
+	require.NoError(t, err)
+	request := new(mDNS.Msg)
+	request.SetQuestion("example.com.", mDNS.TypeA)
+	request.Id = 1
+	require.NoError(t, wire.WriteMessage(stream, request.Id, request))
+	stream.Close()
+	_, err = wire.ReadMessage(stream)
+	var applicationError *quic.ApplicationError
+	require.True(t, errors.As(err, &applicationError), err)
+	require.Equal(t, dnsQUIC.DoQProtocolError, applicationError.ErrorCode)
+}
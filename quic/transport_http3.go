@@ -46,6 +46,7 @@ func NewHTTP3Transport(options dns.TransportOptions) (*HTTP3Transport, error) {
 		name:        options.Name,
 		destination: serverURL.String(),
 		transport: &http3.Transport{
+			TLSClientConfig: options.TLSConfig,
 			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
 				destinationAddr := M.ParseSocksaddr(addr)
 				conn, dialErr := options.Dialer.DialContext(ctx, N.NetworkUDP, destinationAddr)
@@ -35,6 +35,7 @@ type Transport struct {
 	ctx        context.Context
 	dialer     N.Dialer
 	serverAddr M.Socksaddr
+	tlsConfig  *tls.Config
 
 	access     sync.Mutex
 	connection quic.EarlyConnection
@@ -52,11 +53,22 @@ func NewTransport(options dns.TransportOptions) (*Transport, error) {
 	if serverAddr.Port == 0 {
 		serverAddr.Port = 853
 	}
+	var tlsConfig *tls.Config
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverAddr.AddrString()
+	}
+	tlsConfig.NextProtos = []string{"doq"}
 	return &Transport{
 		name:       options.Name,
 		ctx:        options.Context,
 		dialer:     options.Dialer,
 		serverAddr: serverAddr,
+		tlsConfig:  tlsConfig,
 	}, nil
 }
 
@@ -103,7 +115,7 @@ func (t *Transport) openConnection() (quic.EarlyConnection, error) {
 		t.ctx,
 		bufio.NewUnbindPacketConn(conn),
 		t.serverAddr.UDPAddr(),
-		&tls.Config{ServerName: t.serverAddr.AddrString(), NextProtos: []string{"doq"}},
+		t.tlsConfig,
 		nil,
 	)
 	if err != nil {
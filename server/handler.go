@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sagernet/sing-dns"
+	M "github.com/sagernet/sing/common/metadata"
+
+	mDNS "github.com/miekg/dns"
+)
+
+type Handler interface {
+	ServeDNS(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error)
+}
+
+type HandlerFunc func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+	return f(ctx, source, message)
+}
+
+var _ Handler = (*ClientHandler)(nil)
+
+type ClientHandler struct {
+	client    *dns.Client
+	transport dns.Transport
+	options   dns.QueryOptions
+}
+
+func NewClientHandler(client *dns.Client, transport dns.Transport, options dns.QueryOptions) *ClientHandler {
+	return &ClientHandler{
+		client:    client,
+		transport: transport,
+		options:   options,
+	}
+}
+
+func (h *ClientHandler) ServeDNS(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+	return h.client.Exchange(ctx, h.transport, message, h.options)
+}
+
+func ErrorResponse(request *mDNS.Msg, err error) *mDNS.Msg {
+	rCode := mDNS.RcodeServerFailure
+	var rCodeError dns.RCodeError
+	if errors.As(err, &rCodeError) {
+		rCode = int(rCodeError)
+	}
+	response := new(mDNS.Msg)
+	response.SetRcode(request, rCode)
+	return response
+}
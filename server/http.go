@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+
+	mDNS "github.com/miekg/dns"
+)
+
+var _ http.Handler = (*HTTPHandler)(nil)
+
+type HTTPHandler struct {
+	logger  logger.ContextLogger
+	handler Handler
+}
+
+func NewHTTPHandler(logger logger.ContextLogger, handler Handler) *HTTPHandler {
+	return &HTTPHandler{
+		logger:  logger,
+		handler: handler,
+	}
+}
+
+func (h *HTTPHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	var rawMessage []byte
+	switch request.Method {
+	case http.MethodGet:
+		encodedMessage := request.URL.Query().Get("dns")
+		if encodedMessage == "" {
+			http.Error(writer, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		var err error
+		rawMessage, err = base64.RawURLEncoding.DecodeString(encodedMessage)
+		if err != nil {
+			http.Error(writer, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if request.Header.Get("Content-Type") != dns.MimeType {
+			http.Error(writer, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		rawMessage, err = io.ReadAll(io.LimitReader(request.Body, mDNS.MaxMsgSize+1))
+		if err != nil {
+			http.Error(writer, "read request failed", http.StatusBadRequest)
+			return
+		}
+		if len(rawMessage) > mDNS.MaxMsgSize {
+			http.Error(writer, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		writer.Header().Set("Allow", "GET, POST")
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var message mDNS.Msg
+	err := message.Unpack(rawMessage)
+	if err != nil {
+		http.Error(writer, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	if message.Response {
+		http.Error(writer, "unexpected response message", http.StatusBadRequest)
+		return
+	}
+	ctx := request.Context()
+	source := M.ParseSocksaddr(request.RemoteAddr)
+	response, err := h.handler.ServeDNS(ctx, source, &message)
+	if err != nil {
+		if h.logger != nil {
+			h.logger.DebugContext(ctx, E.Cause(err, "exchange for ", source))
+		}
+		response = ErrorResponse(&message, err)
+	} else if response == nil {
+		http.Error(writer, "no response", http.StatusBadGateway)
+		return
+	}
+	response.Id = message.Id
+	buffer := buf.NewSize(1 + response.Len())
+	defer buffer.Release()
+	exMessage := *response
+	exMessage.Compress = true
+	rawResponse, err := exMessage.PackBuffer(buffer.FreeBytes())
+	if err != nil {
+		http.Error(writer, "pack response failed", http.StatusInternalServerError)
+		return
+	}
+	header := writer.Header()
+	header.Set("Content-Type", dns.MimeType)
+	header.Set("Content-Length", strconv.Itoa(len(rawResponse)))
+	if maxAge, loaded := responseMaxAge(response); loaded {
+		header.Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
+	}
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(rawResponse)
+}
+
+func responseMaxAge(response *mDNS.Msg) (uint32, bool) {
+	var (
+		maxAge uint32
+		loaded bool
+	)
+	for _, record := range response.Answer {
+		if !loaded || record.Header().Ttl < maxAge {
+			maxAge = record.Header().Ttl
+			loaded = true
+		}
+	}
+	if loaded {
+		return maxAge, true
+	}
+	for _, record := range response.Ns {
+		soa, isSOA := record.(*mDNS.SOA)
+		if !isSOA {
+			continue
+		}
+		maxAge = soa.Hdr.Ttl
+		if soa.Minttl < maxAge {
+			maxAge = soa.Minttl
+		}
+		return maxAge, true
+	}
+	return 0, false
+}
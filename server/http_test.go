@@ -0,0 +1,132 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	t.Parallel()
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	handler := server.NewHTTPHandler(logger.NOP(), server.NewClientHandler(client, &fixedTransport{netip.MustParseAddr("1.1.1.1")}, dns.QueryOptions{}))
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	transport := dns.NewHTTPSTransport(dns.TransportOptions{
+		Address: httpServer.URL + "/dns-query",
+		Dialer:  N.SystemDialer,
+	})
+	defer transport.Close()
+	request := new(mDNS.Msg)
+	request.SetQuestion("example.com.", mDNS.TypeA)
+	response, err := transport.Exchange(context.Background(), request)
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "1.1.1.1", response.Answer[0].(*mDNS.A).A.String())
+
+	request.Id = 0
+	rawMessage, err := request.Pack()
+	require.NoError(t, err)
+	httpResponse, err := http.Get(httpServer.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(rawMessage))
+	require.NoError(t, err)
+	defer httpResponse.Body.Close()
+	require.Equal(t, http.StatusOK, httpResponse.StatusCode)
+	require.Equal(t, dns.MimeType, httpResponse.Header.Get("Content-Type"))
+	require.Regexp(t, `^max-age=\d+$`, httpResponse.Header.Get("Cache-Control"))
+	var responseMessage mDNS.Msg
+	var responseBody bytes.Buffer
+	_, err = responseBody.ReadFrom(httpResponse.Body)
+	require.NoError(t, err)
+	require.NoError(t, responseMessage.Unpack(responseBody.Bytes()))
+	require.Equal(t, uint16(0), responseMessage.Id)
+	require.Len(t, responseMessage.Answer, 1)
+
+	for _, testCase := range []struct {
+		method      string
+		target      string
+		contentType string
+		status      int
+	}{
+		{http.MethodGet, "/dns-query", "", http.StatusBadRequest},
+		{http.MethodGet, "/dns-query?dns=!!", "", http.StatusBadRequest},
+		{http.MethodPost, "/dns-query", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPut, "/dns-query", dns.MimeType, http.StatusMethodNotAllowed},
+	} {
+		httpRequest, err := http.NewRequest(testCase.method, httpServer.URL+testCase.target, bytes.NewReader(rawMessage))
+		require.NoError(t, err)
+		if testCase.contentType != "" {
+			httpRequest.Header.Set("Content-Type", testCase.contentType)
+		}
+		httpResponse, err := http.DefaultClient.Do(httpRequest)
+		require.NoError(t, err)
+		httpResponse.Body.Close()
+		require.Equal(t, testCase.status, httpResponse.StatusCode, testCase.method+" "+testCase.target)
+	}
+}
+
+func TestHTTPHandlerMaxAge(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		name         string
+		records      []string
+		cacheControl string
+	}{
+		{"answer", []string{
+			"example.com. 300 IN A 1.1.1.1",
+			"example.com. 60 IN NS ns.example.com.",
+		}, "max-age=300"},
+		{"negative", []string{
+			"example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 120",
+		}, "max-age=120"},
+		{"empty", nil, ""},
+	} {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			handler := server.NewHTTPHandler(logger.NOP(), server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+				response := new(mDNS.Msg)
+				response.SetReply(message)
+				for _, record := range testCase.records {
+					rr, err := mDNS.NewRR(record)
+					if err != nil {
+						return nil, err
+					}
+					switch rr.Header().Rrtype {
+					case mDNS.TypeA:
+						response.Answer = append(response.Answer, rr)
+					default:
+						response.Ns = append(response.Ns, rr)
+					}
+				}
+				return response, nil
+			}))
+			httpServer := httptest.NewServer(handler)
+			defer httpServer.Close()
+			request := new(mDNS.Msg)
+			request.SetQuestion("example.com.", mDNS.TypeA)
+			rawMessage, err := request.Pack()
+			require.NoError(t, err)
+			httpResponse, err := http.Get(httpServer.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(rawMessage))
+			require.NoError(t, err)
+			httpResponse.Body.Close()
+			require.Equal(t, http.StatusOK, httpResponse.StatusCode)
+			require.Equal(t, testCase.cacheControl, httpResponse.Header.Get("Cache-Control"))
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/internal/wire"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+)
+
+const (
+	DefaultMaxConcurrent  = 1024
+	DefaultTCPIdleTimeout = 10 * time.Second
+)
+
+type Options struct {
+	Context        context.Context
+	Logger         logger.ContextLogger
+	Network        string
+	Listen         M.Socksaddr
+	Handler        Handler
+	TLSConfig      *tls.Config
+	MaxConcurrent  int
+	TCPIdleTimeout time.Duration
+}
+
+type Server struct {
+	ctx            context.Context
+	cancel         context.CancelFunc
+	logger         logger.ContextLogger
+	network        string
+	listen         M.Socksaddr
+	handler        Handler
+	tlsConfig      *tls.Config
+	concurrency    chan struct{}
+	tcpIdleTimeout time.Duration
+	access         sync.Mutex
+	closers        map[any]func() error
+}
+
+func NewServer(options Options) (*Server, error) {
+	if options.Handler == nil {
+		return nil, E.New("missing handler")
+	}
+	switch options.Network {
+	case "", N.NetworkUDP, N.NetworkTCP:
+	default:
+		return nil, E.New("unknown network: ", options.Network)
+	}
+	if options.TLSConfig != nil && options.Network == N.NetworkUDP {
+		return nil, E.New("TLS is only supported over TCP")
+	}
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	maxConcurrent := options.MaxConcurrent
+	if maxConcurrent == 0 {
+		maxConcurrent = DefaultMaxConcurrent
+	}
+	tcpIdleTimeout := options.TCPIdleTimeout
+	if tcpIdleTimeout == 0 {
+		tcpIdleTimeout = DefaultTCPIdleTimeout
+	}
+	serverLogger := options.Logger
+	if serverLogger == nil {
+		serverLogger = logger.NOP()
+	}
+	server := &Server{
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         serverLogger,
+		network:        options.Network,
+		listen:         options.Listen,
+		handler:        options.Handler,
+		tlsConfig:      options.TLSConfig,
+		tcpIdleTimeout: tcpIdleTimeout,
+		closers:        make(map[any]func() error),
+	}
+	if maxConcurrent > 0 {
+		server.concurrency = make(chan struct{}, maxConcurrent)
+	}
+	return server, nil
+}
+
+func (s *Server) Start() error {
+	if s.tlsConfig == nil && (s.network == "" || s.network == N.NetworkUDP) {
+		packetConn, err := net.ListenPacket(N.NetworkUDP, s.listen.String())
+		if err != nil {
+			return E.Cause(err, "listen udp")
+		}
+		go s.serve("udp", func() error {
+			return s.ServeUDP(packetConn)
+		})
+	}
+	if s.network == "" || s.network == N.NetworkTCP {
+		listener, err := net.Listen(N.NetworkTCP, s.listen.String())
+		if err != nil {
+			s.Close()
+			return E.Cause(err, "listen tcp")
+		}
+		if s.tlsConfig != nil {
+			go s.serve("tls", func() error {
+				return s.ServeTLS(listener, s.tlsConfig)
+			})
+		} else {
+			go s.serve("tcp", func() error {
+				return s.ServeTCP(listener)
+			})
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve(network string, serve func() error) {
+	err := serve()
+	if err != nil && !common.Done(s.ctx) {
+		s.logger.Error(E.Cause(err, "serve ", network))
+	}
+}
+
+func (s *Server) Close() error {
+	s.cancel()
+	s.access.Lock()
+	closers := s.closers
+	s.closers = make(map[any]func() error)
+	s.access.Unlock()
+	var errors []error
+	for _, closer := range closers {
+		errors = append(errors, closer())
+	}
+	return E.Errors(errors...)
+}
+
+func (s *Server) track(key any, closer func() error) bool {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if common.Done(s.ctx) {
+		return false
+	}
+	s.closers[key] = closer
+	return true
+}
+
+func (s *Server) untrack(key any) {
+	s.access.Lock()
+	delete(s.closers, key)
+	s.access.Unlock()
+}
+
+func (s *Server) acquire() bool {
+	if s.concurrency == nil {
+		return true
+	}
+	select {
+	case s.concurrency <- struct{}{}:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *Server) release() {
+	if s.concurrency != nil {
+		<-s.concurrency
+	}
+}
+
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	if !s.track(conn, conn.Close) {
+		conn.Close()
+		return net.ErrClosed
+	}
+	defer s.untrack(conn)
+	defer conn.Close()
+	for {
+		buffer := buf.NewSize(mDNS.MaxMsgSize)
+		n, addr, err := conn.ReadFrom(buffer.FreeBytes())
+		if err != nil {
+			buffer.Release()
+			if common.Done(s.ctx) {
+				return nil
+			}
+			return err
+		}
+		buffer.Truncate(n)
+		source := M.SocksaddrFromNet(addr)
+		var request mDNS.Msg
+		err = request.Unpack(buffer.Bytes())
+		if err != nil {
+			s.logger.DebugContext(s.ctx, E.Cause(err, "unpack request from ", source))
+			if buffer.Len() >= 2 {
+				s.writeFormatError(conn, addr, binary.BigEndian.Uint16(buffer.Bytes()))
+			}
+			buffer.Release()
+			continue
+		}
+		buffer.Release()
+		if !s.acquire() {
+			return nil
+		}
+		go func() {
+			defer s.release()
+			s.handleUDP(conn, addr, source, &request)
+		}()
+	}
+}
+
+func (s *Server) handleUDP(conn net.PacketConn, addr net.Addr, source M.Socksaddr, request *mDNS.Msg) {
+	response := s.exchange(source, request)
+	if response == nil {
+		return
+	}
+	buffer, err := dns.TruncateDNSMessage(request, response, 0)
+	if err != nil {
+		s.logger.ErrorContext(s.ctx, E.Cause(err, "pack response to ", source))
+		return
+	}
+	defer buffer.Release()
+	_, err = conn.WriteTo(buffer.Bytes(), addr)
+	if err != nil && !common.Done(s.ctx) {
+		s.logger.DebugContext(s.ctx, E.Cause(err, "write response to ", source))
+	}
+}
+
+func (s *Server) writeFormatError(conn net.PacketConn, addr net.Addr, messageId uint16) {
+	response := mDNS.Msg{
+		MsgHdr: mDNS.MsgHdr{
+			Id:       messageId,
+			Response: true,
+			Rcode:    mDNS.RcodeFormatError,
+		},
+	}
+	rawMessage, err := response.Pack()
+	if err != nil {
+		return
+	}
+	conn.WriteTo(rawMessage, addr)
+}
+
+func (s *Server) ServeTCP(listener net.Listener) error {
+	if !s.track(listener, listener.Close) {
+		listener.Close()
+		return net.ErrClosed
+	}
+	defer s.untrack(listener)
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if common.Done(s.ctx) {
+				return nil
+			}
+			return err
+		}
+		go s.ServeStream(conn)
+	}
+}
+
+func (s *Server) ServeStream(conn net.Conn) {
+	if !s.track(conn, conn.Close) {
+		conn.Close()
+		return
+	}
+	defer s.untrack(conn)
+	defer conn.Close()
+	source := M.SocksaddrFromNet(conn.RemoteAddr())
+	var (
+		writeAccess sync.Mutex
+		group       sync.WaitGroup
+	)
+	for {
+		if s.tcpIdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.tcpIdleTimeout))
+		}
+		request, err := wire.ReadMessage(conn)
+		if err != nil {
+			break
+		}
+		if !s.acquire() {
+			break
+		}
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			defer s.release()
+			response := s.exchange(source, request)
+			if response == nil {
+				return
+			}
+			writeAccess.Lock()
+			err := wire.WriteMessage(conn, response.Id, response)
+			writeAccess.Unlock()
+			if err != nil {
+				s.logger.DebugContext(s.ctx, E.Cause(err, "write response to ", source))
+				conn.Close()
+			}
+		}()
+	}
+	group.Wait()
+}
+
+func (s *Server) exchange(source M.Socksaddr, request *mDNS.Msg) *mDNS.Msg {
+	if request.Response {
+		return nil
+	}
+	response, err := s.handler.ServeDNS(s.ctx, source, request)
+	if err != nil {
+		if common.Done(s.ctx) {
+			return nil
+		}
+		s.logger.DebugContext(s.ctx, E.Cause(err, "exchange for ", source))
+		response = ErrorResponse(request, err)
+	} else if response == nil {
+		return nil
+	}
+	response.Id = request.Id
+	return response
+}
@@ -0,0 +1,181 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/internal/wire"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+var _ dns.Transport = (*fixedTransport)(nil)
+
+type fixedTransport struct {
+	address netip.Addr
+}
+
+func (t *fixedTransport) Name() string {
+	return "fixed"
+}
+
+func (t *fixedTransport) Start() error {
+	return nil
+}
+
+func (t *fixedTransport) Reset() {
+}
+
+func (t *fixedTransport) Close() error {
+	return nil
+}
+
+func (t *fixedTransport) Raw() bool {
+	return true
+}
+
+func (t *fixedTransport) Exchange(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+	return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{t.address}, 300), nil
+}
+
+func (t *fixedTransport) Lookup(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func startServer(t *testing.T, options server.Options) (udpAddr net.Addr, tcpAddr net.Addr) {
+	options.Logger = logger.NOP()
+	dnsServer, err := server.NewServer(options)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		dnsServer.Close()
+	})
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go dnsServer.ServeUDP(packetConn)
+	go dnsServer.ServeTCP(listener)
+	return packetConn.LocalAddr(), listener.Addr()
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	udpAddr, tcpAddr := startServer(t, server.Options{
+		Handler: server.NewClientHandler(client, &fixedTransport{netip.MustParseAddr("1.1.1.1")}, dns.QueryOptions{}),
+	})
+	request := new(mDNS.Msg)
+	request.SetQuestion("example.com.", mDNS.TypeA)
+	for _, exchange := range []struct {
+		network string
+		address net.Addr
+	}{{"udp", udpAddr}, {"tcp", tcpAddr}} {
+		dnsClient := &mDNS.Client{Net: exchange.network}
+		response, _, err := dnsClient.Exchange(request, exchange.address.String())
+		require.NoError(t, err)
+		require.Equal(t, request.Id, response.Id)
+		require.Len(t, response.Answer, 1)
+		require.Equal(t, "1.1.1.1", response.Answer[0].(*mDNS.A).A.String())
+	}
+}
+
+func TestServerError(t *testing.T) {
+	t.Parallel()
+	udpAddr, _ := startServer(t, server.Options{
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			return nil, dns.RCodeRefused
+		}),
+	})
+	request := new(mDNS.Msg)
+	request.SetQuestion("example.com.", mDNS.TypeA)
+	response, err := mDNS.Exchange(request, udpAddr.String())
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeRefused, response.Rcode)
+}
+
+func TestServerTruncate(t *testing.T) {
+	t.Parallel()
+	udpAddr, tcpAddr := startServer(t, server.Options{
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			response := new(mDNS.Msg)
+			response.SetReply(message)
+			for i := 0; i < 20; i++ {
+				response.Answer = append(response.Answer, &mDNS.TXT{
+					Hdr: mDNS.RR_Header{
+						Name:   message.Question[0].Name,
+						Rrtype: mDNS.TypeTXT,
+						Class:  mDNS.ClassINET,
+						Ttl:    300,
+					},
+					Txt: []string{strings.Repeat("x", 100)},
+				})
+			}
+			return response, nil
+		}),
+	})
+	request := new(mDNS.Msg)
+	request.SetQuestion("example.com.", mDNS.TypeTXT)
+	response, err := mDNS.Exchange(request, udpAddr.String())
+	require.NoError(t, err)
+	require.True(t, response.Truncated)
+	require.Less(t, len(response.Answer), 20)
+	dnsClient := &mDNS.Client{Net: "tcp"}
+	response, _, err = dnsClient.Exchange(request, tcpAddr.String())
+	require.NoError(t, err)
+	require.False(t, response.Truncated)
+	require.Len(t, response.Answer, 20)
+}
+
+func TestServerPipeline(t *testing.T) {
+	t.Parallel()
+	var concurrent, maxConcurrent atomic.Int32
+	_, tcpAddr := startServer(t, server.Options{
+		MaxConcurrent: 2,
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			current := concurrent.Add(1)
+			defer concurrent.Add(-1)
+			for {
+				loaded := maxConcurrent.Load()
+				if current <= loaded || maxConcurrent.CompareAndSwap(loaded, current) {
+					break
+				}
+			}
+			if message.Question[0].Name == "slow.example.com." {
+				time.Sleep(200 * time.Millisecond)
+			}
+			return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 300), nil
+		}),
+	})
+	conn, err := net.Dial("tcp", tcpAddr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	domains := []string{"slow.example.com.", "fast.example.com.", "slow.example.com.", "fast.example.com."}
+	for i, domain := range domains {
+		request := new(mDNS.Msg)
+		request.SetQuestion(domain, mDNS.TypeA)
+		require.NoError(t, wire.WriteMessage(conn, uint16(i+1), request))
+	}
+	var order []uint16
+	for range domains {
+		response, err := wire.ReadMessage(conn)
+		require.NoError(t, err)
+		require.Equal(t, domains[response.Id-1], response.Question[0].Name)
+		order = append(order, response.Id)
+	}
+	require.Equal(t, uint16(2), order[0])
+	require.ElementsMatch(t, []uint16{1, 2, 3, 4}, order)
+	require.LessOrEqual(t, maxConcurrent.Load(), int32(2))
+}
@@ -0,0 +1,14 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+func (s *Server) ServeTLS(listener net.Listener, config *tls.Config) error {
+	if len(config.NextProtos) == 0 {
+		config = config.Clone()
+		config.NextProtos = []string{"dot"}
+	}
+	return s.ServeTCP(tls.NewListener(listener, config))
+}
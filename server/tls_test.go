@@ -0,0 +1,67 @@
+package server_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/internal/testutil"
+	"github.com/sagernet/sing-dns/internal/wire"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTLS(t *testing.T) {
+	t.Parallel()
+	serverConfig, certPool := testutil.NewCertificate(t)
+	client := dns.NewClient(dns.ClientOptions{
+		Logger: logger.NOP(),
+	})
+	dnsServer, err := server.NewServer(server.Options{
+		Logger:         logger.NOP(),
+		Handler:        server.NewClientHandler(client, &fixedTransport{netip.MustParseAddr("1.1.1.1")}, dns.QueryOptions{}),
+		TLSConfig:      serverConfig,
+		TCPIdleTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer dnsServer.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go dnsServer.ServeTLS(listener, serverConfig)
+
+	transport, err := dns.NewTLSTransport(dns.TransportOptions{
+		Context:   context.Background(),
+		Logger:    logger.NOP(),
+		Dialer:    N.SystemDialer,
+		Address:   "tls://" + listener.Addr().String(),
+		TLSConfig: &tls.Config{RootCAs: certPool},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	for i := 0; i < 2; i++ {
+		request := new(mDNS.Msg)
+		request.SetQuestion("example.com.", mDNS.TypeA)
+		response, err := transport.Exchange(context.Background(), request)
+		require.NoError(t, err)
+		require.Len(t, response.Answer, 1)
+		require.Equal(t, "1.1.1.1", response.Answer[0].(*mDNS.A).A.String())
+	}
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: certPool, NextProtos: []string{"dot"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "dot", conn.ConnectionState().NegotiatedProtocol)
+	time.Sleep(400 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = wire.ReadMessage(conn)
+	require.ErrorIs(t, err, io.EOF)
+}
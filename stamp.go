@@ -0,0 +1,219 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+)
+
+const (
+	StampPropertyDNSSEC   uint64 = 1 << 0
+	StampPropertyNoLog    uint64 = 1 << 1
+	StampPropertyNoFilter uint64 = 1 << 2
+)
+
+type StampProtocol uint8
+
+const (
+	StampProtocolPlain         StampProtocol = 0x00
+	StampProtocolDNSCrypt      StampProtocol = 0x01
+	StampProtocolDoH           StampProtocol = 0x02
+	StampProtocolTLS           StampProtocol = 0x03
+	StampProtocolQUIC          StampProtocol = 0x04
+	StampProtocolODoHTarget    StampProtocol = 0x05
+	StampProtocolDNSCryptRelay StampProtocol = 0x81
+	StampProtocolODoHRelay     StampProtocol = 0x85
+)
+
+func (p StampProtocol) String() string {
+	switch p {
+	case StampProtocolPlain:
+		return "Plain"
+	case StampProtocolDNSCrypt:
+		return "DNSCrypt"
+	case StampProtocolDoH:
+		return "DoH"
+	case StampProtocolTLS:
+		return "DoT"
+	case StampProtocolQUIC:
+		return "DoQ"
+	case StampProtocolODoHTarget:
+		return "ODoH target"
+	case StampProtocolDNSCryptRelay:
+		return "DNSCrypt relay"
+	case StampProtocolODoHRelay:
+		return "ODoH relay"
+	default:
+		return F.ToString("unknown(", uint8(p), ")")
+	}
+}
+
+type ServerStamp struct {
+	Protocol        StampProtocol
+	Props           uint64
+	ServerAddr      string
+	ServerPublicKey []byte
+	ProviderName    string
+	Hashes          [][]byte
+	Path            string
+	Bootstrap       []string
+}
+
+func ParseStamp(stamp string) (*ServerStamp, error) {
+	if !strings.HasPrefix(stamp, "sdns://") {
+		return nil, E.New("invalid stamp: missing sdns:// prefix")
+	}
+	rawStamp, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(stamp[len("sdns://"):], "="))
+	if err != nil {
+		return nil, E.Cause(err, "decode stamp")
+	}
+	if len(rawStamp) < 1 {
+		return nil, E.New("invalid stamp: empty")
+	}
+	reader := &stampReader{data: rawStamp[1:]}
+	serverStamp := &ServerStamp{
+		Protocol: StampProtocol(rawStamp[0]),
+	}
+	switch serverStamp.Protocol {
+	case StampProtocolPlain:
+		serverStamp.Props = reader.readProps()
+		serverStamp.ServerAddr = string(reader.readLP())
+		if reader.err == nil && serverStamp.ServerAddr == "" {
+			return nil, E.New("invalid stamp: missing server address")
+		}
+	case StampProtocolDNSCrypt:
+		serverStamp.Props = reader.readProps()
+		serverStamp.ServerAddr = string(reader.readLP())
+		serverStamp.ServerPublicKey = reader.readLP()
+		serverStamp.ProviderName = string(reader.readLP())
+		if reader.err == nil && len(serverStamp.ServerPublicKey) != 32 {
+			return nil, E.New("invalid stamp: bad public key length")
+		}
+		if reader.err == nil && serverStamp.ProviderName == "" {
+			return nil, E.New("invalid stamp: missing provider name")
+		}
+	case StampProtocolDoH, StampProtocolODoHRelay:
+		serverStamp.Props = reader.readProps()
+		serverStamp.ServerAddr = string(reader.readLP())
+		serverStamp.Hashes = reader.readHashes()
+		serverStamp.ProviderName = string(reader.readLP())
+		serverStamp.Path = string(reader.readLP())
+		serverStamp.Bootstrap = reader.readBootstrap()
+	case StampProtocolTLS, StampProtocolQUIC:
+		serverStamp.Props = reader.readProps()
+		serverStamp.ServerAddr = string(reader.readLP())
+		serverStamp.Hashes = reader.readHashes()
+		serverStamp.ProviderName = string(reader.readLP())
+		serverStamp.Bootstrap = reader.readBootstrap()
+	case StampProtocolODoHTarget:
+		serverStamp.Props = reader.readProps()
+		serverStamp.ProviderName = string(reader.readLP())
+		serverStamp.Path = string(reader.readLP())
+	case StampProtocolDNSCryptRelay:
+		serverStamp.ServerAddr = string(reader.readLP())
+		if reader.err == nil && serverStamp.ServerAddr == "" {
+			return nil, E.New("invalid stamp: missing server address")
+		}
+	default:
+		return nil, E.New("unsupported stamp protocol: ", serverStamp.Protocol)
+	}
+	if reader.err != nil {
+		return nil, E.Cause(reader.err, "invalid stamp")
+	}
+	if len(reader.data) > 0 {
+		return nil, E.New("invalid stamp: garbage after end")
+	}
+	switch serverStamp.Protocol {
+	case StampProtocolDoH, StampProtocolTLS, StampProtocolQUIC, StampProtocolODoHTarget, StampProtocolODoHRelay:
+		if serverStamp.ProviderName == "" {
+			return nil, E.New("invalid stamp: missing hostname")
+		}
+	}
+	for _, hash := range serverStamp.Hashes {
+		if len(hash) != 32 {
+			return nil, E.New("invalid stamp: bad certificate hash length")
+		}
+	}
+	return serverStamp, nil
+}
+
+type stampReader struct {
+	data []byte
+	err  error
+}
+
+func (r *stampReader) readProps() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 8 {
+		r.err = E.New("short properties")
+		return 0
+	}
+	props := binary.LittleEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return props
+}
+
+func (r *stampReader) readLP() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < 1 {
+		r.err = E.New("unexpected end")
+		return nil
+	}
+	length := int(r.data[0])
+	if len(r.data) < 1+length {
+		r.err = E.New("unexpected end")
+		return nil
+	}
+	value := r.data[1 : 1+length]
+	r.data = r.data[1+length:]
+	return value
+}
+
+func (r *stampReader) readVLP() [][]byte {
+	var values [][]byte
+	for {
+		if r.err != nil {
+			return nil
+		}
+		if len(r.data) < 1 {
+			r.err = E.New("unexpected end")
+			return nil
+		}
+		more := r.data[0]&0x80 != 0
+		length := int(r.data[0] &^ 0x80)
+		if len(r.data) < 1+length {
+			r.err = E.New("unexpected end")
+			return nil
+		}
+		value := r.data[1 : 1+length]
+		r.data = r.data[1+length:]
+		if len(value) > 0 {
+			values = append(values, value)
+		}
+		if !more {
+			return values
+		}
+	}
+}
+
+func (r *stampReader) readHashes() [][]byte {
+	return r.readVLP()
+}
+
+func (r *stampReader) readBootstrap() []string {
+	if r.err != nil || len(r.data) == 0 {
+		return nil
+	}
+	var bootstrap []string
+	for _, value := range r.readVLP() {
+		bootstrap = append(bootstrap, string(value))
+	}
+	return bootstrap
+}
@@ -2,6 +2,7 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
 	"net/netip"
 	"net/url"
 
@@ -31,6 +32,8 @@ type TransportOptions struct {
 	Dialer       N.Dialer
 	Address      string
 	ClientSubnet netip.Prefix
+	TLSConfig    *tls.Config
+	Health       *HealthTracker
 }
 
 var transports map[string]TransportConstructor
@@ -0,0 +1,462 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/control"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DHCPv4ClientPort = 68
+	DHCPv4ServerPort = 67
+	DHCPv6ClientPort = 546
+	DHCPv6ServerPort = 547
+)
+
+const (
+	dhcpDiscoverTimeout    = 5 * time.Second
+	dhcpRetransmitInterval = time.Second
+
+	dhcpv4OpRequest         = 1
+	dhcpv4OpReply           = 2
+	dhcpv4HeaderLen         = 236
+	dhcpv4OptionPad         = 0
+	dhcpv4OptionDNS         = 6
+	dhcpv4OptionMessageType = 53
+	dhcpv4OptionParams      = 55
+	dhcpv4OptionEnd         = 255
+	dhcpv4MessageACK        = 5
+	dhcpv4MessageInform     = 8
+
+	dhcpv6MessageReply       = 7
+	dhcpv6MessageInfoRequest = 11
+	dhcpv6OptionClientID     = 1
+	dhcpv6OptionORO          = 6
+	dhcpv6OptionElapsedTime  = 8
+	dhcpv6OptionDNSServers   = 23
+)
+
+var (
+	dhcpv4MagicCookie = []byte{99, 130, 83, 99}
+	dhcpv4Broadcast   = netip.AddrPortFrom(netip.AddrFrom4([4]byte{255, 255, 255, 255}), DHCPv4ServerPort)
+	dhcpv6AllServers  = netip.AddrPortFrom(netip.MustParseAddr("ff02::1:2"), DHCPv6ServerPort)
+)
+
+var _ Transport = (*DHCPTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"dhcp"}, func(options TransportOptions) (Transport, error) {
+		return NewDHCPTransport(options)
+	})
+}
+
+type DHCPTransport struct {
+	name          string
+	ctx           context.Context
+	logger        logger.ContextLogger
+	dialer        N.Dialer
+	interfaceName string
+	serverAddr    netip.AddrPort
+	access        sync.Mutex
+	transports    []*UDPTransport
+}
+
+func NewDHCPTransport(options TransportOptions) (*DHCPTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	if serverURL.Host == "" {
+		return nil, E.New("missing interface name")
+	}
+	var serverAddr netip.AddrPort
+	if server := serverURL.Query().Get("server"); server != "" {
+		serverAddr, err = parseDHCPServerAddr(server)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &DHCPTransport{
+		name:          options.Name,
+		ctx:           options.Context,
+		logger:        options.Logger,
+		dialer:        options.Dialer,
+		interfaceName: serverURL.Host,
+		serverAddr:    serverAddr,
+	}, nil
+}
+
+func parseDHCPServerAddr(server string) (netip.AddrPort, error) {
+	serverAddr, err := netip.ParseAddrPort(server)
+	if err == nil {
+		return serverAddr, nil
+	}
+	addr, err := netip.ParseAddr(server)
+	if err != nil {
+		return netip.AddrPort{}, E.New("invalid DHCP server address: ", server)
+	}
+	if addr.Is4() {
+		return netip.AddrPortFrom(addr, DHCPv4ServerPort), nil
+	}
+	return netip.AddrPortFrom(addr, DHCPv6ServerPort), nil
+}
+
+func (t *DHCPTransport) Name() string {
+	return t.name
+}
+
+func (t *DHCPTransport) Start() error {
+	return nil
+}
+
+func (t *DHCPTransport) Reset() {
+	t.access.Lock()
+	transports := t.transports
+	t.transports = nil
+	t.access.Unlock()
+	for _, transport := range transports {
+		transport.Close()
+	}
+}
+
+func (t *DHCPTransport) Close() error {
+	t.Reset()
+	return nil
+}
+
+func (t *DHCPTransport) Raw() bool {
+	return true
+}
+
+func (t *DHCPTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	transports, err := t.loadTransports(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var exchangeErrors []error
+	for _, transport := range transports {
+		response, err := transport.Exchange(ctx, message)
+		if err == nil {
+			return response, nil
+		}
+		exchangeErrors = append(exchangeErrors, err)
+	}
+	return nil, E.Errors(exchangeErrors...)
+}
+
+func (t *DHCPTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *DHCPTransport) loadTransports(ctx context.Context) ([]*UDPTransport, error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if len(t.transports) > 0 {
+		return t.transports, nil
+	}
+	servers, err := t.discover(ctx)
+	if err != nil {
+		return nil, E.Cause(err, "discover DNS servers on ", t.interfaceName)
+	}
+	t.logger.InfoContext(ctx, "discovered DNS servers on ", t.interfaceName, ": ", servers)
+	transports := make([]*UDPTransport, 0, len(servers))
+	for _, server := range servers {
+		transport, err := NewUDPTransport(TransportOptions{
+			Context: t.ctx,
+			Logger:  t.logger,
+			Name:    t.name,
+			Dialer:  t.dialer,
+			Address: netip.AddrPortFrom(server, 53).String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, transport)
+	}
+	t.transports = transports
+	return transports, nil
+}
+
+func (t *DHCPTransport) discover(ctx context.Context) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(t.interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dhcpDiscoverTimeout)
+	defer cancel()
+	if t.serverAddr.IsValid() {
+		if t.serverAddr.Addr().Is4() {
+			return t.discover4(ctx, iface)
+		}
+		return t.discover6(ctx, iface)
+	}
+	results := make(chan dhcpDiscoverResult, 2)
+	go func() {
+		servers, err := t.discover4(ctx, iface)
+		results <- dhcpDiscoverResult{servers, err}
+	}()
+	go func() {
+		servers, err := t.discover6(ctx, iface)
+		results <- dhcpDiscoverResult{servers, err}
+	}()
+	var (
+		servers        []netip.Addr
+		discoverErrors []error
+	)
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if result.err != nil {
+			discoverErrors = append(discoverErrors, result.err)
+			continue
+		}
+		if len(servers) == 0 {
+			timer := time.AfterFunc(dhcpRetransmitInterval, cancel)
+			defer timer.Stop()
+		}
+		servers = append(servers, result.servers...)
+	}
+	if len(servers) == 0 {
+		return nil, E.Errors(discoverErrors...)
+	}
+	return servers, nil
+}
+
+type dhcpDiscoverResult struct {
+	servers []netip.Addr
+	err     error
+}
+
+func (t *DHCPTransport) listenPacket(ctx context.Context, iface *net.Interface, network string, clientPort uint16) (net.PacketConn, error) {
+	var listenConfig net.ListenConfig
+	var listenAddr string
+	if t.serverAddr.IsValid() {
+		listenAddr = ":0"
+	} else {
+		listenConfig.Control = control.Append(control.BindToInterface(nil, iface.Name, iface.Index), control.ReuseAddr())
+		listenAddr = ":" + strconv.Itoa(int(clientPort))
+	}
+	return listenConfig.ListenPacket(ctx, network, listenAddr)
+}
+
+func (t *DHCPTransport) discover4(ctx context.Context, iface *net.Interface) ([]netip.Addr, error) {
+	var clientAddr netip.Addr
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, isIPNet := addr.(*net.IPNet); isIPNet {
+			if ip := M.AddrFromIP(ipNet.IP).Unmap(); ip.Is4() {
+				clientAddr = ip
+				break
+			}
+		}
+	}
+	if !clientAddr.IsValid() {
+		return nil, E.New("no IPv4 address on interface")
+	}
+	conn, err := t.listenPacket(ctx, iface, N.NetworkUDP+"4", DHCPv4ClientPort)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var transactionID [4]byte
+	_, err = rand.Read(transactionID[:])
+	if err != nil {
+		return nil, err
+	}
+	serverAddr := t.serverAddr
+	if !serverAddr.IsValid() {
+		serverAddr = dhcpv4Broadcast
+	}
+	request := buildDHCPv4Inform(transactionID, clientAddr, iface.HardwareAddr)
+	return dhcpRoundTrip(ctx, conn, serverAddr, request, func(packet []byte) ([]netip.Addr, bool) {
+		return parseDHCPv4Reply(packet, transactionID)
+	})
+}
+
+func (t *DHCPTransport) discover6(ctx context.Context, iface *net.Interface) ([]netip.Addr, error) {
+	conn, err := t.listenPacket(ctx, iface, N.NetworkUDP+"6", DHCPv6ClientPort)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var transactionID [3]byte
+	_, err = rand.Read(transactionID[:])
+	if err != nil {
+		return nil, err
+	}
+	serverAddr := t.serverAddr
+	if !serverAddr.IsValid() {
+		serverAddr = netip.AddrPortFrom(dhcpv6AllServers.Addr().WithZone(iface.Name), dhcpv6AllServers.Port())
+	}
+	request := buildDHCPv6InformationRequest(transactionID, iface.HardwareAddr)
+	return dhcpRoundTrip(ctx, conn, serverAddr, request, func(packet []byte) ([]netip.Addr, bool) {
+		servers, loaded := parseDHCPv6Reply(packet, transactionID)
+		for i, server := range servers {
+			if server.IsLinkLocalUnicast() {
+				servers[i] = server.WithZone(iface.Name)
+			}
+		}
+		return servers, loaded
+	})
+}
+
+func dhcpRoundTrip(ctx context.Context, conn net.PacketConn, serverAddr netip.AddrPort, request []byte, parse func(packet []byte) ([]netip.Addr, bool)) ([]netip.Addr, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	destination := net.UDPAddrFromAddrPort(serverAddr)
+	buffer := buf.NewSize(dns.MaxMsgSize)
+	defer buffer.Release()
+	for {
+		_, err := conn.WriteTo(request, destination)
+		if err != nil {
+			return nil, E.Errors(err, ctx.Err())
+		}
+		conn.SetReadDeadline(time.Now().Add(dhcpRetransmitInterval))
+		for {
+			buffer.Reset()
+			n, _, err := conn.ReadFrom(buffer.FreeBytes())
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				return nil, err
+			}
+			servers, loaded := parse(buffer.FreeBytes()[:n])
+			if !loaded {
+				continue
+			}
+			if len(servers) == 0 {
+				return nil, E.New("no DNS servers in DHCP reply")
+			}
+			return servers, nil
+		}
+	}
+}
+
+func buildDHCPv4Inform(transactionID [4]byte, clientAddr netip.Addr, hardwareAddr net.HardwareAddr) []byte {
+	packet := make([]byte, dhcpv4HeaderLen, dhcpv4HeaderLen+16)
+	packet[0] = dhcpv4OpRequest
+	packet[1] = 1
+	packet[2] = byte(len(hardwareAddr))
+	copy(packet[4:8], transactionID[:])
+	clientAddr4 := clientAddr.As4()
+	copy(packet[12:16], clientAddr4[:])
+	copy(packet[28:44], hardwareAddr)
+	packet = append(packet, dhcpv4MagicCookie...)
+	packet = append(packet, dhcpv4OptionMessageType, 1, dhcpv4MessageInform)
+	packet = append(packet, dhcpv4OptionParams, 1, dhcpv4OptionDNS)
+	packet = append(packet, dhcpv4OptionEnd)
+	return packet
+}
+
+func parseDHCPv4Reply(packet []byte, transactionID [4]byte) ([]netip.Addr, bool) {
+	if len(packet) < dhcpv4HeaderLen+len(dhcpv4MagicCookie) || packet[0] != dhcpv4OpReply {
+		return nil, false
+	}
+	if !bytes.Equal(packet[4:8], transactionID[:]) || !bytes.Equal(packet[dhcpv4HeaderLen:dhcpv4HeaderLen+4], dhcpv4MagicCookie) {
+		return nil, false
+	}
+	var (
+		messageType byte
+		servers     []netip.Addr
+	)
+	options := packet[dhcpv4HeaderLen+4:]
+	for len(options) > 0 {
+		code := options[0]
+		if code == dhcpv4OptionPad {
+			options = options[1:]
+			continue
+		}
+		if code == dhcpv4OptionEnd || len(options) < 2 || len(options) < 2+int(options[1]) {
+			break
+		}
+		value := options[2 : 2+int(options[1])]
+		options = options[2+len(value):]
+		switch code {
+		case dhcpv4OptionMessageType:
+			if len(value) == 1 {
+				messageType = value[0]
+			}
+		case dhcpv4OptionDNS:
+			for ; len(value) >= 4; value = value[4:] {
+				servers = append(servers, netip.AddrFrom4([4]byte(value[:4])))
+			}
+		}
+	}
+	if messageType != dhcpv4MessageACK {
+		return nil, false
+	}
+	return servers, true
+}
+
+func buildDHCPv6InformationRequest(transactionID [3]byte, hardwareAddr net.HardwareAddr) []byte {
+	packet := []byte{dhcpv6MessageInfoRequest}
+	packet = append(packet, transactionID[:]...)
+	if len(hardwareAddr) > 0 {
+		packet = binary.BigEndian.AppendUint16(packet, dhcpv6OptionClientID)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(4+len(hardwareAddr)))
+		packet = binary.BigEndian.AppendUint16(packet, 3)
+		packet = binary.BigEndian.AppendUint16(packet, 1)
+		packet = append(packet, hardwareAddr...)
+	}
+	packet = binary.BigEndian.AppendUint16(packet, dhcpv6OptionORO)
+	packet = binary.BigEndian.AppendUint16(packet, 2)
+	packet = binary.BigEndian.AppendUint16(packet, dhcpv6OptionDNSServers)
+	packet = binary.BigEndian.AppendUint16(packet, dhcpv6OptionElapsedTime)
+	packet = binary.BigEndian.AppendUint16(packet, 2)
+	packet = binary.BigEndian.AppendUint16(packet, 0)
+	return packet
+}
+
+func parseDHCPv6Reply(packet []byte, transactionID [3]byte) ([]netip.Addr, bool) {
+	if len(packet) < 4 || packet[0] != dhcpv6MessageReply || !bytes.Equal(packet[1:4], transactionID[:]) {
+		return nil, false
+	}
+	var servers []netip.Addr
+	options := packet[4:]
+	for len(options) >= 4 {
+		code := binary.BigEndian.Uint16(options)
+		length := int(binary.BigEndian.Uint16(options[2:]))
+		if len(options) < 4+length {
+			break
+		}
+		value := options[4 : 4+length]
+		options = options[4+length:]
+		if code == dhcpv6OptionDNSServers {
+			for ; len(value) >= 16; value = value[16:] {
+				servers = append(servers, netip.AddrFrom16([16]byte(value[:16])))
+			}
+		}
+	}
+	return servers, true
+}
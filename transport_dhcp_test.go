@@ -0,0 +1,134 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type redirectDialer struct {
+	N.Dialer
+	destinations map[M.Socksaddr]M.Socksaddr
+}
+
+func (d *redirectDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if redirect, loaded := d.destinations[destination]; loaded {
+		destination = redirect
+	}
+	return d.Dialer.DialContext(ctx, network, destination)
+}
+
+func startFixedUDPServer(t *testing.T, address netip.Addr) M.Socksaddr {
+	dnsServer, err := server.NewServer(server.Options{
+		Logger: logger.NOP(),
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{address}, 300), nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		dnsServer.Close()
+	})
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go dnsServer.ServeUDP(packetConn)
+	return M.SocksaddrFromNet(packetConn.LocalAddr())
+}
+
+func startDHCPv4Responder(t *testing.T, dnsServer *atomic.Pointer[netip.Addr], requests *atomic.Int32) netip.AddrPort {
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, source, err := conn.ReadFromUDPAddrPort(buffer)
+			if err != nil {
+				return
+			}
+			request := buffer[:n]
+			if len(request) < 244 || request[0] != 1 || request[240] != 53 || request[242] != 8 {
+				continue
+			}
+			requests.Add(1)
+			reply := make([]byte, 240)
+			reply[0] = 2
+			copy(reply[4:8], request[4:8])
+			copy(reply[12:16], request[12:16])
+			copy(reply[236:240], request[236:240])
+			serverAddr := dnsServer.Load().As4()
+			reply = append(reply, 53, 1, 5, 6, 4)
+			reply = append(reply, serverAddr[:]...)
+			reply = append(reply, 255)
+			conn.WriteToUDPAddrPort(reply, source)
+		}
+	}()
+	return netip.MustParseAddrPort(conn.LocalAddr().String())
+}
+
+func loopbackInterface(t *testing.T) string {
+	interfaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestDHCPTransport(t *testing.T) {
+	t.Parallel()
+	firstServer := netip.MustParseAddr("127.0.0.1")
+	secondServer := netip.MustParseAddr("127.0.0.2")
+	dialer := &redirectDialer{
+		Dialer: N.SystemDialer,
+		destinations: map[M.Socksaddr]M.Socksaddr{
+			M.SocksaddrFrom(firstServer, 53):  startFixedUDPServer(t, netip.MustParseAddr("1.1.1.1")),
+			M.SocksaddrFrom(secondServer, 53): startFixedUDPServer(t, netip.MustParseAddr("2.2.2.2")),
+		},
+	}
+	var (
+		dnsServer atomic.Pointer[netip.Addr]
+		requests  atomic.Int32
+	)
+	dnsServer.Store(&firstServer)
+	responderAddr := startDHCPv4Responder(t, &dnsServer, &requests)
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  dialer,
+		Address: "dhcp://" + loopbackInterface(t) + "?server=" + responderAddr.String(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.True(t, transport.Raw())
+
+	for i := 0; i < 2; i++ {
+		response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, "1.1.1.1", response.Answer[0].(*mDNS.A).A.String())
+	}
+	require.Equal(t, int32(1), requests.Load())
+
+	dnsServer.Store(&secondServer)
+	transport.Reset()
+	response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, "2.2.2.2", response.Answer[0].(*mDNS.A).A.String())
+	require.Equal(t, int32(2), requests.Load())
+}
@@ -0,0 +1,550 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+const (
+	DNSCryptVersionXSalsa20Poly1305  = 0x0001
+	DNSCryptVersionXChacha20Poly1305 = 0x0002
+)
+
+const (
+	dnsCryptCertMagic     = "DNSC"
+	dnsCryptResolverMagic = "r6fnvWj8"
+	dnsCryptMinQueryLen   = 256
+	dnsCryptCertLen       = 124
+	dnsCryptHalfNonceLen  = 12
+	dnsCryptNonceLen      = 24
+	dnsCryptRefreshMargin = time.Hour
+)
+
+var _ Transport = (*DNSCryptTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"dnscrypt"}, func(options TransportOptions) (Transport, error) {
+		return NewDNSCryptTransport(options)
+	})
+}
+
+type DNSCryptTransport struct {
+	name          string
+	dialer        N.Dialer
+	logger        logger.ContextLogger
+	serverAddr    M.Socksaddr
+	providerName  string
+	providerKey   ed25519.PublicKey
+	certTransport *UDPTransport
+	access        sync.Mutex
+	cert          *dnsCryptCert
+}
+
+type dnsCryptCert struct {
+	version           uint16
+	resolverPublicKey [32]byte
+	clientMagic       [8]byte
+	serial            uint32
+	notBefore         time.Time
+	notAfter          time.Time
+	refreshAt         time.Time
+	clientPublicKey   [32]byte
+	sharedKey         [32]byte
+}
+
+func NewDNSCryptTransport(options TransportOptions) (*DNSCryptTransport, error) {
+	var (
+		serverAddr   M.Socksaddr
+		providerName string
+		providerKey  ed25519.PublicKey
+	)
+	if strings.HasPrefix(options.Address, "sdns://") {
+		stamp, err := ParseStamp(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		if stamp.Protocol != StampProtocolDNSCrypt {
+			return nil, E.New("unsupported stamp protocol: ", stamp.Protocol)
+		}
+		serverAddr = M.ParseSocksaddr(stamp.ServerAddr)
+		providerName = stamp.ProviderName
+		providerKey = stamp.ServerPublicKey
+	} else {
+		serverURL, err := url.Parse(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		serverAddr = M.ParseSocksaddr(serverURL.Host)
+		query := serverURL.Query()
+		providerName = query.Get("provider_name")
+		if providerName == "" {
+			return nil, E.New("missing provider_name")
+		}
+		providerKey, err = hex.DecodeString(strings.ReplaceAll(query.Get("public_key"), ":", ""))
+		if err != nil {
+			return nil, E.Cause(err, "parse public_key")
+		}
+		if len(providerKey) != ed25519.PublicKeySize {
+			return nil, E.New("invalid public_key length: ", len(providerKey))
+		}
+	}
+	if !serverAddr.IsValid() {
+		return nil, E.New("invalid server address")
+	}
+	if serverAddr.Port == 0 {
+		serverAddr.Port = 443
+	}
+	certTransport, err := NewUDPTransport(TransportOptions{
+		Context: options.Context,
+		Logger:  options.Logger,
+		Name:    options.Name,
+		Dialer:  options.Dialer,
+		Address: serverAddr.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DNSCryptTransport{
+		name:          options.Name,
+		dialer:        options.Dialer,
+		logger:        options.Logger,
+		serverAddr:    serverAddr,
+		providerName:  dns.Fqdn(providerName),
+		providerKey:   providerKey,
+		certTransport: certTransport,
+	}, nil
+}
+
+func (t *DNSCryptTransport) Name() string {
+	return t.name
+}
+
+func (t *DNSCryptTransport) Start() error {
+	return nil
+}
+
+func (t *DNSCryptTransport) Reset() {
+	t.access.Lock()
+	t.cert = nil
+	t.access.Unlock()
+	t.certTransport.Reset()
+}
+
+func (t *DNSCryptTransport) Close() error {
+	return t.certTransport.Close()
+}
+
+func (t *DNSCryptTransport) Raw() bool {
+	return true
+}
+
+func (t *DNSCryptTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	cert, err := t.loadCert(ctx)
+	if err != nil {
+		return nil, E.Cause(err, "fetch DNSCrypt certificate")
+	}
+	response, err := t.exchange(ctx, cert, message, N.NetworkUDP)
+	if err != nil {
+		return nil, err
+	}
+	if response.Truncated {
+		if t.logger != nil {
+			t.logger.InfoContext(ctx, "response truncated, retrying with TCP")
+		}
+		return t.exchange(ctx, cert, message, N.NetworkTCP)
+	}
+	return response, nil
+}
+
+func (t *DNSCryptTransport) exchange(ctx context.Context, cert *dnsCryptCert, message *dns.Msg, network string) (*dns.Msg, error) {
+	exMessage := *message
+	exMessage.Compress = true
+	rawQuery, err := exMessage.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var minQueryLen int
+	if network == N.NetworkUDP {
+		minQueryLen = dnsCryptMinQueryLen
+	}
+	encryptedQuery, clientNonce, err := cert.encryptQuery(rawQuery, minQueryLen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.dialer.DialContext(ctx, network, t.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	var encryptedResponse []byte
+	if network == N.NetworkUDP {
+		_, err = conn.Write(encryptedQuery)
+		if err != nil {
+			return nil, err
+		}
+		buffer := buf.NewSize(dns.MaxMsgSize)
+		defer buffer.Release()
+		_, err = buffer.ReadOnceFrom(conn)
+		if err != nil {
+			return nil, E.Errors(err, ctx.Err())
+		}
+		encryptedResponse = buffer.Bytes()
+	} else {
+		encryptedResponse, err = exchangeDNSCryptStream(conn, encryptedQuery)
+		if err != nil {
+			return nil, E.Errors(err, ctx.Err())
+		}
+	}
+	rawResponse, err := cert.decryptResponse(encryptedResponse, clientNonce)
+	if err != nil {
+		return nil, err
+	}
+	var response dns.Msg
+	err = response.Unpack(rawResponse)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func exchangeDNSCryptStream(conn net.Conn, encryptedQuery []byte) ([]byte, error) {
+	buffer := buf.NewSize(2 + len(encryptedQuery))
+	defer buffer.Release()
+	binary.BigEndian.PutUint16(buffer.Extend(2), uint16(len(encryptedQuery)))
+	copy(buffer.Extend(len(encryptedQuery)), encryptedQuery)
+	_, err := conn.Write(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var responseLen uint16
+	err = binary.Read(conn, binary.BigEndian, &responseLen)
+	if err != nil {
+		return nil, err
+	}
+	encryptedResponse := make([]byte, responseLen)
+	_, err = io.ReadFull(conn, encryptedResponse)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedResponse, nil
+}
+
+func (t *DNSCryptTransport) loadCert(ctx context.Context) (*dnsCryptCert, error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.cert != nil && time.Now().Before(t.cert.refreshAt) {
+		return t.cert, nil
+	}
+	cert, err := t.fetchCert(ctx)
+	if err != nil {
+		if t.cert != nil && time.Now().Before(t.cert.notAfter) {
+			if t.logger != nil {
+				t.logger.WarnContext(ctx, "refresh DNSCrypt certificate: ", err)
+			}
+			return t.cert, nil
+		}
+		return nil, err
+	}
+	if t.logger != nil {
+		t.logger.DebugContext(ctx, "loaded DNSCrypt certificate ", cert.serial, " for ", t.providerName, ", valid until ", cert.notAfter.Format(time.RFC3339))
+	}
+	t.cert = cert
+	return cert, nil
+}
+
+func (t *DNSCryptTransport) fetchCert(ctx context.Context) (*dnsCryptCert, error) {
+	message := new(dns.Msg)
+	message.SetQuestion(t.providerName, dns.TypeTXT)
+	response, err := t.certTransport.Exchange(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return nil, RCodeError(response.Rcode)
+	}
+	var (
+		selected   *dnsCryptCert
+		certErrors []error
+	)
+	timeNow := time.Now()
+	for _, record := range response.Answer {
+		txtRecord, isTXT := record.(*dns.TXT)
+		if !isTXT {
+			continue
+		}
+		rawCert, err := unescapeTXT(strings.Join(txtRecord.Txt, ""))
+		if err != nil {
+			certErrors = append(certErrors, err)
+			continue
+		}
+		cert, err := parseDNSCryptCert(rawCert, t.providerKey)
+		if err != nil {
+			certErrors = append(certErrors, err)
+			continue
+		}
+		if timeNow.Before(cert.notBefore) || !timeNow.Before(cert.notAfter) {
+			certErrors = append(certErrors, E.New("certificate ", cert.serial, " not valid now"))
+			continue
+		}
+		if selected == nil || cert.serial > selected.serial || cert.serial == selected.serial && cert.version > selected.version {
+			selected = cert
+		}
+	}
+	if selected == nil {
+		if len(certErrors) > 0 {
+			return nil, E.Errors(certErrors...)
+		}
+		return nil, E.New("no certificate found")
+	}
+	refreshMargin := selected.notAfter.Sub(timeNow) / 2
+	if refreshMargin > dnsCryptRefreshMargin {
+		refreshMargin = dnsCryptRefreshMargin
+	}
+	selected.refreshAt = selected.notAfter.Add(-refreshMargin)
+	err = selected.generateKey()
+	if err != nil {
+		return nil, err
+	}
+	return selected, nil
+}
+
+func parseDNSCryptCert(rawCert []byte, providerKey ed25519.PublicKey) (*dnsCryptCert, error) {
+	if len(rawCert) < dnsCryptCertLen {
+		return nil, E.New("invalid certificate length: ", len(rawCert))
+	}
+	if string(rawCert[:4]) != dnsCryptCertMagic {
+		return nil, E.New("invalid certificate magic")
+	}
+	cert := &dnsCryptCert{
+		version: binary.BigEndian.Uint16(rawCert[4:6]),
+	}
+	switch cert.version {
+	case DNSCryptVersionXSalsa20Poly1305, DNSCryptVersionXChacha20Poly1305:
+	default:
+		return nil, E.New("unsupported certificate version: ", cert.version)
+	}
+	if binary.BigEndian.Uint16(rawCert[6:8]) != 0 {
+		return nil, E.New("unsupported certificate minor version")
+	}
+	if !ed25519.Verify(providerKey, rawCert[72:], rawCert[8:72]) {
+		return nil, E.New("invalid certificate signature")
+	}
+	copy(cert.resolverPublicKey[:], rawCert[72:104])
+	copy(cert.clientMagic[:], rawCert[104:112])
+	cert.serial = binary.BigEndian.Uint32(rawCert[112:116])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(rawCert[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(rawCert[120:124])), 0)
+	return cert, nil
+}
+
+func (c *dnsCryptCert) generateKey() error {
+	clientPublicKey, clientPrivateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	c.clientPublicKey = *clientPublicKey
+	switch c.version {
+	case DNSCryptVersionXSalsa20Poly1305:
+		box.Precompute(&c.sharedKey, &c.resolverPublicKey, clientPrivateKey)
+	case DNSCryptVersionXChacha20Poly1305:
+		sharedSecret, err := curve25519.X25519(clientPrivateKey[:], c.resolverPublicKey[:])
+		if err != nil {
+			return err
+		}
+		sharedKey, err := chacha20.HChaCha20(sharedSecret, make([]byte, 16))
+		if err != nil {
+			return err
+		}
+		copy(c.sharedKey[:], sharedKey)
+	}
+	return nil
+}
+
+func (c *dnsCryptCert) encryptQuery(rawQuery []byte, minQueryLen int) (encryptedQuery []byte, clientNonce []byte, err error) {
+	var nonce [dnsCryptNonceLen]byte
+	_, err = rand.Read(nonce[:dnsCryptHalfNonceLen])
+	if err != nil {
+		return
+	}
+	paddedLen := (len(rawQuery) + 1 + 63) / 64 * 64
+	if paddedLen < minQueryLen {
+		paddedLen = minQueryLen
+	}
+	paddedQuery := make([]byte, paddedLen)
+	copy(paddedQuery, rawQuery)
+	paddedQuery[len(rawQuery)] = 0x80
+	encryptedQuery = make([]byte, 0, len(c.clientMagic)+len(c.clientPublicKey)+dnsCryptHalfNonceLen+paddedLen+secretbox.Overhead)
+	encryptedQuery = append(encryptedQuery, c.clientMagic[:]...)
+	encryptedQuery = append(encryptedQuery, c.clientPublicKey[:]...)
+	encryptedQuery = append(encryptedQuery, nonce[:dnsCryptHalfNonceLen]...)
+	switch c.version {
+	case DNSCryptVersionXSalsa20Poly1305:
+		encryptedQuery = secretbox.Seal(encryptedQuery, paddedQuery, &nonce, &c.sharedKey)
+	case DNSCryptVersionXChacha20Poly1305:
+		encryptedQuery, err = xsecretboxSeal(encryptedQuery, paddedQuery, &nonce, &c.sharedKey)
+		if err != nil {
+			return
+		}
+	}
+	clientNonce = nonce[:dnsCryptHalfNonceLen]
+	return
+}
+
+func (c *dnsCryptCert) decryptResponse(encryptedResponse []byte, clientNonce []byte) ([]byte, error) {
+	headerLen := len(dnsCryptResolverMagic) + dnsCryptNonceLen
+	if len(encryptedResponse) < headerLen+secretbox.Overhead {
+		return nil, E.New("invalid DNSCrypt response length")
+	}
+	if string(encryptedResponse[:len(dnsCryptResolverMagic)]) != dnsCryptResolverMagic {
+		return nil, E.New("invalid DNSCrypt response magic")
+	}
+	var nonce [dnsCryptNonceLen]byte
+	copy(nonce[:], encryptedResponse[len(dnsCryptResolverMagic):headerLen])
+	if !bytes.Equal(nonce[:dnsCryptHalfNonceLen], clientNonce) {
+		return nil, E.New("unexpected DNSCrypt response nonce")
+	}
+	var (
+		paddedResponse []byte
+		err            error
+	)
+	switch c.version {
+	case DNSCryptVersionXSalsa20Poly1305:
+		var loaded bool
+		paddedResponse, loaded = secretbox.Open(nil, encryptedResponse[headerLen:], &nonce, &c.sharedKey)
+		if !loaded {
+			err = E.New("message authentication failed")
+		}
+	case DNSCryptVersionXChacha20Poly1305:
+		paddedResponse, err = xsecretboxOpen(nil, encryptedResponse[headerLen:], &nonce, &c.sharedKey)
+	}
+	if err != nil {
+		return nil, E.Cause(err, "decrypt DNSCrypt response")
+	}
+	return unpadDNSCrypt(paddedResponse)
+}
+
+func xsecretboxSeal(out []byte, message []byte, nonce *[dnsCryptNonceLen]byte, key *[32]byte) ([]byte, error) {
+	cipher, err := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	var authKey [32]byte
+	cipher.XORKeyStream(authKey[:], authKey[:])
+	ret, output := sliceForAppend(out, poly1305.TagSize+len(message))
+	cipher.XORKeyStream(output[poly1305.TagSize:], message)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, output[poly1305.TagSize:], &authKey)
+	copy(output, tag[:])
+	return ret, nil
+}
+
+func xsecretboxOpen(out []byte, box []byte, nonce *[dnsCryptNonceLen]byte, key *[32]byte) ([]byte, error) {
+	if len(box) < poly1305.TagSize {
+		return nil, E.New("message too short")
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	var authKey [32]byte
+	cipher.XORKeyStream(authKey[:], authKey[:])
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], box)
+	if !poly1305.Verify(&tag, box[poly1305.TagSize:], &authKey) {
+		return nil, E.New("message authentication failed")
+	}
+	ret, output := sliceForAppend(out, len(box)-poly1305.TagSize)
+	cipher.XORKeyStream(output, box[poly1305.TagSize:])
+	return ret, nil
+}
+
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+func unpadDNSCrypt(paddedMessage []byte) ([]byte, error) {
+	index := bytes.LastIndexByte(paddedMessage, 0x80)
+	if index < 0 {
+		return nil, E.New("invalid DNSCrypt padding")
+	}
+	for _, b := range paddedMessage[index+1:] {
+		if b != 0 {
+			return nil, E.New("invalid DNSCrypt padding")
+		}
+	}
+	return paddedMessage[:index], nil
+}
+
+func unescapeTXT(text string) ([]byte, error) {
+	output := make([]byte, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			output = append(output, text[i])
+			continue
+		}
+		i++
+		if i >= len(text) {
+			return nil, E.New("invalid escape in TXT record")
+		}
+		if text[i] >= '0' && text[i] <= '9' {
+			if i+3 > len(text) {
+				return nil, E.New("invalid escape in TXT record")
+			}
+			value, err := strconv.ParseUint(text[i:i+3], 10, 8)
+			if err != nil {
+				return nil, E.New("invalid escape in TXT record")
+			}
+			output = append(output, byte(value))
+			i += 2
+		} else {
+			output = append(output, text[i])
+		}
+	}
+	return output, nil
+}
+
+func (t *DNSCryptTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
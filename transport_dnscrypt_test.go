@@ -0,0 +1,438 @@
+package dns_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+type dnsCryptTestServer struct {
+	providerName string
+	providerKey  ed25519.PrivateKey
+	version      uint16
+	truncate     bool
+	certFetches  atomic.Int32
+	access       sync.Mutex
+	serial       uint32
+	certLifetime time.Duration
+	resolverKey  *[32]byte
+	clientMagic  [8]byte
+	packetConn   net.PacketConn
+	listener     net.Listener
+}
+
+func newDNSCryptTestServer(t *testing.T, version uint16, truncate bool, certLifetime time.Duration) *dnsCryptTestServer {
+	_, providerKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	server := &dnsCryptTestServer{
+		providerName: "2.dnscrypt-cert.example.com.",
+		providerKey:  providerKey,
+		version:      version,
+		truncate:     truncate,
+		certLifetime: certLifetime,
+	}
+	server.packetConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server.listener, err = net.Listen("tcp", server.packetConn.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		server.packetConn.Close()
+		server.listener.Close()
+	})
+	go server.serveUDP()
+	go server.serveTCP()
+	return server
+}
+
+func (s *dnsCryptTestServer) stamp() string {
+	rawStamp := []byte{byte(dns.StampProtocolDNSCrypt)}
+	rawStamp = binary.LittleEndian.AppendUint64(rawStamp, dns.StampPropertyNoLog)
+	for _, value := range [][]byte{
+		[]byte(s.packetConn.LocalAddr().String()),
+		s.providerKey.Public().(ed25519.PublicKey),
+		[]byte(strings.TrimSuffix(s.providerName, ".")),
+	} {
+		rawStamp = append(rawStamp, byte(len(value)))
+		rawStamp = append(rawStamp, value...)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(rawStamp)
+}
+
+func (s *dnsCryptTestServer) rotateCert() []byte {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.serial++
+	var err error
+	_, s.resolverKey, err = box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	_, err = rand.Read(s.clientMagic[:])
+	if err != nil {
+		panic(err)
+	}
+	resolverPublicKey, err := curve25519.X25519(s.resolverKey[:], curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	signed := append([]byte(nil), resolverPublicKey...)
+	signed = append(signed, s.clientMagic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, s.serial)
+	timeNow := time.Now()
+	signed = binary.BigEndian.AppendUint32(signed, uint32(timeNow.Add(-time.Minute).Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(timeNow.Add(s.certLifetime).Unix()))
+	rawCert := []byte("DNSC")
+	rawCert = binary.BigEndian.AppendUint16(rawCert, s.version)
+	rawCert = binary.BigEndian.AppendUint16(rawCert, 0)
+	rawCert = append(rawCert, ed25519.Sign(s.providerKey, signed)...)
+	return append(rawCert, signed...)
+}
+
+func dnsCryptSharedKey(version uint16, resolverKey *[32]byte, clientPublicKey []byte) *[32]byte {
+	var sharedKey [32]byte
+	if version == dns.DNSCryptVersionXSalsa20Poly1305 {
+		var publicKey [32]byte
+		copy(publicKey[:], clientPublicKey)
+		box.Precompute(&sharedKey, &publicKey, resolverKey)
+	} else {
+		sharedSecret, err := curve25519.X25519(resolverKey[:], clientPublicKey)
+		if err != nil {
+			panic(err)
+		}
+		key, err := chacha20.HChaCha20(sharedSecret, make([]byte, 16))
+		if err != nil {
+			panic(err)
+		}
+		copy(sharedKey[:], key)
+	}
+	return &sharedKey
+}
+
+func xsecretboxStream(nonce *[24]byte, key *[32]byte, data []byte) (authKey [32]byte, output []byte) {
+	subKey, err := chacha20.HChaCha20(key[:], nonce[:16])
+	if err != nil {
+		panic(err)
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(subKey, append(make([]byte, 4), nonce[16:]...))
+	if err != nil {
+		panic(err)
+	}
+	block := make([]byte, 32+len(data))
+	copy(block[32:], data)
+	cipher.XORKeyStream(block, block)
+	copy(authKey[:], block)
+	return authKey, block[32:]
+}
+
+func xsecretboxSeal(message []byte, nonce *[24]byte, key *[32]byte) []byte {
+	authKey, encrypted := xsecretboxStream(nonce, key, message)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, encrypted, &authKey)
+	return append(tag[:], encrypted...)
+}
+
+func xsecretboxOpen(box []byte, nonce *[24]byte, key *[32]byte) ([]byte, bool) {
+	if len(box) < poly1305.TagSize {
+		return nil, false
+	}
+	authKey, message := xsecretboxStream(nonce, key, box[poly1305.TagSize:])
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], box)
+	if !poly1305.Verify(&tag, box[poly1305.TagSize:], &authKey) {
+		return nil, false
+	}
+	return message, true
+}
+
+func (s *dnsCryptTestServer) handle(rawMessage []byte, network string) []byte {
+	s.access.Lock()
+	clientMagic := s.clientMagic
+	s.access.Unlock()
+	if len(rawMessage) > 8 && bytes.Equal(rawMessage[:8], clientMagic[:]) {
+		return s.handleEncrypted(rawMessage, network)
+	}
+	var message mDNS.Msg
+	err := message.Unpack(rawMessage)
+	if err != nil || message.Question[0].Name != s.providerName || message.Question[0].Qtype != mDNS.TypeTXT {
+		return nil
+	}
+	s.certFetches.Add(1)
+	rawCert := s.rotateCert()
+	var escapedCert strings.Builder
+	for _, b := range rawCert {
+		fmt.Fprintf(&escapedCert, "\\%03d", b)
+	}
+	response := new(mDNS.Msg)
+	response.SetReply(&message)
+	response.Answer = []mDNS.RR{&mDNS.TXT{
+		Hdr: mDNS.RR_Header{
+			Name:   s.providerName,
+			Rrtype: mDNS.TypeTXT,
+			Class:  mDNS.ClassINET,
+			Ttl:    86400,
+		},
+		Txt: []string{escapedCert.String()},
+	}}
+	rawResponse, err := response.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return rawResponse
+}
+
+func (s *dnsCryptTestServer) handleEncrypted(rawMessage []byte, network string) []byte {
+	s.access.Lock()
+	defer s.access.Unlock()
+	clientPublicKey := rawMessage[8:40]
+	var nonce [24]byte
+	copy(nonce[:12], rawMessage[40:52])
+	sharedKey := dnsCryptSharedKey(s.version, s.resolverKey, clientPublicKey)
+	var (
+		paddedQuery []byte
+		err         error
+	)
+	if s.version == dns.DNSCryptVersionXSalsa20Poly1305 {
+		var loaded bool
+		paddedQuery, loaded = secretbox.Open(nil, rawMessage[52:], &nonce, sharedKey)
+		if !loaded {
+			return nil
+		}
+	} else {
+		var loaded bool
+		paddedQuery, loaded = xsecretboxOpen(rawMessage[52:], &nonce, sharedKey)
+		if !loaded {
+			return nil
+		}
+	}
+	if network == "udp" && len(paddedQuery) < 256 {
+		return nil
+	}
+	var query mDNS.Msg
+	err = query.Unpack(paddedQuery[:bytes.LastIndexByte(paddedQuery, 0x80)])
+	if err != nil {
+		return nil
+	}
+	response := dns.FixedResponse(query.Id, query.Question[0], []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 300)
+	if network == "udp" && s.truncate {
+		response.Answer = nil
+		response.Truncated = true
+	}
+	rawResponse, err := response.Pack()
+	if err != nil {
+		panic(err)
+	}
+	paddedResponse := make([]byte, (len(rawResponse)+1+63)/64*64)
+	copy(paddedResponse, rawResponse)
+	paddedResponse[len(rawResponse)] = 0x80
+	_, err = rand.Read(nonce[12:])
+	if err != nil {
+		panic(err)
+	}
+	encryptedResponse := append([]byte("r6fnvWj8"), nonce[:]...)
+	if s.version == dns.DNSCryptVersionXSalsa20Poly1305 {
+		return secretbox.Seal(encryptedResponse, paddedResponse, &nonce, sharedKey)
+	}
+	return append(encryptedResponse, xsecretboxSeal(paddedResponse, &nonce, sharedKey)...)
+}
+
+func (s *dnsCryptTestServer) serveUDP() {
+	buffer := make([]byte, mDNS.MaxMsgSize)
+	for {
+		n, addr, err := s.packetConn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		response := s.handle(buffer[:n], "udp")
+		if response != nil {
+			s.packetConn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *dnsCryptTestServer) serveTCP() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length uint16
+			err := binary.Read(conn, binary.BigEndian, &length)
+			if err != nil {
+				return
+			}
+			rawMessage := make([]byte, length)
+			_, err = io.ReadFull(conn, rawMessage)
+			if err != nil {
+				return
+			}
+			response := s.handle(rawMessage, "tcp")
+			if response == nil {
+				return
+			}
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+		}()
+	}
+}
+
+func TestDNSCryptTransport(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		name     string
+		version  uint16
+		truncate bool
+	}{
+		{"xsalsa20poly1305", dns.DNSCryptVersionXSalsa20Poly1305, false},
+		{"xchacha20poly1305", dns.DNSCryptVersionXChacha20Poly1305, false},
+		{"tcp fallback", dns.DNSCryptVersionXChacha20Poly1305, true},
+	} {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			server := newDNSCryptTestServer(t, testCase.version, testCase.truncate, time.Hour)
+			transport, err := dns.CreateTransport(dns.TransportOptions{
+				Context: context.Background(),
+				Logger:  logger.NOP(),
+				Dialer:  N.SystemDialer,
+				Address: server.stamp(),
+			})
+			require.NoError(t, err)
+			defer transport.Close()
+			for i := 0; i < 2; i++ {
+				response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+				require.NoError(t, err)
+				require.False(t, response.Truncated)
+				require.Len(t, response.Answer, 1)
+				require.Equal(t, "1.1.1.1", response.Answer[0].(*mDNS.A).A.String())
+			}
+			require.Equal(t, int32(1), server.certFetches.Load())
+		})
+	}
+}
+
+func TestDNSCryptXSecretBox(t *testing.T) {
+	t.Parallel()
+	var resolverKey, clientKey [32]byte
+	var nonce [24]byte
+	for i := range resolverKey {
+		resolverKey[i] = byte(i)
+		clientKey[i] = byte(32 + i)
+	}
+	for i := range nonce {
+		nonce[i] = byte(64 + i)
+	}
+	clientPublicKey, err := curve25519.X25519(clientKey[:], curve25519.Basepoint)
+	require.NoError(t, err)
+	require.Equal(t, "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254", hex.EncodeToString(clientPublicKey))
+	sharedKey := dnsCryptSharedKey(dns.DNSCryptVersionXChacha20Poly1305, &resolverKey, clientPublicKey)
+	require.Equal(t, "f829d921c627acb72402ac20fb0d9353fe184bf3a042933e305be08fcc25d07e", hex.EncodeToString(sharedKey[:]))
+	message := []byte("sing-dns xsecretbox known answer test message, long enough to span more than one chacha20 block!!")
+	sealed := xsecretboxSeal(message, &nonce, sharedKey)
+	require.Equal(t, "885676c98124f670f3cccbcfcefb3112a7a40e9dee0abc351b2d4e22bbf0edb0"+
+		"9d01eecc4bbc31d157819bead7bef5fe8de3a08fe24b2d7cb229a379d9bed4d8"+
+		"b0610b22c8ca6d646ffe1c285653e0f8439db08bc101f5d54d35900156a38f36"+
+		"b110a64e48a8a2401785b4444ae7fe1364", hex.EncodeToString(sealed))
+	opened, loaded := xsecretboxOpen(sealed, &nonce, sharedKey)
+	require.True(t, loaded)
+	require.Equal(t, message, opened)
+	sealed[0] ^= 1
+	_, loaded = xsecretboxOpen(sealed, &nonce, sharedKey)
+	require.False(t, loaded)
+}
+
+func TestDNSCryptTransportAddress(t *testing.T) {
+	t.Parallel()
+	server := newDNSCryptTestServer(t, dns.DNSCryptVersionXChacha20Poly1305, false, time.Hour)
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "dnscrypt://" + server.packetConn.LocalAddr().String() + "?" + url.Values{
+			"provider_name": {server.providerName},
+			"public_key":    {hex.EncodeToString(server.providerKey.Public().(ed25519.PublicKey))},
+		}.Encode(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	_, err = dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "dnscrypt://127.0.0.1?provider_name=2.dnscrypt-cert.example.com&public_key=00",
+	})
+	require.Error(t, err)
+}
+
+func TestDNSCryptTransportRotateCert(t *testing.T) {
+	t.Parallel()
+	server := newDNSCryptTestServer(t, dns.DNSCryptVersionXChacha20Poly1305, false, 4*time.Second)
+	transport, err := dns.NewDNSCryptTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: server.stamp(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	_, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	time.Sleep(2500 * time.Millisecond)
+	response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, int32(2), server.certFetches.Load())
+}
+
+func TestParseStamp(t *testing.T) {
+	t.Parallel()
+	publicKey := bytes.Repeat([]byte{0x42}, 32)
+	rawStamp := []byte{byte(dns.StampProtocolDNSCrypt)}
+	rawStamp = binary.LittleEndian.AppendUint64(rawStamp, dns.StampPropertyDNSSEC|dns.StampPropertyNoLog)
+	rawStamp = append(rawStamp, byte(len("149.112.112.10:8443")))
+	rawStamp = append(rawStamp, "149.112.112.10:8443"...)
+	rawStamp = append(rawStamp, byte(len(publicKey)))
+	rawStamp = append(rawStamp, publicKey...)
+	rawStamp = append(rawStamp, byte(len("2.dnscrypt-cert.quad9.net")))
+	rawStamp = append(rawStamp, "2.dnscrypt-cert.quad9.net"...)
+	stamp, err := dns.ParseStamp("sdns://" + base64.RawURLEncoding.EncodeToString(rawStamp))
+	require.NoError(t, err)
+	require.Equal(t, dns.StampProtocolDNSCrypt, stamp.Protocol)
+	require.Equal(t, dns.StampPropertyDNSSEC|dns.StampPropertyNoLog, stamp.Props)
+	require.Equal(t, "149.112.112.10:8443", stamp.ServerAddr)
+	require.Equal(t, publicKey, stamp.ServerPublicKey)
+	require.Equal(t, "2.dnscrypt-cert.quad9.net", stamp.ProviderName)
+	_, err = dns.ParseStamp("sdns://" + base64.RawURLEncoding.EncodeToString(rawStamp[:len(rawStamp)-1]))
+	require.Error(t, err)
+	_, err = dns.ParseStamp("sdns://" + base64.RawURLEncoding.EncodeToString(append(rawStamp, 0)))
+	require.Error(t, err)
+}
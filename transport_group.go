@@ -0,0 +1,374 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	groupUpstreamTimeout = 5 * time.Second
+	groupFastestCount    = 2
+)
+
+const (
+	groupPolicyFailover uint8 = iota
+	groupPolicyRace
+	groupPolicyFastest
+	groupPolicyRoundRobin
+)
+
+var _ Transport = (*GroupTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"group"}, func(options TransportOptions) (Transport, error) {
+		return NewGroupTransport(options)
+	})
+}
+
+type GroupTransport struct {
+	name         string
+	logger       logger.ContextLogger
+	policy       uint8
+	fastestCount int
+	health       *HealthTracker
+	access       sync.Mutex
+	upstreams    []*groupUpstream
+}
+
+type groupUpstream struct {
+	transport     Transport
+	timeout       time.Duration
+	weight        int
+	currentWeight int
+	rtt           time.Duration
+}
+
+func NewGroupTransport(options TransportOptions) (*GroupTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	query := serverURL.Query()
+	transport := &GroupTransport{
+		name:         options.Name,
+		logger:       options.Logger,
+		fastestCount: groupFastestCount,
+		health:       options.Health,
+	}
+	switch policy := query.Get("policy"); policy {
+	case "", "failover":
+		transport.policy = groupPolicyFailover
+	case "race":
+		transport.policy = groupPolicyRace
+	case "fastest":
+		transport.policy = groupPolicyFastest
+	case "round_robin":
+		transport.policy = groupPolicyRoundRobin
+	default:
+		return nil, E.New("unknown group policy: ", policy)
+	}
+	if countString := query.Get("count"); countString != "" {
+		transport.fastestCount, err = strconv.Atoi(countString)
+		if err != nil || transport.fastestCount < 1 {
+			return nil, E.New("invalid count: ", countString)
+		}
+	}
+	timeout := groupUpstreamTimeout
+	if timeoutString := query.Get("timeout"); timeoutString != "" {
+		timeout, err = time.ParseDuration(timeoutString)
+		if err != nil {
+			return nil, E.Cause(err, "parse timeout")
+		}
+	}
+	for index, upstreamString := range query["upstream"] {
+		upstream, err := parseGroupUpstream(options, index, upstreamString, timeout)
+		if err != nil {
+			return nil, E.Cause(err, "parse upstream[", index, "]")
+		}
+		transport.upstreams = append(transport.upstreams, upstream)
+	}
+	if len(transport.upstreams) == 0 {
+		return nil, E.New("missing upstreams")
+	}
+	return transport, nil
+}
+
+func parseGroupUpstream(options TransportOptions, index int, upstreamString string, timeout time.Duration) (*groupUpstream, error) {
+	query, err := url.ParseQuery(upstreamString)
+	if err != nil {
+		return nil, err
+	}
+	upstream := &groupUpstream{
+		timeout: timeout,
+		weight:  1,
+	}
+	if timeoutString := query.Get("timeout"); timeoutString != "" {
+		upstream.timeout, err = time.ParseDuration(timeoutString)
+		if err != nil {
+			return nil, E.Cause(err, "parse timeout")
+		}
+	}
+	if weightString := query.Get("weight"); weightString != "" {
+		upstream.weight, err = strconv.Atoi(weightString)
+		if err != nil || upstream.weight < 1 {
+			return nil, E.New("invalid weight: ", weightString)
+		}
+	}
+	serverAddress := query.Get("server")
+	if serverAddress == "" {
+		return nil, E.New("missing server")
+	}
+	serverOptions := options
+	serverOptions.Name = query.Get("name")
+	if serverOptions.Name == "" {
+		serverOptions.Name = options.Name + "/upstream[" + strconv.Itoa(index) + "]"
+	}
+	serverOptions.Address = serverAddress
+	upstream.transport, err = CreateTransport(serverOptions)
+	if err != nil {
+		return nil, E.Cause(err, "create server transport")
+	}
+	return upstream, nil
+}
+
+func (t *GroupTransport) Name() string {
+	return t.name
+}
+
+func (t *GroupTransport) Start() error {
+	for _, upstream := range t.upstreams {
+		err := upstream.transport.Start()
+		if err != nil {
+			return E.Cause(err, "start transport[", upstream.transport.Name(), "]")
+		}
+	}
+	return nil
+}
+
+func (t *GroupTransport) Reset() {
+	t.access.Lock()
+	for _, upstream := range t.upstreams {
+		upstream.rtt = 0
+		upstream.currentWeight = 0
+	}
+	t.access.Unlock()
+	for _, upstream := range t.upstreams {
+		upstream.transport.Reset()
+	}
+}
+
+func (t *GroupTransport) Close() error {
+	return common.Close(common.Map(t.upstreams, func(it *groupUpstream) any {
+		return it.transport
+	})...)
+}
+
+func (t *GroupTransport) Raw() bool {
+	return true
+}
+
+func (t *GroupTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *GroupTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	var (
+		response *dns.Msg
+		err      error
+	)
+	switch t.policy {
+	case groupPolicyRace:
+		upstreams := t.availableUpstreams(t.upstreams)
+		response, err = t.exchangeRace(ctx, upstreams, message)
+	case groupPolicyFastest:
+		upstreams := t.availableUpstreams(t.fastestOrder())
+		count := t.fastestCount
+		if count > len(upstreams) {
+			count = len(upstreams)
+		}
+		response, err = t.exchangeRace(ctx, upstreams[:count], message)
+		if err != nil && count < len(upstreams) {
+			var fallbackResponse *dns.Msg
+			fallbackResponse, err = t.exchangeSequential(ctx, upstreams[count:], message)
+			if fallbackResponse != nil {
+				response = fallbackResponse
+			}
+		}
+	case groupPolicyRoundRobin:
+		response, err = t.exchangeSequential(ctx, t.availableUpstreams(t.roundRobinOrder()), message)
+	default:
+		response, err = t.exchangeSequential(ctx, t.availableUpstreams(t.upstreams), message)
+	}
+	if err != nil && response != nil {
+		return response, nil
+	}
+	return response, err
+}
+
+func (t *GroupTransport) exchangeSequential(ctx context.Context, upstreams []*groupUpstream, message *dns.Msg) (*dns.Msg, error) {
+	var (
+		lastResponse *dns.Msg
+		errors       []error
+	)
+	for _, upstream := range upstreams {
+		response, err := t.exchangeUpstream(ctx, upstream, message)
+		if err == nil {
+			return response, nil
+		}
+		if response != nil {
+			lastResponse = response
+		}
+		errors = append(errors, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return lastResponse, E.Errors(errors...)
+}
+
+func (t *GroupTransport) exchangeRace(ctx context.Context, upstreams []*groupUpstream, message *dns.Msg) (*dns.Msg, error) {
+	type raceResult struct {
+		response *dns.Msg
+		err      error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, len(upstreams))
+	for _, upstream := range upstreams {
+		go func(upstream *groupUpstream, message *dns.Msg) {
+			response, err := t.exchangeUpstream(ctx, upstream, message)
+			results <- raceResult{response, err}
+		}(upstream, message.Copy())
+	}
+	var (
+		lastResponse *dns.Msg
+		errors       []error
+	)
+	for range upstreams {
+		result := <-results
+		if result.err == nil {
+			return result.response, nil
+		}
+		if result.response != nil {
+			lastResponse = result.response
+		}
+		errors = append(errors, result.err)
+	}
+	return lastResponse, E.Errors(errors...)
+}
+
+func (t *GroupTransport) exchangeUpstream(ctx context.Context, upstream *groupUpstream, message *dns.Msg) (*dns.Msg, error) {
+	transport := upstream.transport
+	contextTransport, loaded := transportNameFromContext(ctx)
+	if loaded && transport.Name() == contextTransport {
+		return nil, E.New("DNS query loopback in transport[", contextTransport, "]")
+	}
+	exchangeCtx, cancel := context.WithTimeout(contextWithTransportName(ctx, transport.Name()), upstream.timeout)
+	defer cancel()
+	startAt := time.Now()
+	var (
+		response *dns.Msg
+		err      error
+	)
+	if transport.Raw() {
+		response, err = transport.Exchange(exchangeCtx, message)
+	} else {
+		response, err = exchangeToLookup(exchangeCtx, transport, message)
+	}
+	if err == nil {
+		err = responseFailure(response)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if t.logger != nil && len(message.Question) > 0 {
+			t.logger.DebugContext(ctx, "exchange ", fqdnToDomain(message.Question[0].Name), " via transport[", transport.Name(), "]: ", err)
+		}
+		if t.health != nil {
+			t.health.Report(transport, time.Since(startAt), err)
+		}
+		t.updateRTT(upstream, upstream.timeout)
+		return response, E.Cause(err, "transport[", transport.Name(), "]")
+	}
+	rtt := time.Since(startAt)
+	if t.health != nil {
+		t.health.Report(transport, rtt, nil)
+	}
+	t.updateRTT(upstream, rtt)
+	return response, nil
+}
+
+func (t *GroupTransport) availableUpstreams(upstreams []*groupUpstream) []*groupUpstream {
+	if t.health == nil {
+		return upstreams
+	}
+	var available, unavailable []*groupUpstream
+	for _, upstream := range upstreams {
+		if t.health.Available(upstream.transport.Name()) {
+			available = append(available, upstream)
+		} else {
+			unavailable = append(unavailable, upstream)
+		}
+	}
+	if t.policy == groupPolicyRace && len(available) > 0 {
+		return available
+	}
+	return append(available, unavailable...)
+}
+
+func (t *GroupTransport) updateRTT(upstream *groupUpstream, rtt time.Duration) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if upstream.rtt == 0 {
+		upstream.rtt = rtt
+	} else {
+		upstream.rtt = (upstream.rtt*7 + rtt) / 8
+	}
+}
+
+func (t *GroupTransport) fastestOrder() []*groupUpstream {
+	t.access.Lock()
+	defer t.access.Unlock()
+	upstreams := append([]*groupUpstream(nil), t.upstreams...)
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		return upstreams[i].rtt < upstreams[j].rtt
+	})
+	return upstreams
+}
+
+func (t *GroupTransport) roundRobinOrder() []*groupUpstream {
+	t.access.Lock()
+	defer t.access.Unlock()
+	var (
+		totalWeight int
+		selected    *groupUpstream
+	)
+	for _, upstream := range t.upstreams {
+		upstream.currentWeight += upstream.weight
+		totalWeight += upstream.weight
+		if selected == nil || upstream.currentWeight > selected.currentWeight {
+			selected = upstream
+		}
+	}
+	selected.currentWeight -= totalWeight
+	upstreams := []*groupUpstream{selected}
+	for _, upstream := range t.upstreams {
+		if upstream != selected {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	return upstreams
+}
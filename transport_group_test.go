@@ -0,0 +1,142 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func startSilentUDPServer(t *testing.T, requests *atomic.Int32) M.Socksaddr {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		packetConn.Close()
+	})
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			_, _, err := packetConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			requests.Add(1)
+		}
+	}()
+	return M.SocksaddrFromNet(packetConn.LocalAddr())
+}
+
+func createGroupTransport(t *testing.T, query url.Values, upstreams ...url.Values) dns.Transport {
+	for _, upstream := range upstreams {
+		query.Add("upstream", upstream.Encode())
+	}
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Name:    "group",
+		Address: "group://?" + query.Encode(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		transport.Close()
+	})
+	require.NoError(t, transport.Start())
+	return transport
+}
+
+func staticUpstream(address string) url.Values {
+	return url.Values{"server": {"static://?record=example.com.+IN+A+" + address}}
+}
+
+func TestGroupTransportFailover(t *testing.T) {
+	t.Parallel()
+	var requests atomic.Int32
+	silentAddr := startSilentUDPServer(t, &requests)
+	transport := createGroupTransport(t, url.Values{},
+		url.Values{"server": {"udp://" + silentAddr.String()}, "timeout": {"100ms"}},
+		url.Values{"server": {"rcode://server_failure"}},
+		url.Values{"server": {"rcode://refused"}},
+		staticUpstream("10.0.0.1"),
+	)
+	startAt := time.Now()
+	response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Less(t, time.Since(startAt), time.Second)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Equal(t, "10.0.0.1", response.Answer[0].(*mDNS.A).A.String())
+	require.Equal(t, int32(1), requests.Load())
+
+	transport = createGroupTransport(t, url.Values{},
+		url.Values{"server": {"rcode://server_failure"}},
+		url.Values{"server": {"rcode://refused"}},
+	)
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeRefused, response.Rcode)
+}
+
+func TestGroupTransportRace(t *testing.T) {
+	t.Parallel()
+	var requests atomic.Int32
+	silentAddr := startSilentUDPServer(t, &requests)
+	transport := createGroupTransport(t, url.Values{"policy": {"race"}, "timeout": {"5s"}},
+		url.Values{"server": {"udp://" + silentAddr.String()}},
+		url.Values{"server": {"rcode://server_failure"}},
+		staticUpstream("10.0.0.1"),
+	)
+	startAt := time.Now()
+	response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Less(t, time.Since(startAt), time.Second)
+	require.Equal(t, "10.0.0.1", response.Answer[0].(*mDNS.A).A.String())
+}
+
+func TestGroupTransportFastest(t *testing.T) {
+	t.Parallel()
+	var requests atomic.Int32
+	silentAddr := startSilentUDPServer(t, &requests)
+	transport := createGroupTransport(t, url.Values{"policy": {"fastest"}, "count": {"1"}},
+		url.Values{"server": {"udp://" + silentAddr.String()}, "timeout": {"100ms"}},
+		staticUpstream("10.0.0.1"),
+	)
+	for i := 0; i < 3; i++ {
+		response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1", response.Answer[0].(*mDNS.A).A.String())
+	}
+	require.Equal(t, int32(1), requests.Load())
+
+	transport.Reset()
+	_, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), requests.Load())
+}
+
+func TestGroupTransportRoundRobin(t *testing.T) {
+	t.Parallel()
+	heavy := staticUpstream("10.0.0.1")
+	heavy.Set("weight", "2")
+	transport := createGroupTransport(t, url.Values{"policy": {"round_robin"}},
+		heavy,
+		staticUpstream("10.0.0.2"),
+	)
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+		require.NoError(t, err)
+		counts[response.Answer[0].(*mDNS.A).A.String()]++
+	}
+	require.Equal(t, 4, counts["10.0.0.1"])
+	require.Equal(t, 2, counts["10.0.0.2"])
+}
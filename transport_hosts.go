@@ -1,11 +1,327 @@
 package dns
 
 import (
+	"bufio"
+	"context"
 	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
 
 	"github.com/miekg/dns"
 )
 
+const hostsCheckInterval = 5 * time.Second
+
+var _ Transport = (*HostsTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"hosts"}, func(options TransportOptions) (Transport, error) {
+		return NewHostsTransport(options)
+	})
+}
+
+type HostsTransport struct {
+	name      string
+	logger    logger.ContextLogger
+	paths     []string
+	inline    *hostsTable
+	ttl       uint32
+	fallback  Transport
+	access    sync.Mutex
+	checkedAt time.Time
+	modTimes  []time.Time
+	table     *hostsTable
+}
+
+type hostsTable struct {
+	addrs map[string][]netip.Addr
+	names map[netip.Addr][]string
+}
+
+func NewHostsTransport(options TransportOptions) (*HostsTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	query := serverURL.Query()
+	var paths []string
+	if serverURL.Path != "" {
+		paths = append(paths, serverURL.Path)
+	}
+	paths = append(paths, query["path"]...)
+	inline := newHostsTable()
+	for _, entry := range query["entry"] {
+		if !inline.parseLine(entry) {
+			return nil, E.New("invalid hosts entry: ", entry)
+		}
+	}
+	if len(paths) == 0 && len(inline.addrs) == 0 {
+		return nil, E.New("missing hosts path or entries")
+	}
+	ttl := uint32(DefaultTTL)
+	if ttlString := query.Get("ttl"); ttlString != "" {
+		ttlValue, err := strconv.ParseUint(ttlString, 10, 32)
+		if err != nil {
+			return nil, E.Cause(err, "parse ttl")
+		}
+		ttl = uint32(ttlValue)
+	}
+	var fallback Transport
+	if fallbackAddress := query.Get("fallback"); fallbackAddress != "" {
+		fallbackOptions := options
+		fallbackOptions.Name = options.Name + "/fallback"
+		fallbackOptions.Address = fallbackAddress
+		fallback, err = CreateTransport(fallbackOptions)
+		if err != nil {
+			return nil, E.Cause(err, "create fallback transport")
+		}
+	}
+	return &HostsTransport{
+		name:     options.Name,
+		logger:   options.Logger,
+		paths:    paths,
+		inline:   inline,
+		ttl:      ttl,
+		fallback: fallback,
+		modTimes: make([]time.Time, len(paths)),
+	}, nil
+}
+
+func (t *HostsTransport) Name() string {
+	return t.name
+}
+
+func (t *HostsTransport) Start() error {
+	t.loadTable()
+	if t.fallback != nil {
+		return t.fallback.Start()
+	}
+	return nil
+}
+
+func (t *HostsTransport) Reset() {
+	t.access.Lock()
+	t.checkedAt = time.Time{}
+	t.access.Unlock()
+	if t.fallback != nil {
+		t.fallback.Reset()
+	}
+}
+
+func (t *HostsTransport) Close() error {
+	if t.fallback != nil {
+		return t.fallback.Close()
+	}
+	return nil
+}
+
+func (t *HostsTransport) Raw() bool {
+	return true
+}
+
+func (t *HostsTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *HostsTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) == 1 && message.Question[0].Qclass == dns.ClassINET {
+		response := t.loadTable().exchange(message, t.ttl)
+		if response != nil {
+			return response, nil
+		}
+	}
+	if t.fallback != nil {
+		return t.fallback.Exchange(ctx, message)
+	}
+	response := new(dns.Msg)
+	response.SetRcode(message, dns.RcodeNameError)
+	return response, nil
+}
+
+func (t *HostsTransport) loadTable() *hostsTable {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.table != nil && time.Since(t.checkedAt) < hostsCheckInterval {
+		return t.table
+	}
+	t.checkedAt = time.Now()
+	modTimes := make([]time.Time, len(t.paths))
+	for i, path := range t.paths {
+		fileInfo, err := os.Stat(path)
+		if err == nil {
+			modTimes[i] = fileInfo.ModTime()
+		}
+	}
+	if t.table != nil && equalTimes(modTimes, t.modTimes) {
+		return t.table
+	}
+	table := newHostsTable()
+	table.merge(t.inline)
+	for _, path := range t.paths {
+		err := table.readFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.logger.Error(E.Cause(err, "read hosts file ", path))
+		}
+	}
+	t.modTimes = modTimes
+	t.table = table
+	return table
+}
+
+func equalTimes(a []time.Time, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func newHostsTable() *hostsTable {
+	return &hostsTable{
+		addrs: make(map[string][]netip.Addr),
+		names: make(map[netip.Addr][]string),
+	}
+}
+
+func (h *hostsTable) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		h.parseLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func (h *hostsTable) parseLine(line string) bool {
+	if index := strings.IndexByte(line, '#'); index != -1 {
+		line = line[:index]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return false
+	}
+	addr, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return false
+	}
+	addr = addr.WithZone("").Unmap()
+	for _, name := range fields[1:] {
+		h.add(dns.Fqdn(strings.ToLower(name)), addr)
+	}
+	return true
+}
+
+func (h *hostsTable) add(name string, addr netip.Addr) {
+	for _, it := range h.addrs[name] {
+		if it == addr {
+			return
+		}
+	}
+	h.addrs[name] = append(h.addrs[name], addr)
+	h.names[addr] = append(h.names[addr], name)
+}
+
+func (h *hostsTable) merge(other *hostsTable) {
+	for name, addrs := range other.addrs {
+		for _, addr := range addrs {
+			h.add(name, addr)
+		}
+	}
+}
+
+func (h *hostsTable) exchange(message *dns.Msg, ttl uint32) *dns.Msg {
+	question := message.Question[0]
+	name := strings.ToLower(question.Name)
+	if question.Qtype == dns.TypePTR {
+		addr, loaded := parseReverseName(name)
+		if !loaded {
+			return nil
+		}
+		names := h.names[addr]
+		if len(names) == 0 {
+			return nil
+		}
+		response := FixedResponse(message.Id, question, nil, ttl)
+		for _, ptrName := range names {
+			response.Answer = append(response.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Ptr: ptrName,
+			})
+		}
+		return response
+	}
+	addrs, loaded := h.addrs[name]
+	if !loaded {
+		return nil
+	}
+	var answerAddrs []netip.Addr
+	for _, addr := range addrs {
+		if question.Qtype == dns.TypeA && addr.Is4() || question.Qtype == dns.TypeAAAA && addr.Is6() {
+			answerAddrs = append(answerAddrs, addr)
+		}
+	}
+	return FixedResponse(message.Id, question, answerAddrs, ttl)
+}
+
+func parseReverseName(name string) (netip.Addr, bool) {
+	if strings.HasSuffix(name, ".in-addr.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var addr [4]byte
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			addr[3-i] = byte(octet)
+		}
+		return netip.AddrFrom4(addr), true
+	}
+	if strings.HasSuffix(name, ".ip6.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		var addr [16]byte
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return netip.Addr{}, false
+			}
+			index := 31 - i
+			if index%2 == 0 {
+				addr[index/2] |= byte(nibble) << 4
+			} else {
+				addr[index/2] |= byte(nibble)
+			}
+		}
+		return netip.AddrFrom16(addr), true
+	}
+	return netip.Addr{}, false
+}
+
 func FixedResponse(id uint16, question dns.Question, addresses []netip.Addr, timeToLive uint32) *dns.Msg {
 	response := dns.Msg{
 		MsgHdr: dns.MsgHdr{
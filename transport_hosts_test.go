@@ -0,0 +1,107 @@
+package dns_test
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostsTransport(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	firstPath := filepath.Join(tempDir, "hosts")
+	secondPath := filepath.Join(tempDir, "hosts.extra")
+	require.NoError(t, os.WriteFile(firstPath, []byte("# static\n127.0.0.1 localhost\n10.0.0.1 Router.lan router\n"), 0o644))
+	require.NoError(t, os.WriteFile(secondPath, []byte("fd00::1 router.lan\n"), 0o644))
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "hosts://" + firstPath + "?" + url.Values{
+			"path":  {secondPath},
+			"entry": {"10.0.0.2 nas.lan"},
+			"ttl":   {"60"},
+		}.Encode(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.NoError(t, transport.Start())
+
+	response, err := transport.Exchange(context.Background(), newTestQuery("router.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "10.0.0.1", response.Answer[0].(*mDNS.A).A.String())
+	require.Equal(t, uint32(60), response.Answer[0].Header().Ttl)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("ROUTER.lan", mDNS.TypeAAAA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "fd00::1", response.Answer[0].(*mDNS.AAAA).AAAA.String())
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("nas.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("router.lan", mDNS.TypeMX))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("1.0.0.10.in-addr.arpa", mDNS.TypePTR))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, "router.lan.", response.Answer[0].(*mDNS.PTR).Ptr)
+
+	reverseName, err := mDNS.ReverseAddr("fd00::1")
+	require.NoError(t, err)
+	response, err = transport.Exchange(context.Background(), newTestQuery(reverseName, mDNS.TypePTR))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("unknown.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+
+	require.NoError(t, os.WriteFile(firstPath, []byte("10.0.0.3 router.lan\n"), 0o644))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(firstPath, modTime, modTime))
+	transport.Reset()
+	response, err = transport.Exchange(context.Background(), newTestQuery("router.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "10.0.0.3", response.Answer[0].(*mDNS.A).A.String())
+	response, err = transport.Exchange(context.Background(), newTestQuery("localhost", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+}
+
+func TestHostsTransportFallback(t *testing.T) {
+	t.Parallel()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "hosts://?" + url.Values{
+			"entry":    {"10.0.0.2 nas.lan"},
+			"fallback": {"rcode://refused"},
+		}.Encode(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	response, err := transport.Exchange(context.Background(), newTestQuery("nas.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	response, err = transport.Exchange(context.Background(), newTestQuery("unknown.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeRefused, response.Rcode)
+}
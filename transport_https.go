@@ -38,6 +38,7 @@ func NewHTTPSTransport(options TransportOptions) *HTTPSTransport {
 		destination: options.Address,
 		transport: &http.Transport{
 			ForceAttemptHTTP2: true,
+			TLSClientConfig:   options.TLSConfig,
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 				return options.Dialer.DialContext(ctx, network, M.ParseSocksaddr(addr))
 			},
@@ -0,0 +1,493 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/contrab/freelru"
+	"github.com/sagernet/sing/contrab/maphash"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	recursiveMaxDepth       = 8
+	recursiveMaxQueries     = 32
+	recursiveMaxCNAMEChain  = 8
+	recursiveServerTimeout  = 2 * time.Second
+	recursiveUDPSize        = 1232
+	recursiveMaxTransports  = 64
+	recursiveMaxDelegations = 1024
+)
+
+var DefaultRootHints = []netip.Addr{
+	netip.MustParseAddr("198.41.0.4"),
+	netip.MustParseAddr("170.247.170.2"),
+	netip.MustParseAddr("192.33.4.12"),
+	netip.MustParseAddr("199.7.91.13"),
+	netip.MustParseAddr("192.203.230.10"),
+	netip.MustParseAddr("192.5.5.241"),
+	netip.MustParseAddr("192.112.36.4"),
+	netip.MustParseAddr("198.97.190.53"),
+	netip.MustParseAddr("192.36.148.17"),
+	netip.MustParseAddr("192.58.128.30"),
+	netip.MustParseAddr("193.0.14.129"),
+	netip.MustParseAddr("199.7.83.42"),
+	netip.MustParseAddr("202.12.27.33"),
+	netip.MustParseAddr("2001:503:ba3e::2:30"),
+	netip.MustParseAddr("2801:1b8:10::b"),
+	netip.MustParseAddr("2001:500:2::c"),
+	netip.MustParseAddr("2001:500:2d::d"),
+	netip.MustParseAddr("2001:500:a8::e"),
+	netip.MustParseAddr("2001:500:2f::f"),
+	netip.MustParseAddr("2001:500:12::d0d"),
+	netip.MustParseAddr("2001:500:1::53"),
+	netip.MustParseAddr("2001:7fe::53"),
+	netip.MustParseAddr("2001:503:c27::2:30"),
+	netip.MustParseAddr("2001:7fd::1"),
+	netip.MustParseAddr("2001:500:9f::42"),
+	netip.MustParseAddr("2001:dc3::35"),
+}
+
+var _ Transport = (*RecursiveTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"recursive"}, func(options TransportOptions) (Transport, error) {
+		return NewRecursiveTransport(options)
+	})
+}
+
+type RecursiveTransport struct {
+	name        string
+	ctx         context.Context
+	logger      logger.ContextLogger
+	dialer      N.Dialer
+	roots       []netip.Addr
+	minimize    bool
+	access      sync.Mutex
+	delegations freelru.Cache[string, *recursiveDelegation]
+	transports  freelru.Cache[netip.Addr, *UDPTransport]
+}
+
+type recursiveDelegation struct {
+	servers []netip.Addr
+}
+
+func NewRecursiveTransport(options TransportOptions) (*RecursiveTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	query := serverURL.Query()
+	var roots []netip.Addr
+	for _, root := range query["root"] {
+		addr, err := netip.ParseAddr(root)
+		if err != nil {
+			return nil, E.Cause(err, "parse root server address")
+		}
+		roots = append(roots, addr)
+	}
+	if hintsPath := query.Get("hints"); hintsPath != "" {
+		hints, err := readRootHints(hintsPath)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, hints...)
+	}
+	if len(roots) == 0 {
+		roots = append([]netip.Addr(nil), DefaultRootHints...)
+	}
+	minimize := true
+	switch query.Get("minimize") {
+	case "", "true":
+	case "false":
+		minimize = false
+	default:
+		return nil, E.New("invalid minimize value: ", query.Get("minimize"))
+	}
+	transports := common.Must1(freelru.New[netip.Addr, *UDPTransport](recursiveMaxTransports, maphash.NewHasher[netip.Addr]().Hash32))
+	transports.SetOnEvict(func(_ netip.Addr, transport *UDPTransport) {
+		transport.Close()
+	})
+	return &RecursiveTransport{
+		name:        options.Name,
+		ctx:         options.Context,
+		logger:      options.Logger,
+		dialer:      options.Dialer,
+		roots:       sortServers(roots),
+		minimize:    minimize,
+		delegations: common.Must1(freelru.New[string, *recursiveDelegation](recursiveMaxDelegations, maphash.NewHasher[string]().Hash32)),
+		transports:  transports,
+	}, nil
+}
+
+func readRootHints(path string) ([]netip.Addr, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	parser := dns.NewZoneParser(file, ".", path)
+	var hints []netip.Addr
+	for record, loaded := parser.Next(); loaded; record, loaded = parser.Next() {
+		switch it := record.(type) {
+		case *dns.A:
+			if addr, loaded := netip.AddrFromSlice(it.A); loaded {
+				hints = append(hints, addr.Unmap())
+			}
+		case *dns.AAAA:
+			if addr, loaded := netip.AddrFromSlice(it.AAAA); loaded {
+				hints = append(hints, addr)
+			}
+		}
+	}
+	err = parser.Err()
+	if err != nil {
+		return nil, E.Cause(err, "parse root hints")
+	}
+	if len(hints) == 0 {
+		return nil, E.New("no root server addresses in ", path)
+	}
+	return hints, nil
+}
+
+func sortServers(servers []netip.Addr) []netip.Addr {
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].Is4() && !servers[j].Is4()
+	})
+	return servers
+}
+
+func (t *RecursiveTransport) Name() string {
+	return t.name
+}
+
+func (t *RecursiveTransport) Start() error {
+	return nil
+}
+
+func (t *RecursiveTransport) Reset() {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.delegations.Purge()
+	for _, server := range t.transports.Keys() {
+		transport, loaded := t.transports.Peek(server)
+		if loaded {
+			transport.Reset()
+		}
+	}
+}
+
+func (t *RecursiveTransport) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.transports.Purge()
+	return nil
+}
+
+func (t *RecursiveTransport) Raw() bool {
+	return true
+}
+
+func (t *RecursiveTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *RecursiveTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) != 1 {
+		response := new(dns.Msg)
+		response.SetRcode(message, dns.RcodeFormatError)
+		return response, nil
+	}
+	question := message.Question[0]
+	response, err := t.resolve(ctx, strings.ToLower(question.Name), question.Qtype, 0)
+	if err != nil {
+		return nil, err
+	}
+	response.Id = message.Id
+	response.Question = []dns.Question{question}
+	response.RecursionDesired = message.RecursionDesired
+	response.RecursionAvailable = true
+	response.Authoritative = false
+	response.Extra = nil
+	return response, nil
+}
+
+func (t *RecursiveTransport) resolve(ctx context.Context, name string, qType uint16, depth int) (*dns.Msg, error) {
+	if depth > recursiveMaxDepth {
+		return nil, E.New("recursion depth exceeded for ", name)
+	}
+	var chain []dns.RR
+	for cnameChain := 0; ; cnameChain++ {
+		response, zone, err := t.resolveName(ctx, name, qType, depth)
+		if err != nil {
+			return nil, err
+		}
+		records, nextName := followAnswer(zone, name, qType, response)
+		chain = append(chain, records...)
+		if nextName == "" {
+			response.Answer = chain
+			return response, nil
+		}
+		if cnameChain >= recursiveMaxCNAMEChain {
+			return nil, E.New("CNAME chain too long for ", name)
+		}
+		name = nextName
+	}
+}
+
+func followAnswer(zone string, name string, qType uint16, response *dns.Msg) ([]dns.RR, string) {
+	var records []dns.RR
+	current := name
+	for i := 0; i <= recursiveMaxCNAMEChain; i++ {
+		if !dns.IsSubDomain(zone, current) {
+			return records, current
+		}
+		var (
+			answered bool
+			target   string
+		)
+		for _, record := range response.Answer {
+			if !strings.EqualFold(record.Header().Name, current) {
+				continue
+			}
+			if record.Header().Rrtype == qType || qType == dns.TypeANY {
+				records = append(records, record)
+				answered = true
+			} else if cname, isCNAME := record.(*dns.CNAME); isCNAME && target == "" {
+				records = append(records, record)
+				target = strings.ToLower(cname.Target)
+			}
+		}
+		if answered || target == "" {
+			if !answered && current != name && response.Rcode == dns.RcodeSuccess && !common.Any(response.Ns, func(it dns.RR) bool {
+				return it.Header().Rrtype == dns.TypeSOA
+			}) {
+				return records, current
+			}
+			return records, ""
+		}
+		current = target
+	}
+	return records, current
+}
+
+func (t *RecursiveTransport) resolveName(ctx context.Context, name string, qType uint16, depth int) (*dns.Msg, string, error) {
+	delegationName := name
+	if qType == dns.TypeDS {
+		if off, end := dns.NextLabel(name, 0); !end {
+			delegationName = name[off:]
+		}
+	}
+	zone, servers := t.closestDelegation(delegationName)
+	minimize := t.minimize
+	labelIndexes := dns.Split(name)
+	minimizeLabels := dns.CountLabel(zone) + 1
+	for queries := 0; queries < recursiveMaxQueries; queries++ {
+		queryName, queryType := name, qType
+		if minimize && minimizeLabels < len(labelIndexes) {
+			queryName = name[labelIndexes[len(labelIndexes)-minimizeLabels]:]
+			queryType = dns.TypeA
+		}
+		response, err := t.exchangeServers(ctx, zone, servers, queryName, queryType)
+		if err != nil {
+			return nil, "", err
+		}
+		if cut := findReferral(zone, name, response); cut != "" && !(qType == dns.TypeDS && cut == name) {
+			servers, err = t.delegationServers(ctx, zone, cut, response, depth)
+			if err != nil {
+				return nil, "", err
+			}
+			zone = cut
+			minimizeLabels = dns.CountLabel(zone) + 1
+			continue
+		}
+		if queryName != name {
+			if response.Rcode == dns.RcodeSuccess {
+				minimizeLabels++
+			} else {
+				minimize = false
+			}
+			continue
+		}
+		return response, zone, nil
+	}
+	return nil, "", E.New("too many queries resolving ", name)
+}
+
+func findReferral(zone string, name string, response *dns.Msg) string {
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) > 0 {
+		return ""
+	}
+	for _, record := range response.Ns {
+		if record.Header().Rrtype != dns.TypeNS {
+			continue
+		}
+		owner := strings.ToLower(record.Header().Name)
+		if owner != zone && dns.IsSubDomain(zone, owner) && dns.IsSubDomain(owner, name) {
+			return owner
+		}
+	}
+	return ""
+}
+
+func (t *RecursiveTransport) delegationServers(ctx context.Context, zone string, cut string, response *dns.Msg, depth int) ([]netip.Addr, error) {
+	var (
+		nameServers []string
+		ttl         uint32
+	)
+	for _, record := range response.Ns {
+		nameServer, isNS := record.(*dns.NS)
+		if !isNS || !strings.EqualFold(nameServer.Hdr.Name, cut) {
+			continue
+		}
+		nameServers = append(nameServers, strings.ToLower(nameServer.Ns))
+		if ttl == 0 || nameServer.Hdr.Ttl < ttl {
+			ttl = nameServer.Hdr.Ttl
+		}
+	}
+	var servers []netip.Addr
+	for _, record := range response.Extra {
+		owner := strings.ToLower(record.Header().Name)
+		if !dns.IsSubDomain(zone, owner) || !common.Contains(nameServers, owner) {
+			continue
+		}
+		switch it := record.(type) {
+		case *dns.A:
+			servers = append(servers, M.AddrFromIP(it.A).Unmap())
+		case *dns.AAAA:
+			servers = append(servers, M.AddrFromIP(it.AAAA))
+		}
+	}
+	if len(servers) == 0 {
+		var lookupErrors []error
+		for _, nameServer := range nameServers {
+			addrs, err := t.lookupServer(ctx, nameServer, depth+1)
+			if err != nil {
+				lookupErrors = append(lookupErrors, err)
+				continue
+			}
+			servers = append(servers, addrs...)
+			if len(servers) > 0 {
+				break
+			}
+		}
+		if len(servers) == 0 {
+			return nil, E.Cause(E.Errors(lookupErrors...), "no name server addresses for ", cut)
+		}
+	}
+	servers = sortServers(servers)
+	if ttl > 0 {
+		t.access.Lock()
+		t.delegations.AddWithLifetime(cut, &recursiveDelegation{servers}, time.Duration(ttl)*time.Second)
+		t.access.Unlock()
+	}
+	return servers, nil
+}
+
+func (t *RecursiveTransport) lookupServer(ctx context.Context, name string, depth int) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		response, err := t.resolve(ctx, name, qType, depth)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range response.Answer {
+			switch it := record.(type) {
+			case *dns.A:
+				addrs = append(addrs, M.AddrFromIP(it.A).Unmap())
+			case *dns.AAAA:
+				addrs = append(addrs, M.AddrFromIP(it.AAAA))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, E.New("no addresses for name server ", name)
+}
+
+func (t *RecursiveTransport) closestDelegation(name string) (string, []netip.Addr) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone := name[off:]
+		delegation, loaded := t.delegations.Get(zone)
+		if loaded {
+			return zone, delegation.servers
+		}
+	}
+	return ".", t.roots
+}
+
+func (t *RecursiveTransport) exchangeServers(ctx context.Context, zone string, servers []netip.Addr, name string, qType uint16) (*dns.Msg, error) {
+	message := new(dns.Msg)
+	message.SetQuestion(name, qType)
+	message.RecursionDesired = false
+	message.SetEdns0(recursiveUDPSize, false)
+	var exchangeErrors []error
+	for _, server := range servers {
+		transport, err := t.serverTransport(server)
+		if err != nil {
+			return nil, err
+		}
+		exchangeCtx, cancel := context.WithTimeout(ctx, recursiveServerTimeout)
+		response, err := transport.Exchange(exchangeCtx, message)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			exchangeErrors = append(exchangeErrors, E.Cause(err, "query ", server))
+			continue
+		}
+		if len(response.Question) != 1 || !strings.EqualFold(response.Question[0].Name, name) || response.Question[0].Qtype != qType {
+			exchangeErrors = append(exchangeErrors, E.New("query ", server, ": mismatched question"))
+			continue
+		}
+		switch response.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+		default:
+			exchangeErrors = append(exchangeErrors, E.New("query ", server, ": ", RCodeError(response.Rcode)))
+			continue
+		}
+		if !response.Authoritative && findReferral(zone, name, response) == "" {
+			exchangeErrors = append(exchangeErrors, E.New("query ", server, ": non-authoritative response"))
+			continue
+		}
+		return response, nil
+	}
+	return nil, E.Cause(E.Errors(exchangeErrors...), "resolve ", name)
+}
+
+func (t *RecursiveTransport) serverTransport(server netip.Addr) (*UDPTransport, error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	transport, loaded := t.transports.Get(server)
+	if loaded {
+		return transport, nil
+	}
+	transport, err := NewUDPTransport(TransportOptions{
+		Context: t.ctx,
+		Logger:  t.logger,
+		Name:    t.name,
+		Dialer:  t.dialer,
+		Address: netip.AddrPortFrom(server, 53).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.transports.Add(server, transport)
+	return transport, nil
+}
@@ -0,0 +1,278 @@
+package dns_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type authoritativeTestServer struct {
+	access  sync.Mutex
+	queries []string
+	modify  func(response *mDNS.Msg)
+}
+
+func (s *authoritativeTestServer) loadQueries() []string {
+	s.access.Lock()
+	defer s.access.Unlock()
+	queries := s.queries
+	s.queries = nil
+	return queries
+}
+
+func startAuthoritativeServer(t *testing.T, name string, content string) (*authoritativeTestServer, M.Socksaddr) {
+	path := filepath.Join(t.TempDir(), name+"zone")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "zone://" + path,
+	})
+	require.NoError(t, err)
+	authoritativeServer := &authoritativeTestServer{}
+	dnsServer, err := server.NewServer(server.Options{
+		Logger: logger.NOP(),
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			authoritativeServer.access.Lock()
+			authoritativeServer.queries = append(authoritativeServer.queries, message.Question[0].Name)
+			modify := authoritativeServer.modify
+			authoritativeServer.access.Unlock()
+			response, err := transport.Exchange(ctx, message)
+			if err == nil && modify != nil {
+				modify(response)
+			}
+			return response, err
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		dnsServer.Close()
+	})
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go dnsServer.ServeUDP(packetConn)
+	return authoritativeServer, M.SocksaddrFromNet(packetConn.LocalAddr())
+}
+
+const (
+	testRootZone = `. 3600 IN SOA ns.root. hostmaster.root. 1 3600 600 86400 60
+internal. 3600 IN NS ns1.internal.
+ns1.internal. 3600 IN A 10.0.1.1
+test. 3600 IN NS ns.nic.test.
+ns.nic.test. 3600 IN A 10.0.2.1
+`
+	testInternalZone = `$ORIGIN internal.
+@ 3600 IN SOA ns1 hostmaster 1 3600 600 86400 60
+@ 3600 IN NS ns1
+ns1 3600 IN A 10.0.1.1
+example 3600 IN NS ns.example.test.
+example 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF
+`
+	testTestZone = `$ORIGIN test.
+@ 3600 IN SOA ns.nic hostmaster 1 3600 600 86400 60
+@ 3600 IN NS ns.nic
+ns.nic 3600 IN A 10.0.2.1
+ns.example 3600 IN A 10.0.3.1
+alias 300 IN CNAME www.example.internal.
+edge 300 IN A 10.0.9.9
+`
+	testExampleZone = `$ORIGIN example.internal.
+@ 3600 IN SOA ns.example.test. hostmaster 1 3600 600 86400 60
+@ 3600 IN NS ns.example.test.
+www 300 IN A 10.0.0.80
+cdn 300 IN CNAME edge.test.
+`
+)
+
+func TestRecursiveTransport(t *testing.T) {
+	t.Parallel()
+	rootServer, rootAddr := startAuthoritativeServer(t, "root", testRootZone)
+	internalServer, internalAddr := startAuthoritativeServer(t, "internal", testInternalZone)
+	_, testAddr := startAuthoritativeServer(t, "test", testTestZone)
+	exampleServer, exampleAddr := startAuthoritativeServer(t, "example", testExampleZone)
+	dialer := &redirectDialer{
+		Dialer: N.SystemDialer,
+		destinations: map[M.Socksaddr]M.Socksaddr{
+			M.ParseSocksaddr("10.0.0.1:53"): rootAddr,
+			M.ParseSocksaddr("10.0.1.1:53"): internalAddr,
+			M.ParseSocksaddr("10.0.2.1:53"): testAddr,
+			M.ParseSocksaddr("10.0.3.1:53"): exampleAddr,
+		},
+	}
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  dialer,
+		Address: "recursive://?root=10.0.0.1",
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	response, err := transport.Exchange(context.Background(), newTestQuery("www.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.True(t, response.RecursionAvailable)
+	require.False(t, response.Authoritative)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "10.0.0.80", response.Answer[0].(*mDNS.A).A.String())
+	for _, name := range rootServer.loadQueries() {
+		require.Contains(t, []string{"internal.", "test."}, name)
+	}
+	require.NotContains(t, internalServer.loadQueries(), "www.example.internal.")
+	require.Contains(t, exampleServer.loadQueries(), "www.example.internal.")
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("alias.test", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, "www.example.internal.", response.Answer[0].(*mDNS.CNAME).Target)
+	require.Equal(t, "10.0.0.80", response.Answer[1].(*mDNS.A).A.String())
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("cdn.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, "10.0.9.9", response.Answer[1].(*mDNS.A).A.String())
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("missing.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.Equal(t, mDNS.TypeSOA, response.Ns[0].Header().Rrtype)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("www.example.internal", mDNS.TypeAAAA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Empty(t, rootServer.loadQueries())
+	require.Empty(t, internalServer.loadQueries())
+
+	transport.Reset()
+	_, err = transport.Exchange(context.Background(), newTestQuery("www.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.NotEmpty(t, rootServer.loadQueries())
+}
+
+func TestRecursiveTransportNoMinimize(t *testing.T) {
+	t.Parallel()
+	rootServer, rootAddr := startAuthoritativeServer(t, "root", testRootZone)
+	_, testAddr := startAuthoritativeServer(t, "test", testTestZone)
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer: &redirectDialer{
+			Dialer: N.SystemDialer,
+			destinations: map[M.Socksaddr]M.Socksaddr{
+				M.ParseSocksaddr("10.0.0.1:53"): rootAddr,
+				M.ParseSocksaddr("10.0.2.1:53"): testAddr,
+			},
+		},
+		Address: "recursive://?root=10.0.0.1&minimize=false",
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	response, err := transport.Exchange(context.Background(), newTestQuery("edge.test", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, []string{"edge.test."}, rootServer.loadQueries())
+}
+
+func TestRecursiveTransportBailiwick(t *testing.T) {
+	t.Parallel()
+	_, rootAddr := startAuthoritativeServer(t, "root", testRootZone)
+	_, internalAddr := startAuthoritativeServer(t, "internal", testInternalZone)
+	_, testAddr := startAuthoritativeServer(t, "test", testTestZone)
+	exampleServer, exampleAddr := startAuthoritativeServer(t, "example", testExampleZone)
+	exampleServer.access.Lock()
+	exampleServer.modify = func(response *mDNS.Msg) {
+		response.Answer = append(response.Answer, &mDNS.A{
+			Hdr: mDNS.RR_Header{Name: "edge.test.", Rrtype: mDNS.TypeA, Class: mDNS.ClassINET, Ttl: 300},
+			A:   net.ParseIP("6.6.6.6"),
+		})
+	}
+	exampleServer.access.Unlock()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer: &redirectDialer{
+			Dialer: N.SystemDialer,
+			destinations: map[M.Socksaddr]M.Socksaddr{
+				M.ParseSocksaddr("10.0.0.1:53"): rootAddr,
+				M.ParseSocksaddr("10.0.1.1:53"): internalAddr,
+				M.ParseSocksaddr("10.0.2.1:53"): testAddr,
+				M.ParseSocksaddr("10.0.3.1:53"): exampleAddr,
+			},
+		},
+		Address: "recursive://?root=10.0.0.1",
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	response, err := transport.Exchange(context.Background(), newTestQuery("cdn.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, "10.0.9.9", response.Answer[1].(*mDNS.A).A.String())
+
+	exampleServer.access.Lock()
+	exampleServer.modify = func(response *mDNS.Msg) {
+		response.Authoritative = false
+	}
+	exampleServer.access.Unlock()
+	_, err = transport.Exchange(context.Background(), newTestQuery("www.example.internal", mDNS.TypeA))
+	require.ErrorContains(t, err, "non-authoritative")
+}
+
+func TestRecursiveTransportDS(t *testing.T) {
+	t.Parallel()
+	_, rootAddr := startAuthoritativeServer(t, "root", testRootZone)
+	_, internalAddr := startAuthoritativeServer(t, "internal", testInternalZone)
+	_, testAddr := startAuthoritativeServer(t, "test", testTestZone)
+	exampleServer, exampleAddr := startAuthoritativeServer(t, "example", testExampleZone)
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer: &redirectDialer{
+			Dialer: N.SystemDialer,
+			destinations: map[M.Socksaddr]M.Socksaddr{
+				M.ParseSocksaddr("10.0.0.1:53"): rootAddr,
+				M.ParseSocksaddr("10.0.1.1:53"): internalAddr,
+				M.ParseSocksaddr("10.0.2.1:53"): testAddr,
+				M.ParseSocksaddr("10.0.3.1:53"): exampleAddr,
+			},
+		},
+		Address: "recursive://?root=10.0.0.1",
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	_, err = transport.Exchange(context.Background(), newTestQuery("www.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	exampleServer.loadQueries()
+	response, err := transport.Exchange(context.Background(), newTestQuery("example.internal", mDNS.TypeDS))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint16(12345), response.Answer[0].(*mDNS.DS).KeyTag)
+	require.Empty(t, exampleServer.loadQueries())
+}
+
+func TestRecursiveTransportDefaultRoots(t *testing.T) {
+	t.Parallel()
+	roots := append([]netip.Addr(nil), dns.DefaultRootHints...)
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "recursive://",
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.Equal(t, roots, dns.DefaultRootHints)
+}
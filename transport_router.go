@@ -0,0 +1,378 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+
+	"github.com/miekg/dns"
+)
+
+var _ Transport = (*RouterTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"router"}, func(options TransportOptions) (Transport, error) {
+		return NewRouterTransport(options)
+	})
+}
+
+type RouterTransport struct {
+	name             string
+	logger           logger.ContextLogger
+	rules            []*routerRule
+	defaultTransport Transport
+	health           *HealthTracker
+}
+
+type routerRule struct {
+	domain        []string
+	domainSuffix  []string
+	domainKeyword []string
+	domainRegex   []*regexp.Regexp
+	queryType     []uint16
+	queryClass    []uint16
+	transport     Transport
+	options       QueryOptions
+}
+
+func NewRouterTransport(options TransportOptions) (*RouterTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	query := serverURL.Query()
+	transport := &RouterTransport{
+		name:   options.Name,
+		logger: options.Logger,
+		health: options.Health,
+	}
+	for index, ruleString := range query["rule"] {
+		rule, err := parseRouterRule(options, index, ruleString)
+		if err != nil {
+			return nil, E.Cause(err, "parse rule[", index, "]")
+		}
+		transport.rules = append(transport.rules, rule)
+	}
+	if defaultAddress := query.Get("default"); defaultAddress != "" {
+		defaultOptions := options
+		defaultOptions.Name = options.Name + "/default"
+		defaultOptions.Address = defaultAddress
+		transport.defaultTransport, err = CreateTransport(defaultOptions)
+		if err != nil {
+			return nil, E.Cause(err, "create default transport")
+		}
+	}
+	if len(transport.rules) == 0 && transport.defaultTransport == nil {
+		return nil, E.New("missing rules or default transport")
+	}
+	return transport, nil
+}
+
+func parseRouterRule(options TransportOptions, index int, ruleString string) (*routerRule, error) {
+	query, err := url.ParseQuery(ruleString)
+	if err != nil {
+		return nil, err
+	}
+	rule := &routerRule{
+		domain:        common.Map(query["domain"], strings.ToLower),
+		domainSuffix:  common.Map(query["domain_suffix"], strings.ToLower),
+		domainKeyword: common.Map(query["domain_keyword"], strings.ToLower),
+	}
+	for _, expression := range query["domain_regex"] {
+		domainRegex, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, E.Cause(err, "parse domain_regex")
+		}
+		rule.domainRegex = append(rule.domainRegex, domainRegex)
+	}
+	for _, typeString := range query["qtype"] {
+		queryType, loaded := dns.StringToType[strings.ToUpper(typeString)]
+		if !loaded {
+			typeValue, err := strconv.ParseUint(typeString, 10, 16)
+			if err != nil {
+				return nil, E.New("unknown qtype: ", typeString)
+			}
+			queryType = uint16(typeValue)
+		}
+		rule.queryType = append(rule.queryType, queryType)
+	}
+	for _, classString := range query["qclass"] {
+		queryClass, loaded := dns.StringToClass[strings.ToUpper(classString)]
+		if !loaded {
+			classValue, err := strconv.ParseUint(classString, 10, 16)
+			if err != nil {
+				return nil, E.New("unknown qclass: ", classString)
+			}
+			queryClass = uint16(classValue)
+		}
+		rule.queryClass = append(rule.queryClass, queryClass)
+	}
+	if strategyString := query.Get("strategy"); strategyString != "" {
+		switch strategyString {
+		case "as_is":
+			rule.options.Strategy = DomainStrategyAsIS
+		case "prefer_ipv4":
+			rule.options.Strategy = DomainStrategyPreferIPv4
+		case "prefer_ipv6":
+			rule.options.Strategy = DomainStrategyPreferIPv6
+		case "ipv4_only":
+			rule.options.Strategy = DomainStrategyUseIPv4
+		case "ipv6_only":
+			rule.options.Strategy = DomainStrategyUseIPv6
+		default:
+			return nil, E.New("unknown strategy: ", strategyString)
+		}
+	}
+	if clientSubnet := query.Get("client_subnet"); clientSubnet != "" {
+		rule.options.ClientSubnet, err = netip.ParsePrefix(clientSubnet)
+		if err != nil {
+			address, addrErr := netip.ParseAddr(clientSubnet)
+			if addrErr != nil {
+				return nil, E.Cause(err, "parse client_subnet")
+			}
+			rule.options.ClientSubnet = netip.PrefixFrom(address, address.BitLen())
+		}
+	}
+	for _, ttlOption := range []struct {
+		key   string
+		value *uint32
+	}{
+		{"min_ttl", &rule.options.MinTTL},
+		{"max_ttl", &rule.options.MaxTTL},
+	} {
+		if ttlString := query.Get(ttlOption.key); ttlString != "" {
+			ttlValue, err := strconv.ParseUint(ttlString, 10, 32)
+			if err != nil {
+				return nil, E.Cause(err, "parse ", ttlOption.key)
+			}
+			*ttlOption.value = uint32(ttlValue)
+		}
+	}
+	if ttlString := query.Get("rewrite_ttl"); ttlString != "" {
+		ttlValue, err := strconv.ParseUint(ttlString, 10, 32)
+		if err != nil {
+			return nil, E.Cause(err, "parse rewrite_ttl")
+		}
+		rewriteTTL := uint32(ttlValue)
+		rule.options.RewriteTTL = &rewriteTTL
+	}
+	serverAddress := query.Get("server")
+	if serverAddress == "" {
+		return nil, E.New("missing server")
+	}
+	serverOptions := options
+	serverOptions.Name = query.Get("name")
+	if serverOptions.Name == "" {
+		serverOptions.Name = options.Name + "/rule[" + strconv.Itoa(index) + "]"
+	}
+	serverOptions.Address = serverAddress
+	rule.transport, err = CreateTransport(serverOptions)
+	if err != nil {
+		return nil, E.Cause(err, "create server transport")
+	}
+	return rule, nil
+}
+
+func (r *routerRule) match(question dns.Question) bool {
+	if len(r.queryType) > 0 && !common.Contains(r.queryType, question.Qtype) {
+		return false
+	}
+	if len(r.queryClass) > 0 && !common.Contains(r.queryClass, question.Qclass) {
+		return false
+	}
+	if len(r.domain) == 0 && len(r.domainSuffix) == 0 && len(r.domainKeyword) == 0 && len(r.domainRegex) == 0 {
+		return true
+	}
+	domain := strings.ToLower(fqdnToDomain(question.Name))
+	if common.Contains(r.domain, domain) {
+		return true
+	}
+	for _, suffix := range r.domainSuffix {
+		if strings.HasPrefix(suffix, ".") {
+			if strings.HasSuffix(domain, suffix) {
+				return true
+			}
+		} else if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	for _, keyword := range r.domainKeyword {
+		if strings.Contains(domain, keyword) {
+			return true
+		}
+	}
+	for _, domainRegex := range r.domainRegex {
+		if domainRegex.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *RouterTransport) Name() string {
+	return t.name
+}
+
+func (t *RouterTransport) Start() error {
+	for _, transport := range t.transports() {
+		err := transport.Start()
+		if err != nil {
+			return E.Cause(err, "start transport[", transport.Name(), "]")
+		}
+	}
+	return nil
+}
+
+func (t *RouterTransport) Reset() {
+	for _, transport := range t.transports() {
+		transport.Reset()
+	}
+}
+
+func (t *RouterTransport) Close() error {
+	return common.Close(common.Map(t.transports(), func(it Transport) any {
+		return it
+	})...)
+}
+
+func (t *RouterTransport) transports() []Transport {
+	transports := common.Map(t.rules, func(it *routerRule) Transport {
+		return it.transport
+	})
+	if t.defaultTransport != nil {
+		transports = append(transports, t.defaultTransport)
+	}
+	return transports
+}
+
+func (t *RouterTransport) Raw() bool {
+	return true
+}
+
+func (t *RouterTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *RouterTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) != 1 {
+		response := new(dns.Msg)
+		response.SetRcode(message, dns.RcodeFormatError)
+		return response, nil
+	}
+	question := message.Question[0]
+	transport := t.defaultTransport
+	var options QueryOptions
+	for index, rule := range t.rules {
+		if rule.match(question) {
+			if t.logger != nil {
+				t.logger.DebugContext(ctx, "match rule[", index, "] => ", rule.transport.Name())
+			}
+			transport = rule.transport
+			options = rule.options
+			break
+		}
+	}
+	if transport == nil {
+		response := new(dns.Msg)
+		response.SetRcode(message, dns.RcodeRefused)
+		return response, nil
+	}
+	if t.health != nil && transport != t.defaultTransport && t.defaultTransport != nil &&
+		!t.health.Available(transport.Name()) && t.health.Available(t.defaultTransport.Name()) {
+		if t.logger != nil {
+			t.logger.DebugContext(ctx, "transport[", transport.Name(), "] is down, fallback to transport[", t.defaultTransport.Name(), "]")
+		}
+		transport = t.defaultTransport
+		options = QueryOptions{}
+	}
+	contextTransport, loaded := transportNameFromContext(ctx)
+	if loaded && transport.Name() == contextTransport {
+		return nil, E.New("DNS query loopback in transport[", contextTransport, "]")
+	}
+	ctx = contextWithTransportName(ctx, transport.Name())
+	if question.Qtype == dns.TypeA && options.Strategy == DomainStrategyUseIPv6 || question.Qtype == dns.TypeAAAA && options.Strategy == DomainStrategyUseIPv4 {
+		response := new(dns.Msg)
+		response.SetReply(message)
+		return response, nil
+	}
+	if options.ClientSubnet.IsValid() {
+		message = SetClientSubnet(message, options.ClientSubnet, true)
+	}
+	var (
+		response *dns.Msg
+		err      error
+	)
+	if t.health != nil {
+		startAt := time.Now()
+		response, err = t.exchangeTransport(ctx, transport, message)
+		if err == nil {
+			t.health.Report(transport, time.Since(startAt), responseFailure(response))
+		} else if !errors.Is(ctx.Err(), context.Canceled) {
+			t.health.Report(transport, time.Since(startAt), err)
+		}
+	} else {
+		response, err = t.exchangeTransport(ctx, transport, message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if question.Qtype == dns.TypeHTTPS {
+		filterHTTPSHints(response, options.Strategy)
+	}
+	for _, recordList := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range recordList {
+			if record.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if options.RewriteTTL != nil {
+				record.Header().Ttl = *options.RewriteTTL
+			} else if options.MinTTL > 0 && record.Header().Ttl < options.MinTTL {
+				record.Header().Ttl = options.MinTTL
+			} else if options.MaxTTL > 0 && record.Header().Ttl > options.MaxTTL {
+				record.Header().Ttl = options.MaxTTL
+			}
+		}
+	}
+	return response, nil
+}
+
+func (t *RouterTransport) exchangeTransport(ctx context.Context, transport Transport, message *dns.Msg) (*dns.Msg, error) {
+	if transport.Raw() {
+		return transport.Exchange(ctx, message)
+	}
+	return exchangeToLookup(ctx, transport, message)
+}
+
+func exchangeToLookup(ctx context.Context, transport Transport, message *dns.Msg) (*dns.Msg, error) {
+	question := message.Question[0]
+	var strategy DomainStrategy
+	switch question.Qtype {
+	case dns.TypeA:
+		strategy = DomainStrategyUseIPv4
+	case dns.TypeAAAA:
+		strategy = DomainStrategyUseIPv6
+	default:
+		return nil, ErrNoRawSupport
+	}
+	addresses, err := transport.Lookup(ctx, fqdnToDomain(question.Name), strategy)
+	if err != nil {
+		err = wrapError(err)
+		if err != RCodeNameError {
+			return nil, err
+		}
+		response := new(dns.Msg)
+		response.SetRcode(message, dns.RcodeNameError)
+		return response, nil
+	}
+	return FixedResponse(message.Id, question, addresses, DefaultTTL), nil
+}
@@ -0,0 +1,114 @@
+package dns_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterTransport(t *testing.T) {
+	t.Parallel()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Name:    "router",
+		Address: "router://?" + url.Values{
+			"rule": {
+				url.Values{
+					"domain_suffix": {"lan"},
+					"server":        {"static://?record=nas.lan.+IN+A+10.0.0.2&record=nas.lan.+IN+AAAA+fd00::2"},
+					"strategy":      {"ipv4_only"},
+					"rewrite_ttl":   {"5"},
+				}.Encode(),
+				url.Values{
+					"domain_keyword": {"ads"},
+					"domain_regex":   {`^track\d+\.`},
+					"server":         {"rcode://refused"},
+				}.Encode(),
+				url.Values{
+					"domain": {"example.com"},
+					"qtype":  {"TXT", "65"},
+					"server": {"rcode://name_error"},
+				}.Encode(),
+				url.Values{
+					"qclass": {"CH"},
+					"server": {"rcode://not_implemented"},
+				}.Encode(),
+			},
+			"default": {"static://?record=example.com.+60+IN+A+10.0.1.1"},
+		}.Encode(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.NoError(t, transport.Start())
+
+	response, err := transport.Exchange(context.Background(), newTestQuery("nas.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint32(5), response.Answer[0].Header().Ttl)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("NAS.lan", mDNS.TypeAAAA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+
+	for _, domain := range []string{"ads.example.org", "track1.example.org"} {
+		response, err = transport.Exchange(context.Background(), newTestQuery(domain, mDNS.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, mDNS.RcodeRefused, response.Rcode, domain)
+	}
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeHTTPS))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint32(60), response.Answer[0].Header().Ttl)
+
+	message := newTestQuery("version.bind", mDNS.TypeTXT)
+	message.Question[0].Qclass = mDNS.ClassCHAOS
+	response, err = transport.Exchange(context.Background(), message)
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNotImplemented, response.Rcode)
+}
+
+func TestRouterTransportLoopback(t *testing.T) {
+	t.Parallel()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Name:    "router",
+		Address: "router://?" + url.Values{
+			"rule": {url.Values{
+				"domain": {"loop.example"},
+				"name":   {"upstream"},
+				"server": {"rcode://success"},
+			}.Encode()},
+		}.Encode(),
+	})
+	require.NoError(t, err)
+	client := dns.NewClient(dns.ClientOptions{})
+	response, err := client.Exchange(context.Background(), transport, newTestQuery("other.example", mDNS.TypeA), dns.QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeRefused, response.Rcode)
+
+	upstream := newTestTransport(60)
+	upstream.name = "upstream"
+	upstream.exchange = func(ctx context.Context, message *mDNS.Msg) (*mDNS.Msg, error) {
+		return transport.Exchange(ctx, message)
+	}
+	_, err = client.Exchange(context.Background(), upstream, newTestQuery("loop.example", mDNS.TypeA), dns.QueryOptions{})
+	require.ErrorContains(t, err, "loopback")
+}
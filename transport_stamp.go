@@ -0,0 +1,302 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/contrab/freelru"
+	"github.com/sagernet/sing/contrab/maphash"
+
+	"github.com/miekg/dns"
+)
+
+const stampBootstrapCacheCapacity = 16
+
+func init() {
+	RegisterTransport([]string{"sdns"}, func(options TransportOptions) (Transport, error) {
+		return NewStampTransport(options)
+	})
+}
+
+func NewStampTransport(options TransportOptions) (Transport, error) {
+	stamp, err := ParseStamp(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	var scheme string
+	switch stamp.Protocol {
+	case StampProtocolPlain:
+		scheme = "udp"
+		serverAddr, err := parseStampAddr(stamp.ServerAddr)
+		if err != nil {
+			return nil, err
+		}
+		if serverAddr.Port() == 0 {
+			serverAddr = netip.AddrPortFrom(serverAddr.Addr(), 53)
+		}
+		options.Address = serverAddr.String()
+	case StampProtocolDNSCrypt:
+		scheme = "dnscrypt"
+	case StampProtocolDoH:
+		scheme = "https"
+		options.Address = (&url.URL{Scheme: "https", Host: stamp.ProviderName, Path: stamp.Path}).String()
+	case StampProtocolTLS:
+		scheme = "tls"
+		options.Address = (&url.URL{Scheme: "tls", Host: stamp.ProviderName}).String()
+	case StampProtocolQUIC:
+		scheme = "quic"
+		options.Address = (&url.URL{Scheme: "quic", Host: stamp.ProviderName}).String()
+	case StampProtocolODoHTarget:
+		scheme = "odoh"
+		options.Address = (&url.URL{Scheme: "odoh", Host: stamp.ProviderName, Path: stamp.Path}).String()
+	default:
+		return nil, E.New("unsupported stamp protocol for transport: ", stamp.Protocol)
+	}
+	constructor := transports[scheme]
+	if constructor == nil {
+		return nil, E.New("no transport registered for ", stamp.Protocol, " stamp")
+	}
+	switch stamp.Protocol {
+	case StampProtocolDoH, StampProtocolTLS, StampProtocolQUIC:
+		if len(stamp.Hashes) > 0 {
+			var tlsConfig *tls.Config
+			if options.TLSConfig != nil {
+				tlsConfig = options.TLSConfig.Clone()
+			} else {
+				tlsConfig = &tls.Config{}
+			}
+			tlsConfig.VerifyPeerCertificate = verifyStampHashes(stamp.Hashes)
+			options.TLSConfig = tlsConfig
+		}
+		dialer, err := newStampDialer(options, stamp)
+		if err != nil {
+			return nil, err
+		}
+		if dialer != nil {
+			options.Dialer = dialer
+			transport, err := constructor(options)
+			if err != nil {
+				dialer.Close()
+				return nil, err
+			}
+			return &stampTransport{transport, dialer}, nil
+		}
+	}
+	return constructor(options)
+}
+
+type stampTransport struct {
+	Transport
+	dialer *stampDialer
+}
+
+func (t *stampTransport) Start() error {
+	err := t.dialer.Start()
+	if err != nil {
+		return err
+	}
+	return t.Transport.Start()
+}
+
+func (t *stampTransport) Reset() {
+	t.dialer.Reset()
+	t.Transport.Reset()
+}
+
+func (t *stampTransport) Close() error {
+	return E.Errors(t.Transport.Close(), t.dialer.Close())
+}
+
+func parseStampAddr(address string) (netip.AddrPort, error) {
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		address = address[1 : len(address)-1]
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err == nil {
+		return addrPort, nil
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.AddrPort{}, E.New("invalid stamp server address: ", address)
+	}
+	return netip.AddrPortFrom(addr, 0), nil
+}
+
+func verifyStampHashes(hashes [][]byte) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				return err
+			}
+			certHash := sha256.Sum256(cert.RawTBSCertificate)
+			for _, hash := range hashes {
+				if bytes.Equal(certHash[:], hash) {
+					return nil
+				}
+			}
+		}
+		return E.New("certificate hash mismatch")
+	}
+}
+
+var _ N.Dialer = (*stampDialer)(nil)
+
+type stampDialer struct {
+	dialer     N.Dialer
+	serverAddr netip.AddrPort
+	bootstrap  []*UDPTransport
+	access     sync.Mutex
+	addresses  freelru.Cache[string, netip.Addr]
+}
+
+func newStampDialer(options TransportOptions, stamp *ServerStamp) (*stampDialer, error) {
+	dialer := &stampDialer{
+		dialer: options.Dialer,
+	}
+	if stamp.ServerAddr != "" {
+		serverAddr, err := parseStampAddr(stamp.ServerAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.serverAddr = serverAddr
+		return dialer, nil
+	}
+	if len(stamp.Bootstrap) == 0 {
+		return nil, nil
+	}
+	dialer.addresses = common.Must1(freelru.New[string, netip.Addr](stampBootstrapCacheCapacity, maphash.NewHasher[string]().Hash32))
+	for _, bootstrap := range stamp.Bootstrap {
+		bootstrapTransport, err := NewUDPTransport(TransportOptions{
+			Context: options.Context,
+			Logger:  options.Logger,
+			Name:    options.Name,
+			Dialer:  options.Dialer,
+			Address: bootstrap,
+		})
+		if err != nil {
+			dialer.Close()
+			return nil, E.Cause(err, "create bootstrap transport")
+		}
+		dialer.bootstrap = append(dialer.bootstrap, bootstrapTransport)
+	}
+	return dialer, nil
+}
+
+func (d *stampDialer) Start() error {
+	for _, bootstrap := range d.bootstrap {
+		err := bootstrap.Start()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *stampDialer) Reset() {
+	if d.addresses != nil {
+		d.access.Lock()
+		d.addresses.Purge()
+		d.access.Unlock()
+	}
+	for _, bootstrap := range d.bootstrap {
+		bootstrap.Reset()
+	}
+}
+
+func (d *stampDialer) Close() error {
+	var errors []error
+	for _, bootstrap := range d.bootstrap {
+		errors = append(errors, bootstrap.Close())
+	}
+	return E.Errors(errors...)
+}
+
+func (d *stampDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	destination, err := d.resolve(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	return d.dialer.DialContext(ctx, network, destination)
+}
+
+func (d *stampDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	destination, err := d.resolve(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	return d.dialer.ListenPacket(ctx, destination)
+}
+
+func (d *stampDialer) resolve(ctx context.Context, destination M.Socksaddr) (M.Socksaddr, error) {
+	if d.serverAddr.IsValid() {
+		port := d.serverAddr.Port()
+		if port == 0 {
+			port = destination.Port
+		}
+		return M.SocksaddrFrom(d.serverAddr.Addr(), port), nil
+	}
+	if destination.IsIP() || d.addresses == nil {
+		return destination, nil
+	}
+	d.access.Lock()
+	addr, loaded := d.addresses.Get(destination.Fqdn)
+	d.access.Unlock()
+	if loaded {
+		return M.SocksaddrFrom(addr, destination.Port), nil
+	}
+	addr, ttl, err := d.lookup(ctx, destination.Fqdn)
+	if err != nil {
+		return M.Socksaddr{}, err
+	}
+	if ttl > 0 {
+		d.access.Lock()
+		d.addresses.AddWithLifetime(destination.Fqdn, addr, time.Duration(ttl)*time.Second)
+		d.access.Unlock()
+	}
+	return M.SocksaddrFrom(addr, destination.Port), nil
+}
+
+func (d *stampDialer) lookup(ctx context.Context, domain string) (netip.Addr, uint32, error) {
+	var lookupErrors []error
+	for _, bootstrap := range d.bootstrap {
+		for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			message := new(dns.Msg)
+			message.SetQuestion(dns.Fqdn(domain), qType)
+			response, err := bootstrap.Exchange(ctx, message)
+			if err != nil {
+				lookupErrors = append(lookupErrors, err)
+				continue
+			}
+			for _, record := range response.Answer {
+				switch answer := record.(type) {
+				case *dns.A:
+					return M.AddrFromIP(answer.A).Unmap(), answer.Hdr.Ttl, nil
+				case *dns.AAAA:
+					return M.AddrFromIP(answer.AAAA), answer.Hdr.Ttl, nil
+				}
+			}
+		}
+	}
+	if len(lookupErrors) > 0 {
+		return netip.Addr{}, 0, E.Cause(E.Errors(lookupErrors...), "bootstrap lookup ", domain)
+	}
+	return netip.Addr{}, 0, E.New("bootstrap lookup ", domain, ": no addresses")
+}
+
+func (d *stampDialer) Upstream() any {
+	return d.dialer
+}
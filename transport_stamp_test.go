@@ -0,0 +1,250 @@
+package dns_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+type stampBuilder struct {
+	data []byte
+}
+
+func newStampBuilder(protocol dns.StampProtocol, props uint64) *stampBuilder {
+	builder := &stampBuilder{data: []byte{byte(protocol)}}
+	if protocol != dns.StampProtocolDNSCryptRelay {
+		builder.data = binary.LittleEndian.AppendUint64(builder.data, props)
+	}
+	return builder
+}
+
+func (b *stampBuilder) lp(value string) *stampBuilder {
+	b.data = append(b.data, byte(len(value)))
+	b.data = append(b.data, value...)
+	return b
+}
+
+func (b *stampBuilder) vlp(values ...[]byte) *stampBuilder {
+	if len(values) == 0 {
+		b.data = append(b.data, 0)
+		return b
+	}
+	for i, value := range values {
+		length := byte(len(value))
+		if i < len(values)-1 {
+			length |= 0x80
+		}
+		b.data = append(b.data, length)
+		b.data = append(b.data, value...)
+	}
+	return b
+}
+
+func (b *stampBuilder) String() string {
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b.data)
+}
+
+func TestParseStampProtocols(t *testing.T) {
+	t.Parallel()
+	firstHash := bytes.Repeat([]byte{1}, 32)
+	secondHash := bytes.Repeat([]byte{2}, 32)
+	stamp, err := dns.ParseStamp(newStampBuilder(dns.StampProtocolDoH, dns.StampPropertyNoLog).
+		lp("[2606:4700::1111]:443").
+		vlp(firstHash, secondHash).
+		lp("dns.example.com").
+		lp("/dns-query").
+		vlp([]byte("1.1.1.1"), []byte("[2606:4700::1111]")).
+		String())
+	require.NoError(t, err)
+	require.Equal(t, &dns.ServerStamp{
+		Protocol:     dns.StampProtocolDoH,
+		Props:        dns.StampPropertyNoLog,
+		ServerAddr:   "[2606:4700::1111]:443",
+		ProviderName: "dns.example.com",
+		Hashes:       [][]byte{firstHash, secondHash},
+		Path:         "/dns-query",
+		Bootstrap:    []string{"1.1.1.1", "[2606:4700::1111]"},
+	}, stamp)
+
+	stamp, err = dns.ParseStamp(newStampBuilder(dns.StampProtocolTLS, 0).lp("").vlp().lp("dns.example.com:853").String())
+	require.NoError(t, err)
+	require.Equal(t, dns.StampProtocolTLS, stamp.Protocol)
+	require.Empty(t, stamp.ServerAddr)
+	require.Empty(t, stamp.Hashes)
+	require.Equal(t, "dns.example.com:853", stamp.ProviderName)
+
+	stamp, err = dns.ParseStamp(newStampBuilder(dns.StampProtocolODoHTarget, 0).lp("odoh.example.com").lp("/dns-query").String())
+	require.NoError(t, err)
+	require.Equal(t, "odoh.example.com", stamp.ProviderName)
+	require.Equal(t, "/dns-query", stamp.Path)
+
+	stamp, err = dns.ParseStamp(newStampBuilder(dns.StampProtocolDNSCryptRelay, 0).lp("192.0.2.1:443").String())
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:443", stamp.ServerAddr)
+
+	_, err = dns.ParseStamp(newStampBuilder(dns.StampProtocolDoH, 0).lp("").vlp([]byte{1, 2, 3}).lp("dns.example.com").lp("/").String())
+	require.Error(t, err)
+	_, err = dns.ParseStamp(newStampBuilder(dns.StampProtocolTLS, 0).lp("").vlp().lp("").String())
+	require.Error(t, err)
+	_, err = dns.ParseStamp(newStampBuilder(0x42, 0).String())
+	require.Error(t, err)
+}
+
+func TestStampTransportPlain(t *testing.T) {
+	t.Parallel()
+	dnsServer, err := server.NewServer(server.Options{
+		Logger: logger.NOP(),
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 300), nil
+		}),
+	})
+	require.NoError(t, err)
+	defer dnsServer.Close()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go dnsServer.ServeUDP(packetConn)
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: newStampBuilder(dns.StampProtocolPlain, 0).lp(packetConn.LocalAddr().String()).String(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+}
+
+func TestStampTransportDoH(t *testing.T) {
+	t.Parallel()
+	httpServer := httptest.NewTLSServer(server.NewHTTPHandler(logger.NOP(), server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+		return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 300), nil
+	})))
+	defer httpServer.Close()
+	certPool := x509.NewCertPool()
+	certPool.AddCert(httpServer.Certificate())
+	certHash := sha256.Sum256(httpServer.Certificate().RawTBSCertificate)
+	for _, testCase := range []struct {
+		name string
+		hash []byte
+		err  bool
+	}{
+		{"pinned", certHash[:], false},
+		{"unpinned", nil, false},
+		{"mismatch", bytes.Repeat([]byte{0}, 32), true},
+	} {
+		builder := newStampBuilder(dns.StampProtocolDoH, 0).lp(httpServer.Listener.Addr().String())
+		if testCase.hash != nil {
+			builder.vlp(testCase.hash)
+		} else {
+			builder.vlp()
+		}
+		builder.lp("example.com").lp("/dns-query")
+		transport, err := dns.CreateTransport(dns.TransportOptions{
+			Context:   context.Background(),
+			Logger:    logger.NOP(),
+			Dialer:    N.SystemDialer,
+			Address:   builder.String(),
+			TLSConfig: &tls.Config{RootCAs: certPool},
+		})
+		require.NoError(t, err, testCase.name)
+		response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+		transport.Close()
+		if testCase.err {
+			require.Error(t, err, testCase.name)
+		} else {
+			require.NoError(t, err, testCase.name)
+			require.Len(t, response.Answer, 1, testCase.name)
+		}
+	}
+}
+
+func TestStampTransportBootstrap(t *testing.T) {
+	t.Parallel()
+	var bootstrapQueries atomic.Int32
+	bootstrapServer, err := server.NewServer(server.Options{
+		Logger: logger.NOP(),
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			bootstrapQueries.Add(1)
+			return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr("127.0.0.1")}, 300), nil
+		}),
+	})
+	require.NoError(t, err)
+	defer bootstrapServer.Close()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go bootstrapServer.ServeUDP(packetConn)
+	httpServer := httptest.NewUnstartedServer(server.NewHTTPHandler(logger.NOP(), server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+		return dns.FixedResponse(message.Id, message.Question[0], []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 300), nil
+	})))
+	httpServer.Config.SetKeepAlivesEnabled(false)
+	httpServer.StartTLS()
+	defer httpServer.Close()
+	certPool := x509.NewCertPool()
+	certPool.AddCert(httpServer.Certificate())
+	_, port, err := net.SplitHostPort(httpServer.Listener.Addr().String())
+	require.NoError(t, err)
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: newStampBuilder(dns.StampProtocolDoH, 0).
+			lp("").
+			vlp().
+			lp(net.JoinHostPort("example.com", port)).
+			lp("/dns-query").
+			vlp([]byte(packetConn.LocalAddr().String())).
+			String(),
+		TLSConfig: &tls.Config{RootCAs: certPool},
+	})
+	require.NoError(t, err)
+	require.NoError(t, transport.Start())
+	defer transport.Close()
+	for i := 0; i < 2; i++ {
+		response, err := transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+		require.NoError(t, err)
+		require.Len(t, response.Answer, 1)
+	}
+	require.Equal(t, int32(1), bootstrapQueries.Load())
+	transport.Reset()
+	_, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), bootstrapQueries.Load())
+}
+
+func TestStampTransportUnsupported(t *testing.T) {
+	t.Parallel()
+	_, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: newStampBuilder(dns.StampProtocolODoHTarget, 0).lp("odoh.example.com").lp("/dns-query").String(),
+	})
+	require.ErrorContains(t, err, "no transport registered for ODoH target stamp")
+	_, err = dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: newStampBuilder(dns.StampProtocolDNSCryptRelay, 0).lp("192.0.2.1:443").String(),
+	})
+	require.ErrorContains(t, err, "unsupported stamp protocol for transport")
+}
@@ -0,0 +1,343 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	staticDefaultNegativeTTL = 300
+	staticMaxCNAMEChain      = 8
+)
+
+var _ Transport = (*StaticTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"static"}, func(options TransportOptions) (Transport, error) {
+		return NewStaticTransport(options)
+	})
+}
+
+type StaticTransport struct {
+	name     string
+	records  *staticRecords
+	fallback Transport
+}
+
+func NewStaticTransport(options TransportOptions) (*StaticTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	query := serverURL.Query()
+	var records []dns.RR
+	for _, record := range query["record"] {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, E.Cause(err, "parse record: ", record)
+		}
+		if rr == nil {
+			continue
+		}
+		records = append(records, rr)
+	}
+	if len(records) == 0 {
+		return nil, E.New("missing records")
+	}
+	var fallback Transport
+	if fallbackAddress := query.Get("fallback"); fallbackAddress != "" {
+		fallbackOptions := options
+		fallbackOptions.Name = options.Name + "/fallback"
+		fallbackOptions.Address = fallbackAddress
+		fallback, err = CreateTransport(fallbackOptions)
+		if err != nil {
+			return nil, E.Cause(err, "create fallback transport")
+		}
+	}
+	return &StaticTransport{
+		name:     options.Name,
+		records:  newStaticRecords(records, query["zone"]),
+		fallback: fallback,
+	}, nil
+}
+
+func (t *StaticTransport) Name() string {
+	return t.name
+}
+
+func (t *StaticTransport) Start() error {
+	if t.fallback != nil {
+		return t.fallback.Start()
+	}
+	return nil
+}
+
+func (t *StaticTransport) Reset() {
+	if t.fallback != nil {
+		t.fallback.Reset()
+	}
+}
+
+func (t *StaticTransport) Close() error {
+	if t.fallback != nil {
+		return t.fallback.Close()
+	}
+	return nil
+}
+
+func (t *StaticTransport) Raw() bool {
+	return true
+}
+
+func (t *StaticTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *StaticTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) == 1 && message.Question[0].Qclass == dns.ClassINET {
+		response := t.records.exchange(message)
+		if response != nil {
+			return response, nil
+		}
+	}
+	if t.fallback != nil {
+		return t.fallback.Exchange(ctx, message)
+	}
+	response := new(dns.Msg)
+	response.SetRcode(message, dns.RcodeNameError)
+	return response, nil
+}
+
+type staticRecords struct {
+	records map[string][]dns.RR
+	names   map[string]bool
+	apexes  map[string]*dns.SOA
+}
+
+func newStaticRecords(records []dns.RR, zones []string) *staticRecords {
+	s := &staticRecords{
+		records: make(map[string][]dns.RR),
+		names:   make(map[string]bool),
+		apexes:  make(map[string]*dns.SOA),
+	}
+	for _, record := range records {
+		owner := strings.ToLower(record.Header().Name)
+		s.records[owner] = append(s.records[owner], record)
+		for off, end := 0, false; !end; off, end = dns.NextLabel(owner, off) {
+			s.names[owner[off:]] = true
+		}
+		if soa, isSOA := record.(*dns.SOA); isSOA {
+			s.apexes[owner] = soa
+		}
+	}
+	for _, zone := range zones {
+		apex := dns.Fqdn(strings.ToLower(zone))
+		if s.apexes[apex] == nil {
+			s.apexes[apex] = newStaticSOA(apex)
+		}
+	}
+	return s
+}
+
+func newStaticSOA(apex string) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   apex,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    staticDefaultNegativeTTL,
+		},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster." + strings.TrimPrefix(apex, "."),
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  staticDefaultNegativeTTL,
+	}
+}
+
+func (s *staticRecords) findSOA(name string) *dns.SOA {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if soa := s.apexes[name[off:]]; soa != nil {
+			return soa
+		}
+	}
+	return s.apexes["."]
+}
+
+func (s *staticRecords) lookupOwner(name string) ([]dns.RR, *dns.SOA) {
+	records, _ := s.lookup(name)
+	if len(records) == 0 {
+		return nil, nil
+	}
+	apex := "."
+	if off, end := dns.NextLabel(strings.ToLower(name), 0); !end {
+		apex = strings.ToLower(name)[off:]
+	}
+	return records, newStaticSOA(apex)
+}
+
+func (s *staticRecords) lookup(name string) ([]dns.RR, bool) {
+	lowerName := strings.ToLower(name)
+	if records, loaded := s.records[lowerName]; loaded {
+		return copyRecords(records, ""), true
+	}
+	if s.names[lowerName] {
+		return nil, true
+	}
+	for off, end := dns.NextLabel(lowerName, 0); !end; off, end = dns.NextLabel(lowerName, off) {
+		ancestor := lowerName[off:]
+		if !s.names[ancestor] {
+			continue
+		}
+		wildcard := s.records["*."+ancestor]
+		if wildcard == nil {
+			return nil, false
+		}
+		return copyRecords(wildcard, name), true
+	}
+	return nil, false
+}
+
+func copyRecords(records []dns.RR, owner string) []dns.RR {
+	recordsCopy := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		record = dns.Copy(record)
+		if owner != "" {
+			record.Header().Name = owner
+		}
+		recordsCopy = append(recordsCopy, record)
+	}
+	return recordsCopy
+}
+
+func (s *staticRecords) exchange(message *dns.Msg) *dns.Msg {
+	question := message.Question[0]
+	name := question.Name
+	soa := s.findSOA(strings.ToLower(name))
+	var records []dns.RR
+	if soa == nil {
+		records, soa = s.lookupOwner(name)
+		if soa == nil {
+			return nil
+		}
+	}
+	response := new(dns.Msg)
+	response.SetReply(message)
+	response.Authoritative = records == nil
+	for chain := 0; ; chain++ {
+		if records == nil {
+			if delegation := s.findDelegation(strings.ToLower(name), soa.Hdr.Name, question.Qtype); len(delegation) > 0 {
+				response.Authoritative = false
+				response.Ns = delegation
+				response.Extra = append(response.Extra, s.additional(delegation)...)
+				return response
+			}
+			var exists bool
+			records, exists = s.lookup(name)
+			if !exists {
+				response.Rcode = dns.RcodeNameError
+				response.Ns = []dns.RR{negativeSOA(soa)}
+				return response
+			}
+		}
+		var answers []dns.RR
+		var cname *dns.CNAME
+		for _, record := range records {
+			if record.Header().Rrtype == question.Qtype || question.Qtype == dns.TypeANY {
+				answers = append(answers, record)
+			} else if it, isCNAME := record.(*dns.CNAME); isCNAME {
+				cname = it
+			}
+		}
+		if len(answers) > 0 {
+			response.Answer = append(response.Answer, answers...)
+			response.Extra = append(response.Extra, s.additional(answers)...)
+			return response
+		}
+		if cname == nil {
+			response.Ns = []dns.RR{negativeSOA(soa)}
+			return response
+		}
+		response.Answer = append(response.Answer, cname)
+		if chain >= staticMaxCNAMEChain {
+			response.Rcode = dns.RcodeServerFailure
+			return response
+		}
+		name = cname.Target
+		records = nil
+		soa = s.findSOA(strings.ToLower(name))
+		if soa == nil {
+			records, soa = s.lookupOwner(name)
+			if soa == nil {
+				return response
+			}
+		}
+	}
+}
+
+func (s *staticRecords) findDelegation(name string, apex string, qType uint16) []dns.RR {
+	apex = strings.ToLower(apex)
+	var ancestors []string
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if name[off:] == apex {
+			break
+		}
+		ancestors = append(ancestors, name[off:])
+	}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		if i == 0 && qType == dns.TypeDS {
+			break
+		}
+		var delegation []dns.RR
+		for _, record := range s.records[ancestors[i]] {
+			if record.Header().Rrtype == dns.TypeNS {
+				delegation = append(delegation, dns.Copy(record))
+			}
+		}
+		if len(delegation) > 0 {
+			return delegation
+		}
+	}
+	return nil
+}
+
+func (s *staticRecords) additional(answers []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, answer := range answers {
+		var target string
+		switch record := answer.(type) {
+		case *dns.MX:
+			target = record.Mx
+		case *dns.SRV:
+			target = record.Target
+		case *dns.NS:
+			target = record.Ns
+		default:
+			continue
+		}
+		for _, record := range s.records[strings.ToLower(target)] {
+			switch record.Header().Rrtype {
+			case dns.TypeA, dns.TypeAAAA:
+				extra = append(extra, dns.Copy(record))
+			}
+		}
+	}
+	return extra
+}
+
+func negativeSOA(soa *dns.SOA) dns.RR {
+	record := dns.Copy(soa)
+	if soa.Minttl < soa.Hdr.Ttl {
+		record.Header().Ttl = soa.Minttl
+	}
+	return record
+}
@@ -0,0 +1,164 @@
+package dns_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticTransport(t *testing.T) {
+	t.Parallel()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "static://?" + url.Values{
+			"zone": {"example.internal"},
+			"record": {
+				"example.internal. 300 IN MX 10 mail.example.internal.",
+				"example.internal. 300 IN TXT \"v=spf1 -all\"",
+				"mail.example.internal. 300 IN A 10.0.0.25",
+				"www.example.internal. 300 IN CNAME web.example.internal.",
+				"web.example.internal. 300 IN A 10.0.0.80",
+				"web.example.internal. 300 IN HTTPS 1 . alpn=h2",
+				"_sip._tcp.example.internal. 300 IN SRV 10 5 5060 mail.example.internal.",
+				"*.apps.example.internal. 60 IN A 10.0.1.1",
+				"25.0.0.10.in-addr.arpa. 300 IN PTR mail.example.internal.",
+				"ext.example.internal. 300 IN CNAME example.com.",
+			},
+		}.Encode(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	response, err := transport.Exchange(context.Background(), newTestQuery("www.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.True(t, response.Authoritative)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, mDNS.TypeCNAME, response.Answer[0].Header().Rrtype)
+	require.Equal(t, "10.0.0.80", response.Answer[1].(*mDNS.A).A.String())
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("www.example.internal", mDNS.TypeHTTPS))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 2)
+	require.Equal(t, mDNS.TypeHTTPS, response.Answer[1].Header().Rrtype)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.internal", mDNS.TypeMX))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Len(t, response.Extra, 1)
+	require.Equal(t, "10.0.0.25", response.Extra[0].(*mDNS.A).A.String())
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("_sip._tcp.example.internal", mDNS.TypeSRV))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint16(5060), response.Answer[0].(*mDNS.SRV).Port)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("25.0.0.10.in-addr.arpa", mDNS.TypePTR))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "mail.example.internal.", response.Answer[0].(*mDNS.PTR).Ptr)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("foo.bar.apps.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "foo.bar.apps.example.internal.", response.Answer[0].Header().Name)
+	require.Equal(t, "10.0.1.1", response.Answer[0].(*mDNS.A).A.String())
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("foo.apps.example.internal", mDNS.TypeAAAA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Len(t, response.Ns, 1)
+	require.Equal(t, "example.internal.", response.Ns[0].Header().Name)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("web.example.internal", mDNS.TypeTXT))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Equal(t, mDNS.TypeSOA, response.Ns[0].Header().Rrtype)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("missing.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.Equal(t, mDNS.TypeSOA, response.Ns[0].Header().Rrtype)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("apps.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("ext.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "example.com.", response.Answer[0].(*mDNS.CNAME).Target)
+}
+
+func TestStaticTransportFallback(t *testing.T) {
+	t.Parallel()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "static://?" + url.Values{
+			"record":   {"nas.lan. IN A 10.0.0.2"},
+			"fallback": {"rcode://refused"},
+		}.Encode(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	response, err := transport.Exchange(context.Background(), newTestQuery("nas.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint32(3600), response.Answer[0].Header().Ttl)
+	response, err = transport.Exchange(context.Background(), newTestQuery("nas.lan", mDNS.TypeAAAA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Equal(t, "lan.", response.Ns[0].Header().Name)
+	response, err = transport.Exchange(context.Background(), newTestQuery("other.lan", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeRefused, response.Rcode)
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeRefused, response.Rcode)
+}
+
+func TestStaticTransportSplitHorizon(t *testing.T) {
+	t.Parallel()
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "static://?" + url.Values{
+			"zone": {"corp.example.com"},
+			"record": {
+				"a.example.com. 300 IN A 10.0.0.1",
+				"b.corp.example.com. 300 IN A 10.0.0.2",
+			},
+			"fallback": {"static://?" + url.Values{"record": {"b.example.com. 300 IN A 192.0.2.2"}}.Encode()},
+		}.Encode(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	response, err := transport.Exchange(context.Background(), newTestQuery("a.example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", response.Answer[0].(*mDNS.A).A.String())
+	response, err = transport.Exchange(context.Background(), newTestQuery("b.example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "192.0.2.2", response.Answer[0].(*mDNS.A).A.String())
+	response, err = transport.Exchange(context.Background(), newTestQuery("c.corp.example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.True(t, response.Authoritative)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+}
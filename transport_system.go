@@ -0,0 +1,410 @@
+//go:build unix
+
+package dns
+
+import (
+	"bufio"
+	"context"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultResolvConfPath = "/etc/resolv.conf"
+
+	resolvConfCheckInterval = 5 * time.Second
+	resolvConfMaxNameserver = 3
+	resolvConfMaxNdots      = 15
+	resolvConfMaxTimeout    = 30
+	resolvConfMaxAttempts   = 5
+	resolvConfEDNS0UDPSize  = 1232
+)
+
+var _ Transport = (*SystemTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"system"}, func(options TransportOptions) (Transport, error) {
+		return NewSystemTransport(options)
+	})
+}
+
+type SystemTransport struct {
+	name       string
+	ctx        context.Context
+	logger     logger.ContextLogger
+	dialer     N.Dialer
+	path       string
+	access     sync.Mutex
+	checkedAt  time.Time
+	modTime    time.Time
+	size       int64
+	config     *resolvConf
+	transports []Transport
+	rotate     atomic.Uint32
+}
+
+type resolvConf struct {
+	servers  []netip.AddrPort
+	search   []string
+	ndots    int
+	timeout  time.Duration
+	attempts int
+	rotate   bool
+	edns0    bool
+	useTCP   bool
+}
+
+func NewSystemTransport(options TransportOptions) (*SystemTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	path := serverURL.Path
+	if path == "" {
+		path = DefaultResolvConfPath
+	}
+	return &SystemTransport{
+		name:   options.Name,
+		ctx:    options.Context,
+		logger: options.Logger,
+		dialer: options.Dialer,
+		path:   path,
+	}, nil
+}
+
+func (t *SystemTransport) Name() string {
+	return t.name
+}
+
+func (t *SystemTransport) Start() error {
+	_, _, err := t.loadConfig()
+	return err
+}
+
+func (t *SystemTransport) Reset() {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.checkedAt = time.Time{}
+	for _, transport := range t.transports {
+		transport.Reset()
+	}
+}
+
+func (t *SystemTransport) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	for _, transport := range t.transports {
+		transport.Close()
+	}
+	t.transports = nil
+	t.config = nil
+	return nil
+}
+
+func (t *SystemTransport) Raw() bool {
+	return true
+}
+
+func (t *SystemTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *SystemTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	config, transports, err := t.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	var edns0Added bool
+	if config.edns0 && message.IsEdns0() == nil {
+		message = message.Copy()
+		message.SetEdns0(resolvConfEDNS0UDPSize, false)
+		edns0Added = true
+	}
+	var response *dns.Msg
+	if len(message.Question) != 1 {
+		response, err = t.exchangeServers(ctx, config, transports, message)
+	} else {
+		response, err = t.exchangeSearch(ctx, config, transports, message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if edns0Added {
+		response.Extra = common.Filter(response.Extra, func(it dns.RR) bool {
+			return it.Header().Rrtype != dns.TypeOPT
+		})
+	}
+	return response, nil
+}
+
+func (t *SystemTransport) exchangeSearch(ctx context.Context, config *resolvConf, transports []Transport, message *dns.Msg) (*dns.Msg, error) {
+	question := message.Question[0]
+	var nameErrorResponse *dns.Msg
+	for _, name := range config.nameList(question.Name) {
+		exMessage := message
+		if name != question.Name {
+			exMessage = message.Copy()
+			exMessage.Question[0].Name = name
+		}
+		response, err := t.exchangeServers(ctx, config, transports, exMessage)
+		if err != nil {
+			return nil, err
+		}
+		if name != question.Name {
+			restoreSearchName(response, name, question.Name)
+		}
+		if response.Rcode != dns.RcodeNameError {
+			return response, nil
+		}
+		if nameErrorResponse == nil || name == question.Name {
+			nameErrorResponse = response
+		}
+	}
+	return nameErrorResponse, nil
+}
+
+func restoreSearchName(response *dns.Msg, searchName string, name string) {
+	for i := range response.Question {
+		if strings.EqualFold(response.Question[i].Name, searchName) {
+			response.Question[i].Name = name
+		}
+	}
+	for _, record := range response.Answer {
+		if strings.EqualFold(record.Header().Name, searchName) {
+			record.Header().Name = name
+		}
+	}
+}
+
+func (t *SystemTransport) exchangeServers(ctx context.Context, config *resolvConf, transports []Transport, message *dns.Msg) (*dns.Msg, error) {
+	var start int
+	if config.rotate {
+		start = int(t.rotate.Add(1)-1) % len(transports)
+	}
+	var (
+		lastResponse   *dns.Msg
+		exchangeErrors []error
+	)
+	for attempt := 0; attempt < config.attempts; attempt++ {
+		for i := range transports {
+			transport := transports[(start+i)%len(transports)]
+			exchangeCtx, cancel := context.WithTimeout(ctx, config.timeout)
+			response, err := transport.Exchange(exchangeCtx, message)
+			cancel()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, E.Errors(append(exchangeErrors, err)...)
+				}
+				exchangeErrors = append(exchangeErrors, err)
+				continue
+			}
+			switch response.Rcode {
+			case dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNotImplemented:
+				lastResponse = response
+				continue
+			}
+			return response, nil
+		}
+	}
+	if lastResponse != nil {
+		return lastResponse, nil
+	}
+	return nil, E.Errors(exchangeErrors...)
+}
+
+func (t *SystemTransport) loadConfig() (*resolvConf, []Transport, error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.config != nil && time.Since(t.checkedAt) < resolvConfCheckInterval {
+		return t.config, t.transports, nil
+	}
+	t.checkedAt = time.Now()
+	fileInfo, err := os.Stat(t.path)
+	if err != nil {
+		if t.config != nil {
+			return t.config, t.transports, nil
+		}
+		return nil, nil, err
+	}
+	if t.config != nil && fileInfo.ModTime().Equal(t.modTime) && fileInfo.Size() == t.size {
+		return t.config, t.transports, nil
+	}
+	config, err := readResolvConf(t.path)
+	if err != nil {
+		if t.config != nil {
+			t.logger.Error(E.Cause(err, "reload ", t.path))
+			return t.config, t.transports, nil
+		}
+		return nil, nil, err
+	}
+	transports := make([]Transport, 0, len(config.servers))
+	for _, server := range config.servers {
+		serverOptions := TransportOptions{
+			Context: t.ctx,
+			Logger:  t.logger,
+			Name:    t.name,
+			Dialer:  t.dialer,
+			Address: server.String(),
+		}
+		if config.useTCP {
+			transports = append(transports, newTCPTransport(serverOptions, M.SocksaddrFromNetIP(server)))
+		} else {
+			transport, err := NewUDPTransport(serverOptions)
+			if err != nil {
+				return nil, nil, err
+			}
+			transports = append(transports, transport)
+		}
+	}
+	for _, transport := range t.transports {
+		transport.Close()
+	}
+	if t.config != nil {
+		t.logger.Info("reloaded ", t.path)
+	}
+	t.modTime = fileInfo.ModTime()
+	t.size = fileInfo.Size()
+	t.config = config
+	t.transports = transports
+	return config, transports, nil
+}
+
+func readResolvConf(path string) (*resolvConf, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config := &resolvConf{
+		ndots:    1,
+		timeout:  5 * time.Second,
+		attempts: 2,
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexAny(line, "#;"); index != -1 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 || len(config.servers) >= resolvConfMaxNameserver {
+				continue
+			}
+			addr, err := netip.ParseAddr(fields[1])
+			if err != nil {
+				continue
+			}
+			config.servers = append(config.servers, netip.AddrPortFrom(addr, 53))
+		case "domain":
+			if len(fields) > 1 {
+				config.search = []string{dns.Fqdn(fields[1])}
+			}
+		case "search":
+			config.search = make([]string, 0, len(fields)-1)
+			for _, domain := range fields[1:] {
+				if domain == "." {
+					continue
+				}
+				config.search = append(config.search, dns.Fqdn(domain))
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				name, value, _ := strings.Cut(option, ":")
+				switch name {
+				case "ndots":
+					config.ndots = parseResolvConfOption(value, 0, resolvConfMaxNdots, config.ndots)
+				case "timeout":
+					config.timeout = time.Duration(parseResolvConfOption(value, 1, resolvConfMaxTimeout, int(config.timeout/time.Second))) * time.Second
+				case "attempts":
+					config.attempts = parseResolvConfOption(value, 1, resolvConfMaxAttempts, config.attempts)
+				case "rotate":
+					config.rotate = true
+				case "edns0":
+					config.edns0 = true
+				case "use-vc", "usevc", "tcp":
+					config.useTCP = true
+				}
+			}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(config.servers) == 0 {
+		config.servers = []netip.AddrPort{
+			netip.MustParseAddrPort("127.0.0.1:53"),
+			netip.MustParseAddrPort("[::1]:53"),
+		}
+	}
+	if config.search == nil {
+		config.search = defaultResolvConfSearch()
+	}
+	return config, nil
+}
+
+func parseResolvConfOption(value string, minValue int, maxValue int, defaultValue int) int {
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue
+	}
+	if number < minValue {
+		return minValue
+	}
+	if number > maxValue {
+		return maxValue
+	}
+	return number
+}
+
+func defaultResolvConfSearch() []string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil
+	}
+	_, domain, loaded := strings.Cut(hostname, ".")
+	if !loaded || domain == "" {
+		return nil
+	}
+	return []string{dns.Fqdn(domain)}
+}
+
+func (c *resolvConf) nameList(name string) []string {
+	if len(c.search) == 0 || name == "." {
+		return []string{name}
+	}
+	hasNdots := dns.CountLabel(name)-1 >= c.ndots
+	names := make([]string, 0, 1+len(c.search))
+	if hasNdots {
+		names = append(names, name)
+	}
+	for _, suffix := range c.search {
+		searchName := name + suffix
+		if len(searchName) <= 254 {
+			names = append(names, searchName)
+		}
+	}
+	if !hasNdots {
+		names = append(names, name)
+	}
+	return names
+}
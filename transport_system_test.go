@@ -0,0 +1,118 @@
+//go:build unix
+
+package dns_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing-dns/server"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func startSearchTestServer(t *testing.T, address netip.Addr, edns0 *atomic.Bool) M.Socksaddr {
+	dnsServer, err := server.NewServer(server.Options{
+		Logger: logger.NOP(),
+		Handler: server.HandlerFunc(func(ctx context.Context, source M.Socksaddr, message *mDNS.Msg) (*mDNS.Msg, error) {
+			edns0.Store(message.IsEdns0() != nil)
+			question := message.Question[0]
+			if question.Name != "example.com." && question.Name != "printer.corp.example." {
+				response := new(mDNS.Msg)
+				response.SetRcode(message, mDNS.RcodeNameError)
+				return response, nil
+			}
+			response := dns.FixedResponse(message.Id, question, []netip.Addr{address}, 120)
+			if question.Qtype == mDNS.TypeTXT {
+				response.Answer = []mDNS.RR{&mDNS.TXT{
+					Hdr: mDNS.RR_Header{Name: question.Name, Rrtype: mDNS.TypeTXT, Class: mDNS.ClassINET, Ttl: 120},
+					Txt: []string{"hello"},
+				}}
+			}
+			return response, nil
+		}),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		dnsServer.Close()
+	})
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go dnsServer.ServeUDP(packetConn)
+	return M.SocksaddrFromNet(packetConn.LocalAddr())
+}
+
+func TestSystemTransport(t *testing.T) {
+	t.Parallel()
+	var edns0 atomic.Bool
+	dialer := &redirectDialer{
+		Dialer: N.SystemDialer,
+		destinations: map[M.Socksaddr]M.Socksaddr{
+			M.ParseSocksaddr("127.0.0.1:53"): startSearchTestServer(t, netip.MustParseAddr("1.1.1.1"), &edns0),
+			M.ParseSocksaddr("127.0.0.2:53"): startSearchTestServer(t, netip.MustParseAddr("2.2.2.2"), &edns0),
+		},
+	}
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(path, []byte("# test\nnameserver 127.0.0.1\nsearch corp.example\noptions ndots:1 edns0 timeout:1\n"), 0o644))
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  dialer,
+		Address: "system://" + path,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.NoError(t, transport.Start())
+	require.True(t, transport.Raw())
+
+	response, err := transport.Exchange(context.Background(), newTestQuery("printer", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "printer.", response.Question[0].Name)
+	require.Equal(t, "printer.", response.Answer[0].Header().Name)
+	require.True(t, edns0.Load())
+	require.Nil(t, response.IsEdns0())
+
+	client := dns.NewClient(dns.ClientOptions{Logger: logger.NOP()})
+	addresses, err := client.Lookup(context.Background(), transport, "printer", dns.QueryOptions{Strategy: dns.DomainStrategyUseIPv4})
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("1.1.1.1")}, addresses)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeTXT))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint32(120), response.Answer[0].Header().Ttl)
+	require.Equal(t, []string{"hello"}, response.Answer[0].(*mDNS.TXT).Txt)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("missing.example.org", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.Equal(t, "missing.example.org.", response.Question[0].Name)
+
+	require.NoError(t, os.WriteFile(path, []byte("nameserver 127.0.0.2\noptions use-vc\n"), 0o644))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	transport.Reset()
+	_, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("nameserver 127.0.0.2\n"), 0o644))
+	modTime = modTime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	transport.Reset()
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, "2.2.2.2", response.Answer[0].(*mDNS.A).A.String())
+	require.False(t, edns0.Load())
+}
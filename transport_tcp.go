@@ -2,14 +2,11 @@ package dns
 
 import (
 	"context"
-	"encoding/binary"
-	"io"
 	"net/netip"
 	"net/url"
 	"os"
 
-	"github.com/sagernet/sing/common"
-	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing-dns/internal/wire"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
@@ -79,49 +76,13 @@ func (t *TCPTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg
 		return nil, err
 	}
 	defer conn.Close()
-	err = writeMessage(conn, 0, message)
+	err = wire.WriteMessage(conn, 0, message)
 	if err != nil {
 		return nil, err
 	}
-	return readMessage(conn)
+	return wire.ReadMessage(conn)
 }
 
 func (t *TCPTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
 	return nil, os.ErrInvalid
 }
-
-func readMessage(reader io.Reader) (*dns.Msg, error) {
-	var responseLen uint16
-	err := binary.Read(reader, binary.BigEndian, &responseLen)
-	if err != nil {
-		return nil, err
-	}
-	if responseLen < 10 {
-		return nil, dns.ErrShortRead
-	}
-	buffer := buf.NewSize(int(responseLen))
-	defer buffer.Release()
-	_, err = buffer.ReadFullFrom(reader, int(responseLen))
-	if err != nil {
-		return nil, err
-	}
-	var message dns.Msg
-	err = message.Unpack(buffer.Bytes())
-	return &message, err
-}
-
-func writeMessage(writer io.Writer, messageId uint16, message *dns.Msg) error {
-	requestLen := message.Len()
-	buffer := buf.NewSize(3 + requestLen)
-	defer buffer.Release()
-	common.Must(binary.Write(buffer, binary.BigEndian, uint16(requestLen)))
-	exMessage := *message
-	exMessage.Id = messageId
-	exMessage.Compress = true
-	rawMessage, err := exMessage.PackBuffer(buffer.FreeBytes())
-	if err != nil {
-		return err
-	}
-	buffer.Truncate(2 + len(rawMessage))
-	return common.Error(writer.Write(buffer.Bytes()))
-}
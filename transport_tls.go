@@ -8,6 +8,7 @@ import (
 	"os"
 	"sync"
 
+	"github.com/sagernet/sing-dns/internal/wire"
 	E "github.com/sagernet/sing/common/exceptions"
 	"github.com/sagernet/sing/common/logger"
 	M "github.com/sagernet/sing/common/metadata"
@@ -30,6 +31,7 @@ type TLSTransport struct {
 	dialer      N.Dialer
 	logger      logger.ContextLogger
 	serverAddr  M.Socksaddr
+	tlsConfig   *tls.Config
 	access      sync.Mutex
 	connections list.List[*tlsDNSConn]
 }
@@ -55,11 +57,21 @@ func NewTLSTransport(options TransportOptions) (*TLSTransport, error) {
 }
 
 func newTLSTransport(options TransportOptions, serverAddr M.Socksaddr) *TLSTransport {
+	var tlsConfig *tls.Config
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverAddr.AddrString()
+	}
 	return &TLSTransport{
 		name:       options.Name,
 		dialer:     options.Dialer,
 		logger:     options.Logger,
 		serverAddr: serverAddr,
+		tlsConfig:  tlsConfig,
 	}
 }
 
@@ -103,9 +115,7 @@ func (t *TLSTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg
 	if err != nil {
 		return nil, err
 	}
-	tlsConn := tls.Client(tcpConn, &tls.Config{
-		ServerName: t.serverAddr.AddrString(),
-	})
+	tlsConn := tls.Client(tcpConn, t.tlsConfig)
 	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
 		tcpConn.Close()
@@ -116,12 +126,12 @@ func (t *TLSTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg
 
 func (t *TLSTransport) exchange(message *dns.Msg, conn *tlsDNSConn) (*dns.Msg, error) {
 	conn.queryId++
-	err := writeMessage(conn, conn.queryId, message)
+	err := wire.WriteMessage(conn, conn.queryId, message)
 	if err != nil {
 		conn.Close()
 		return nil, E.Cause(err, "write request")
 	}
-	response, err := readMessage(conn)
+	response, err := wire.ReadMessage(conn)
 	if err != nil {
 		conn.Close()
 		return nil, E.Cause(err, "read response")
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
@@ -36,7 +37,7 @@ type UDPTransport struct {
 	logger       logger.ContextLogger
 	serverAddr   M.Socksaddr
 	clientAddr   netip.Prefix
-	udpSize      int
+	udpSize      atomic.Int32
 	tcpTransport *TCPTransport
 	access       sync.Mutex
 	conn         *dnsConnection
@@ -56,7 +57,7 @@ func NewUDPTransport(options TransportOptions) (*UDPTransport, error) {
 		serverAddr.Port = 53
 	}
 	ctx, cancel := context.WithCancel(options.Context)
-	return &UDPTransport{
+	transport := &UDPTransport{
 		name:         options.Name,
 		optCtx:       options.Context,
 		ctx:          ctx,
@@ -65,9 +66,10 @@ func NewUDPTransport(options TransportOptions) (*UDPTransport, error) {
 		logger:       options.Logger,
 		serverAddr:   serverAddr,
 		clientAddr:   options.ClientSubnet,
-		udpSize:      512,
 		tcpTransport: newTCPTransport(options, serverAddr),
-	}, nil
+	}
+	transport.udpSize.Store(512)
+	return transport, nil
 }
 
 func (t *UDPTransport) Name() string {
@@ -114,8 +116,12 @@ func (t *UDPTransport) exchange(ctx context.Context, message *dns.Msg) (*dns.Msg
 		return nil, err
 	}
 	if edns0Opt := message.IsEdns0(); edns0Opt != nil {
-		if udpSize := int(edns0Opt.UDPSize()); udpSize > t.udpSize {
-			t.udpSize = udpSize
+		udpSize := int32(edns0Opt.UDPSize())
+		for {
+			current := t.udpSize.Load()
+			if udpSize <= current || t.udpSize.CompareAndSwap(current, udpSize) {
+				break
+			}
 		}
 	}
 	buffer := buf.NewSize(1 + message.Len())
@@ -195,7 +201,7 @@ func (t *UDPTransport) recvLoop(conn *dnsConnection) {
 	var group task.Group
 	group.Append0(func(ctx context.Context) error {
 		for {
-			buffer := buf.NewSize(t.udpSize)
+			buffer := buf.NewSize(int(t.udpSize.Load()))
 			_, err := buffer.ReadOnceFrom(conn)
 			if err != nil {
 				buffer.Release()
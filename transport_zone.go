@@ -0,0 +1,215 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+
+	"github.com/miekg/dns"
+)
+
+const zoneCheckInterval = 5 * time.Second
+
+var _ Transport = (*ZoneTransport)(nil)
+
+func init() {
+	RegisterTransport([]string{"zone"}, func(options TransportOptions) (Transport, error) {
+		return NewZoneTransport(options)
+	})
+}
+
+type ZoneTransport struct {
+	name      string
+	logger    logger.ContextLogger
+	origin    string
+	access    sync.Mutex
+	checkedAt time.Time
+	files     []*zoneFile
+	records   *staticRecords
+}
+
+type zoneFile struct {
+	path    string
+	modTime time.Time
+	soa     *dns.SOA
+	records []dns.RR
+}
+
+func NewZoneTransport(options TransportOptions) (*ZoneTransport, error) {
+	serverURL, err := url.Parse(options.Address)
+	if err != nil {
+		return nil, err
+	}
+	query := serverURL.Query()
+	var paths []string
+	if serverURL.Path != "" {
+		paths = append(paths, serverURL.Path)
+	}
+	paths = append(paths, query["path"]...)
+	if len(paths) == 0 {
+		return nil, E.New("missing zone file path")
+	}
+	origin := "."
+	if query.Has("origin") {
+		origin = dns.Fqdn(query.Get("origin"))
+	}
+	transport := &ZoneTransport{
+		name:      options.Name,
+		logger:    options.Logger,
+		origin:    origin,
+		checkedAt: time.Now(),
+	}
+	apexes := make(map[string]string)
+	for _, path := range paths {
+		file := &zoneFile{path: path}
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		file.modTime = fileInfo.ModTime()
+		file.soa, file.records, err = readZoneFile(path, origin)
+		if err != nil {
+			return nil, err
+		}
+		apex := strings.ToLower(file.soa.Hdr.Name)
+		if otherPath, loaded := apexes[apex]; loaded {
+			return nil, E.New("duplicate zone ", apex, " in ", otherPath, " and ", path)
+		}
+		apexes[apex] = path
+		transport.files = append(transport.files, file)
+	}
+	transport.records = transport.buildRecords()
+	return transport, nil
+}
+
+func readZoneFile(path string, origin string) (*dns.SOA, []dns.RR, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	parser := dns.NewZoneParser(file, origin, path)
+	parser.SetIncludeAllowed(true)
+	var (
+		soa     *dns.SOA
+		records []dns.RR
+	)
+	for record, loaded := parser.Next(); loaded; record, loaded = parser.Next() {
+		if it, isSOA := record.(*dns.SOA); isSOA {
+			if soa != nil {
+				return nil, nil, E.New("multiple SOA records in ", path)
+			}
+			soa = it
+		}
+		records = append(records, record)
+	}
+	err = parser.Err()
+	if err != nil {
+		return nil, nil, E.Cause(err, "parse zone file ", path)
+	}
+	if soa == nil {
+		return nil, nil, E.New("missing SOA record in ", path)
+	}
+	apex := strings.ToLower(soa.Hdr.Name)
+	for _, record := range records {
+		if !dns.IsSubDomain(apex, strings.ToLower(record.Header().Name)) {
+			return nil, nil, E.New("out of zone record in ", path, ": ", record.String())
+		}
+	}
+	return soa, records, nil
+}
+
+func (t *ZoneTransport) buildRecords() *staticRecords {
+	var records []dns.RR
+	for _, file := range t.files {
+		records = append(records, file.records...)
+	}
+	return newStaticRecords(records, nil)
+}
+
+func (t *ZoneTransport) Name() string {
+	return t.name
+}
+
+func (t *ZoneTransport) Start() error {
+	return nil
+}
+
+func (t *ZoneTransport) Reset() {
+	t.access.Lock()
+	t.checkedAt = time.Time{}
+	t.access.Unlock()
+}
+
+func (t *ZoneTransport) Close() error {
+	return nil
+}
+
+func (t *ZoneTransport) Raw() bool {
+	return true
+}
+
+func (t *ZoneTransport) Lookup(ctx context.Context, domain string, strategy DomainStrategy) ([]netip.Addr, error) {
+	return nil, os.ErrInvalid
+}
+
+func (t *ZoneTransport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	if len(message.Question) != 1 {
+		response := new(dns.Msg)
+		response.SetRcode(message, dns.RcodeFormatError)
+		return response, nil
+	}
+	if message.Question[0].Qclass == dns.ClassINET {
+		response := t.loadRecords(ctx).exchange(message)
+		if response != nil {
+			return response, nil
+		}
+	}
+	response := new(dns.Msg)
+	response.SetRcode(message, dns.RcodeRefused)
+	return response, nil
+}
+
+func (t *ZoneTransport) loadRecords(ctx context.Context) *staticRecords {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if time.Since(t.checkedAt) < zoneCheckInterval {
+		return t.records
+	}
+	t.checkedAt = time.Now()
+	var updated bool
+	for _, file := range t.files {
+		fileInfo, err := os.Stat(file.path)
+		if err != nil || fileInfo.ModTime().Equal(file.modTime) {
+			continue
+		}
+		file.modTime = fileInfo.ModTime()
+		soa, records, err := readZoneFile(file.path, t.origin)
+		if err != nil {
+			t.logger.ErrorContext(ctx, E.Cause(err, "reload zone"))
+			continue
+		}
+		if !strings.EqualFold(soa.Hdr.Name, file.soa.Hdr.Name) {
+			t.logger.ErrorContext(ctx, "reload zone ", file.path, ": apex changed from ", file.soa.Hdr.Name, " to ", soa.Hdr.Name)
+			continue
+		}
+		if soa.Serial == file.soa.Serial {
+			continue
+		}
+		t.logger.InfoContext(ctx, "reloaded zone ", soa.Hdr.Name, " serial ", file.soa.Serial, " -> ", soa.Serial)
+		file.soa = soa
+		file.records = records
+		updated = true
+	}
+	if updated {
+		t.records = t.buildRecords()
+	}
+	return t.records
+}
@@ -0,0 +1,148 @@
+package dns_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-dns"
+	"github.com/sagernet/sing/common/logger"
+	N "github.com/sagernet/sing/common/network"
+
+	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testZoneFile = `$ORIGIN example.internal.
+$TTL 300
+@       IN SOA ns1 hostmaster (
+                SERIAL ; serial
+                3600   ; refresh
+                600    ; retry
+                86400  ; expire
+                60 )   ; minimum
+        IN NS  ns1
+ns1     IN A   10.0.0.53
+www     IN CNAME web
+web     IN A   10.0.0.80
+alias   IN CNAME www
+*.apps  IN A   10.0.1.1
+sub     IN NS  ns.sub
+ns.sub  IN A   10.0.2.53
+$INCLUDE extra.zone
+`
+
+func writeTestZone(t *testing.T, path string, serial string, webAddress string) {
+	content := strings.Replace(testZoneFile, "SERIAL", serial, 1)
+	content = strings.Replace(content, "10.0.0.80", webAddress, 1)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+}
+
+func TestZoneTransport(t *testing.T) {
+	t.Parallel()
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "example.internal.zone")
+	writeTestZone(t, path, "2024010101", "10.0.0.80")
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "extra.zone"), []byte("mail 600 IN A 10.0.0.25\n"), 0o644))
+	transport, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "zone://" + path,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	response, err := transport.Exchange(context.Background(), newTestQuery("alias.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.True(t, response.Authoritative)
+	require.Len(t, response.Answer, 3)
+	require.Equal(t, "10.0.0.80", response.Answer[2].(*mDNS.A).A.String())
+	require.Equal(t, uint32(300), response.Answer[2].Header().Ttl)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("mail.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, uint32(600), response.Answer[0].Header().Ttl)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.internal", mDNS.TypeSOA))
+	require.NoError(t, err)
+	require.True(t, response.Authoritative)
+	require.Len(t, response.Answer, 1)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("host.sub.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.False(t, response.Authoritative)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Len(t, response.Ns, 1)
+	require.Equal(t, "ns.sub.example.internal.", response.Ns[0].(*mDNS.NS).Ns)
+	require.Len(t, response.Extra, 1)
+	require.Equal(t, "10.0.2.53", response.Extra[0].(*mDNS.A).A.String())
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("ns.sub.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.False(t, response.Authoritative)
+	require.Empty(t, response.Answer)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("sub.example.internal", mDNS.TypeDS))
+	require.NoError(t, err)
+	require.True(t, response.Authoritative)
+	require.Empty(t, response.Answer)
+	require.Equal(t, mDNS.TypeSOA, response.Ns[0].Header().Rrtype)
+	require.Equal(t, uint32(60), response.Ns[0].Header().Ttl)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("x.apps.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Len(t, response.Answer, 1)
+	require.Equal(t, "x.apps.example.internal.", response.Answer[0].Header().Name)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("web.example.internal", mDNS.TypeAAAA))
+	require.NoError(t, err)
+	require.True(t, response.Authoritative)
+	require.Equal(t, mDNS.RcodeSuccess, response.Rcode)
+	require.Empty(t, response.Answer)
+	require.Len(t, response.Ns, 1)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("missing.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.True(t, response.Authoritative)
+	require.Equal(t, mDNS.RcodeNameError, response.Rcode)
+	require.Equal(t, mDNS.TypeSOA, response.Ns[0].Header().Rrtype)
+
+	response, err = transport.Exchange(context.Background(), newTestQuery("example.com", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, mDNS.RcodeRefused, response.Rcode)
+
+	writeTestZone(t, path, "2024010101", "10.0.0.81")
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	transport.Reset()
+	response, err = transport.Exchange(context.Background(), newTestQuery("web.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.80", response.Answer[0].(*mDNS.A).A.String())
+
+	writeTestZone(t, path, "2024010102", "10.0.0.81")
+	modTime = modTime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	transport.Reset()
+	response, err = transport.Exchange(context.Background(), newTestQuery("web.example.internal", mDNS.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.81", response.Answer[0].(*mDNS.A).A.String())
+}
+
+func TestZoneTransportInvalid(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "invalid.zone")
+	require.NoError(t, os.WriteFile(path, []byte("$ORIGIN example.internal.\nwww 300 IN A 10.0.0.1\n"), 0o644))
+	_, err := dns.CreateTransport(dns.TransportOptions{
+		Context: context.Background(),
+		Logger:  logger.NOP(),
+		Dialer:  N.SystemDialer,
+		Address: "zone://" + path,
+	})
+	require.ErrorContains(t, err, "missing SOA record")
+}